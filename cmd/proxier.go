@@ -1,26 +1,49 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jademperor/api-proxier/internal/engine"
 	"github.com/jademperor/api-proxier/internal/logger"
+	// plugins registered to be enabled by -plugin flag
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/apikey"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/concurrency"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/extauthz"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/hmacauth"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/introspection"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/jwt"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/rbacauthz"
 	"github.com/jademperor/common/pkg/utils"
 )
 
 var (
-	addr      = flag.String("addr", ":9000", "http server listen on")
+	addr      = flag.String("addr", ":9000", "http server listen on, e.g. :9000 or unix:/var/run/proxier.sock")
 	logpath   = flag.String("logpath", "./logs", "log files folder")
 	debug     = flag.Bool("debug", false, "open debug")
 	plugins   utils.StringArray
 	etcdAddrs utils.StringArray
 )
 
+var (
+	proxyProtocol         = flag.Bool("proxy-protocol", false, "accept PROXY protocol v1/v2 header on listener")
+	upstreamProxyProtocol = flag.Int("upstream-proxy-protocol", 0, "send PROXY protocol header of version (1 or 2) to upstream, 0 means not to send")
+	trustedProxies        utils.StringArray
+	forwardedHeader       = flag.String("forwarded-header", "X-Forwarded-For", "forwarding header maintained by trusted proxies to resolve client IP from, X-Forwarded-For or Forwarded")
+)
+
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	flag.Var(&etcdAddrs, "etcd-addr", "addr of etcd store")
-	flag.Var(&plugins, "plugin", "plugin extension format like: [pluginName:plugin.so:/path/to/config]")
+	flag.Var(&plugins, "plugin", "plugin format like: [pluginName:plugin.so:/path/to/config], or registered plugin [pluginName:/path/to/config] and [pluginName={json config}]")
+	flag.Var(&trustedProxies, "trusted-proxy", "CIDR or IP of trusted proxy to resolve client IP from forwarding headers, and to send PROXY protocol header")
 	flag.Parse()
 
 	// valid command line arguments
@@ -33,13 +56,47 @@ func main() {
 	logger.Init(*logpath, *debug)
 
 	// new engine to run
-	e, err := engine.New(etcdAddrs, plugins, *debug)
+	e, err := engine.New(etcdAddrs, plugins, *debug,
+		engine.WithProxyProtocol(*proxyProtocol),
+		engine.WithUpstreamProxyProtocol(*upstreamProxyProtocol),
+		engine.WithTrustedProxies(trustedProxies),
+		engine.WithForwardedHeader(*forwardedHeader),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// reload plugins on SIGHUP and shutdown gracefully on SIGINT or SIGTERM
+	done := make(chan struct{})
+	go handleSignals(e, done)
+
 	// run the server and serve with http request
 	if err := e.Run(*addr); err != nil {
-		log.Fatal(err)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-done
+	}
+}
+
+func handleSignals(e *engine.Engine, done chan<- struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			logger.Logger.Info("got SIGHUP, reload plugins")
+			e.ReloadPlugins()
+			continue
+		}
+
+		logger.Logger.Infof("got %s, shutdown", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := e.Shutdown(ctx); err != nil {
+			logger.Logger.Errorf("shutdown got error: %v", err)
+		}
+		cancel()
+		close(done)
+		return
 	}
 }
@@ -1,11 +1,14 @@
 module github.com/jademperor/api-proxier
 
 require (
+	github.com/golang/protobuf v1.2.0
 	github.com/jademperor/common v0.0.0-20190306060559-7fb4afe774df
 	github.com/julienschmidt/httprouter v1.2.0
 	github.com/sony/gobreaker v0.0.0-20181109014844-d928aaea92e1
 	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869 // indirect
 	golang.org/x/sys v0.0.0-20181119195503-ec83556a53fe // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8
+	google.golang.org/grpc v1.18.0
 )
 
 replace github.com/jademperor/common => ../common
@@ -0,0 +1,162 @@
+// Package consumer to manage consumers of APIs and their credentials,
+// which are loaded from the config source by engine, and used by auth
+// plugins to identify consumers.
+package consumer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+var (
+	// ErrUnknownKey key not found
+	ErrUnknownKey = errors.New("unknown key")
+	// ErrRevokedKey key or consumer revoked
+	ErrRevokedKey = errors.New("revoked key")
+	// ErrExpiredKey key expired
+	ErrExpiredKey = errors.New("expired key")
+
+	// DefaultStore loaded by engine and used by plugins
+	DefaultStore = NewStore()
+)
+
+// Consumer of APIs
+type Consumer struct {
+	Idx  string `json:"idx"`
+	Name string `json:"name"`
+	// Plan of consumer, like "free" or "pro", to be used by other plugins
+	Plan string `json:"plan"`
+	// Keys API keys of consumer
+	Keys []*Key `json:"keys"`
+	// Secrets to sign requests with HMAC
+	Secrets []*Secret `json:"secrets"`
+	// Revoked all keys of consumer
+	Revoked bool `json:"revoked"`
+	// Metadata of consumer
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Key API key of consumer
+type Key struct {
+	// Key in plaintext
+	Key string `json:"key"`
+	// Hash hex of SHA-256 of key, used if Key is empty, so the key would
+	// not be stored in plaintext
+	Hash    string `json:"hash"`
+	Revoked bool   `json:"revoked"`
+	// ExpiresAt unix seconds of key expired, 0 means never
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// Secret shared with consumer to sign requests, identified by ID
+type Secret struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret"`
+	Revoked bool   `json:"revoked"`
+}
+
+// Hash of key as stored in Key.Hash
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type entry struct {
+	consumer *Consumer
+	key      *Key
+}
+
+type secretEntry struct {
+	consumer *Consumer
+	secret   *Secret
+}
+
+// Store of consumers indexed by hash of keys and ID of secrets
+type Store struct {
+	mutex   sync.RWMutex
+	keys    map[string]*entry
+	secrets map[string]*secretEntry
+}
+
+// NewStore ...
+func NewStore() *Store {
+	return &Store{
+		keys:    make(map[string]*entry),
+		secrets: make(map[string]*secretEntry),
+	}
+}
+
+// Load consumers to replace all loaded, keys duplicated are ignored
+func (s *Store) Load(consumers []*Consumer) {
+	var (
+		keys    = make(map[string]*entry)
+		secrets = make(map[string]*secretEntry)
+	)
+	for _, c := range consumers {
+		for _, sec := range c.Secrets {
+			if dup, ok := secrets[sec.ID]; ok {
+				logger.Logger.Errorf("secret [%s] of consumer [%s] duplicated with [%s], ignored",
+					sec.ID, c.Idx, dup.consumer.Idx)
+				continue
+			}
+			secrets[sec.ID] = &secretEntry{consumer: c, secret: sec}
+		}
+		for _, k := range c.Keys {
+			h := strings.ToLower(k.Hash)
+			if k.Key != "" {
+				h = Hash(k.Key)
+			}
+			if h == "" {
+				continue
+			}
+			if dup, ok := keys[h]; ok {
+				logger.Logger.Errorf("key of consumer [%s] duplicated with [%s], ignored",
+					c.Idx, dup.consumer.Idx)
+				continue
+			}
+			keys[h] = &entry{consumer: c, key: k}
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys, s.secrets = keys, secrets
+}
+
+// Lookup consumer of key at now
+func (s *Store) Lookup(key string, now time.Time) (*Consumer, error) {
+	s.mutex.RLock()
+	e, ok := s.keys[Hash(key)]
+	s.mutex.RUnlock()
+
+	switch {
+	case !ok:
+		return nil, ErrUnknownKey
+	case e.consumer.Revoked || e.key.Revoked:
+		return nil, ErrRevokedKey
+	case e.key.ExpiresAt != 0 && now.Unix() >= e.key.ExpiresAt:
+		return nil, ErrExpiredKey
+	}
+	return e.consumer, nil
+}
+
+// Secret of consumer with id
+func (s *Store) Secret(id string) (*Consumer, []byte, error) {
+	s.mutex.RLock()
+	e, ok := s.secrets[id]
+	s.mutex.RUnlock()
+
+	switch {
+	case !ok:
+		return nil, nil, ErrUnknownKey
+	case e.consumer.Revoked || e.secret.Revoked:
+		return nil, nil, ErrRevokedKey
+	}
+	return e.consumer, []byte(e.secret.Secret), nil
+}
@@ -0,0 +1,63 @@
+package consumer
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_Store(t *testing.T) {
+	now := time.Now()
+	s := NewStore()
+	s.Load([]*Consumer{
+		{Idx: "c1", Plan: "pro", Keys: []*Key{
+			{Key: "k1"},
+			{Hash: Hash("k2")},
+			{Key: "k3", Revoked: true},
+			{Key: "k4", ExpiresAt: now.Unix() - 1},
+		}},
+		{Idx: "c2", Revoked: true, Keys: []*Key{{Key: "k5"}}, Secrets: []*Secret{{ID: "s2", Secret: "x"}}},
+		{Idx: "c4", Secrets: []*Secret{{ID: "s1", Secret: "secret"}, {ID: "s3", Revoked: true}}},
+		// duplicated key is ignored
+		{Idx: "c3", Keys: []*Key{{Key: "k1"}}},
+	})
+
+	cases := []struct {
+		key string
+		idx string
+		err error
+	}{
+		{"k1", "c1", nil},
+		{"k2", "c1", nil},
+		{"k3", "", ErrRevokedKey},
+		{"k4", "", ErrExpiredKey},
+		{"k5", "", ErrRevokedKey},
+		{"k6", "", ErrUnknownKey},
+	}
+	for _, c := range cases {
+		consumer, err := s.Lookup(c.key, now)
+		if err != c.err || (err == nil && consumer.Idx != c.idx) {
+			t.Errorf("%s: want %s %v, got %v %v", c.key, c.idx, c.err, consumer, err)
+		}
+	}
+
+	if c, secret, err := s.Secret("s1"); err != nil || c.Idx != "c4" || string(secret) != "secret" {
+		t.Errorf("want secret of c4, got %v %s %v", c, secret, err)
+	}
+	for id, want := range map[string]error{"s2": ErrRevokedKey, "s3": ErrRevokedKey, "s4": ErrUnknownKey} {
+		if _, _, err := s.Secret(id); err != want {
+			t.Errorf("%s: want %v, got %v", id, want, err)
+		}
+	}
+
+	s.Load(nil)
+	if _, err := s.Lookup("k1", now); err != ErrUnknownKey {
+		t.Errorf("want consumers replaced, got %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package engine
+
+// keys of configs only used by api-proxier, others are defined
+// in package github.com/jademperor/common/configs
+const (
+	// transcodingsKey to store REST/JSON to gRPC transcoding rules
+	transcodingsKey = "/transcodings"
+	// tcpProxiesKey to store L4 TCP proxy rules
+	tcpProxiesKey = "/tcpproxies"
+	// pluginChainsKey to store plugin chains of API and routing rules
+	pluginChainsKey = "/pluginchains"
+	// pluginsKey to store plugin configs, like enablement, order and config
+	pluginsKey = "/plugins"
+	// consumersKey to store consumers of APIs and their credentials
+	consumersKey = "/consumers"
+	// rbacKey to store roles of RBAC, granting methods and paths to consumers
+	rbacKey = "/rbac"
+)
+
+const (
+	// headerRequestID header to pass request ID
+	headerRequestID = "X-Request-Id"
+)
@@ -1,26 +1,37 @@
 package engine
 
 import (
-	// "context"
-	// "encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
 	"net/http"
 	"net/http/pprof"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/jademperor/api-proxier/internal/consumer"
 	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/netaddr"
+	"github.com/jademperor/api-proxier/internal/pluginchain"
 	"github.com/jademperor/api-proxier/internal/proxy"
-	"github.com/jademperor/api-proxier/internal/stdplugin/httplog"
-	"github.com/jademperor/api-proxier/internal/stdplugin/ratelimit"
+	"github.com/jademperor/api-proxier/internal/proxyproto"
+	"github.com/jademperor/api-proxier/internal/rbac"
+	"github.com/jademperor/api-proxier/internal/realip"
+	"github.com/jademperor/api-proxier/internal/tcpproxy"
+	"github.com/jademperor/api-proxier/internal/transcode"
 	"github.com/jademperor/api-proxier/plugin"
 	"github.com/jademperor/common/configs"
 	"github.com/jademperor/common/etcdutils"
 	"github.com/jademperor/common/models"
+	"github.com/jademperor/common/pkg/code"
 	// "go.etcd.io/etcd/client"
 )
 
 // New Engine ...
-func New(etcdAddrs []string, pluginsFlag []string, debug bool) (*Engine, error) {
+func New(etcdAddrs []string, pluginsFlag []string, debug bool, opts ...Option) (*Engine, error) {
 	store, err := etcdutils.NewEtcdStore(etcdAddrs)
 	if err != nil {
 		return nil, err
@@ -31,14 +42,27 @@ func New(etcdAddrs []string, pluginsFlag []string, debug bool) (*Engine, error)
 		store:    store,
 		debug:    debug,
 		debugMux: http.NewServeMux(),
+		plgFlags: make(map[string]string),
+		extCfgs:  make(map[string][]byte),
+		managed:  make(map[string]*managedPlugin),
 		// kapi:    kapi,
 	}
 
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.realIP, err = realip.New(e.trustedProxies, e.forwardedHeader); err != nil {
+		return nil, err
+	}
+	e.proxier.SetRealIP(e.realIP)
+	e.proxier.SetProxyProtocol(e.upstreamProxyProtocol)
+
 	// proxier data loading ...
 	e.prepare()
 
-	e.initPlugins()
-	e.installExtension(pluginsFlag)
+	e.chains = pluginchain.New(nil)
+	e.initPlugins(pluginsFlag)
+	e.preparePluginChains()
 	e.initialWatchers()
 
 	// generate a new contextPool
@@ -54,6 +78,8 @@ func New(etcdAddrs []string, pluginsFlag []string, debug bool) (*Engine, error)
 		e.debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		e.debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		e.debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		e.debugMux.HandleFunc("/debug/plugins", e.pluginsHandler)
+		e.debugMux.Handle("/debug/vars", expvar.Handler())
 	}
 
 	return e, nil
@@ -68,43 +94,39 @@ type Engine struct {
 	contextPool  *plugin.ContextPool
 	debug        bool
 	debugMux     *http.ServeMux
-	// kapi         client.KeysAPI  // etcd client api
-	// addr         string          // gate addr
-}
+	plgFlags     map[string]string // extension flags by plugin name, to load config
+	extCfgs      map[string][]byte // config data applied to extensions by plugin name
+	chains       *pluginchain.Resolver
 
-// initial plugins
-func (e *Engine) initPlugins() {
-	plgHTTPLogger := httplog.New(logger.Logger)
-	plgTokenBucket := ratelimit.New(1000000, 1000)
+	plgMutex   sync.Mutex                // guard allPlugins, managed and extensions
+	managed    map[string]*managedPlugin // plugins from config source by name
+	extensions []plugin.Plugin           // plugins from flags
 
-	// install plugins
-	e.use(plgHTTPLogger)  // idx = 0
-	e.use(plgTokenBucket) // idx = 1
-}
+	proxyProtocol         bool // accept PROXY protocol header on listener
+	upstreamProxyProtocol int  // version of PROXY protocol to send to upstream
 
-func (e *Engine) installExtension(pluginsFlag []string) {
-	for _, plgFlag := range pluginsFlag {
-		plg, err := plugin.InstallExtension(plgFlag)
-		if err != nil {
-			logger.Logger.Errorf("plugin.InstallExtension() got error: %v, skip this", err)
-			continue
-		}
-		if plg == nil {
-			continue
-		}
-		e.use(plg)
-	}
-}
+	trustedProxies  []string         // CIDRs of trusted proxies
+	forwardedHeader string           // forwarding header maintained by trusted proxies
+	realIP          *realip.Resolver // resolver of client IP
 
-func (e *Engine) use(plgs ...plugin.Plugin) {
-	e.allPlugins = append(e.allPlugins, plgs...)
-	e.numAllPlugin += len(plgs)
+	tcpMutex   sync.Mutex
+	tcpRules   []*tcpproxy.Rule            // rules of L4 TCP proxy
+	tcpServers map[string]*tcpproxy.Server // running TCP proxy servers by rule idx
+	running    bool                        // TCP proxy servers only start while running
+	server     *http.Server                // http server, guarded by tcpMutex also
+	closed     bool                        // Shutdown called, Run would not serve
+	// kapi         client.KeysAPI  // etcd client api
+	// addr         string          // gate addr
 }
 
 func (e *Engine) prepare() {
 	e.prepareClusters()
 	e.prepareAPIs()
 	e.prepareRoutings()
+	e.prepareTranscodings()
+	e.prepareTCPProxies()
+	e.prepareConsumers()
+	e.prepareRBAC()
 }
 
 // prepare load clusters info and proxy models into Engine.proxier
@@ -175,6 +197,167 @@ func (e *Engine) prepareRoutings() {
 	e.proxier.LoadRouting(routingCfgs)
 }
 
+func (e *Engine) prepareTranscodings() {
+	var (
+		transcodingCfgs = make([]*transcode.Rule, 0)
+	)
+
+	e.store.Iter(transcodingsKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find transcoding cfg instance: ", k)
+		transcodingCfg := new(transcode.Rule)
+		if err := etcdutils.Decode(v, transcodingCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		transcodingCfgs = append(transcodingCfgs, transcodingCfg)
+	})
+	e.proxier.LoadTranscodings(transcodingCfgs)
+}
+
+func (e *Engine) prepareTCPProxies() {
+	var (
+		tcpProxyCfgs = make([]*tcpproxy.Rule, 0)
+	)
+
+	e.store.Iter(tcpProxiesKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find tcp proxy cfg instance: ", k)
+		tcpProxyCfg := new(tcpproxy.Rule)
+		if err := etcdutils.Decode(v, tcpProxyCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		tcpProxyCfgs = append(tcpProxyCfgs, tcpProxyCfg)
+	})
+
+	e.tcpMutex.Lock()
+	e.tcpRules = tcpProxyCfgs
+	e.tcpMutex.Unlock()
+}
+
+// preparePluginChains load plugin chains, must be called after plugins installed
+func (e *Engine) preparePluginChains() {
+	var (
+		chainCfgs = make([]*pluginchain.Rule, 0)
+	)
+
+	e.store.Iter(pluginChainsKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find plugin chain cfg instance: ", k)
+		chainCfg := new(pluginchain.Rule)
+		if err := etcdutils.Decode(v, chainCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		chainCfgs = append(chainCfgs, chainCfg)
+	})
+	e.chains.Load(chainCfgs)
+}
+
+// prepareConsumers load consumers into consumer.DefaultStore, which is
+// used by auth plugins
+func (e *Engine) prepareConsumers() {
+	var (
+		consumerCfgs = make([]*consumer.Consumer, 0)
+	)
+
+	e.store.Iter(consumersKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find consumer cfg instance: ", k)
+		consumerCfg := new(consumer.Consumer)
+		if err := etcdutils.Decode(v, consumerCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		consumerCfgs = append(consumerCfgs, consumerCfg)
+	})
+	consumer.DefaultStore.Load(consumerCfgs)
+}
+
+// prepareRBAC load roles into rbac.DefaultStore, which is used by the rbac
+// plugin
+func (e *Engine) prepareRBAC() {
+	var (
+		roleCfgs = make([]*rbac.Role, 0)
+	)
+
+	e.store.Iter(rbacKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find rbac role cfg instance: ", k)
+		roleCfg := new(rbac.Role)
+		if err := etcdutils.Decode(v, roleCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		roleCfgs = append(roleCfgs, roleCfg)
+	})
+	rbac.DefaultStore.Load(roleCfgs)
+}
+
+// proxyTrusted peers allowed to send PROXY protocol header, which are the
+// trusted proxies, nil means any peer if no trusted proxies configured
+func (e *Engine) proxyTrusted() func(ip string) bool {
+	if len(e.trustedProxies) == 0 {
+		return nil
+	}
+	return e.realIP.Trusted
+}
+
+// serveTCPProxies start servers with e.tcpRules, only servers of rules
+// changed or removed are closed with their connections.
+func (e *Engine) serveTCPProxies() {
+	e.tcpMutex.Lock()
+	defer e.tcpMutex.Unlock()
+
+	if !e.running {
+		return
+	}
+
+	rules := make(map[string]*tcpproxy.Rule, len(e.tcpRules))
+	for _, rule := range e.tcpRules {
+		if _, dup := rules[rule.Idx]; dup {
+			logger.Logger.Errorf("duplicate tcp proxy rule: %s, so skipped", rule.Idx)
+			continue
+		}
+		rules[rule.Idx] = rule
+	}
+
+	// close servers before starting new ones, which may listen on the same
+	// address
+	servers := make(map[string]*tcpproxy.Server, len(rules))
+	for idx, srv := range e.tcpServers {
+		if rule, ok := rules[idx]; ok && *rule == *srv.Rule() {
+			servers[idx] = srv
+			continue
+		}
+		srv.Close()
+	}
+	for idx, rule := range rules {
+		if _, ok := servers[idx]; ok {
+			continue
+		}
+		srv := tcpproxy.New(rule, e.proxier.Pick, e.proxyTrusted())
+		servers[idx] = srv
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != tcpproxy.ErrServerClosed {
+				logger.Logger.Errorf("tcp proxy [%s] stopped: %v", srv.Rule().Idx, err)
+			}
+		}()
+	}
+	e.tcpServers = servers
+}
+
 // ServeHTTP the implemention of http.Handler
 func (e *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if e.debug && strings.HasPrefix(req.URL.Path, "/debug") {
@@ -184,9 +367,27 @@ func (e *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// ctx := plugin.NewContext(w, req, e.allPlugins)
 	ctx, err := e.contextPool.Get(w, req, plugin.DefaultPreFactory)
 	if err != nil {
-		ctx.SetError(err)
+		logger.Logger.Errorf("contextPool.Get() got error: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(code.NewCodeInfo(code.CodeSystemErr, err.Error()))
 		return
 	}
+	// always put ctx back, even aborted or panicked
+	defer e.contextPool.Put(ctx)
+	defer ctx.Recover("Engine")
+	defer ctx.Finish()
+
+	ctx.ClientIP = e.realIP.ClientIP(req)
+	ctx.SetValue(plugin.KeyClientIP, ctx.ClientIP)
+	ctx.SetValue(plugin.KeyRequestID, requestID(ctx))
+
+	// match route before plugins, and resolve plugin chain of it
+	route, _ := e.proxier.Match(ctx.Method, ctx.Path)
+	ctx.SetRoute(route)
+	plugins, release := e.chains.Resolve(route)
+	ctx.OnFinish(release)
+	ctx.SetPlugins(plugins)
 
 	// start process with plugin
 	ctx.Next()
@@ -196,10 +397,10 @@ func (e *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	e.proxier.Handle(ctx)
-	e.contextPool.Put(ctx)
 }
 
-// Run Engine start listenning and serving by ServeHTTP
+// Run Engine start listenning and serving by ServeHTTP, http.ErrServerClosed
+// returned if Shutdown called, even before Run.
 func (e *Engine) Run(addr string) error {
 	// e.init(addr)
 	logger.Logger.WithFields(map[string]interface{}{
@@ -207,10 +408,81 @@ func (e *Engine) Run(addr string) error {
 		"addr":       addr,
 	}).Info("start listening")
 
+	// start L4 TCP proxies
+	e.tcpMutex.Lock()
+	if e.closed {
+		e.tcpMutex.Unlock()
+		return http.ErrServerClosed
+	}
+	e.running = true
+	e.tcpMutex.Unlock()
+	e.serveTCPProxies()
+
 	timeout := 5 * time.Second
 	if e.debug {
 		timeout = time.Duration(100 * time.Second)
 	}
 	handler := http.TimeoutHandler(e, timeout, configs.TIMEOUT)
-	return http.ListenAndServe(addr, handler)
+
+	l, err := netaddr.Listen(addr)
+	if err != nil {
+		return err
+	}
+	if e.proxyProtocol {
+		if len(e.trustedProxies) == 0 {
+			logger.Logger.Info("PROXY protocol header is accepted from any peer, set -trusted-proxy to restrict")
+		}
+		l = proxyproto.NewListener(l, timeout, e.proxyTrusted())
+	}
+
+	// Serve returns http.ErrServerClosed if Shutdown called after the server
+	// set, or the server is never set if Shutdown called before
+	srv := &http.Server{Handler: handler}
+	e.tcpMutex.Lock()
+	if e.closed {
+		e.tcpMutex.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	e.server = srv
+	e.tcpMutex.Unlock()
+	return srv.Serve(l)
+}
+
+// Shutdown Engine gracefully, stop accepting new connections and wait
+// for active requests until ctx done, then close TCP proxies and plugins.
+// Run would return http.ErrServerClosed.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	e.tcpMutex.Lock()
+	e.running = false
+	e.closed = true
+	srv := e.server
+	for _, tcpSrv := range e.tcpServers {
+		tcpSrv.Close()
+	}
+	e.tcpServers = nil
+	e.tcpMutex.Unlock()
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	e.chains.Close()
+	e.closePlugins()
+	logger.Logger.Info("engine shutdown")
+	return err
+}
+
+// requestID get ID of request from X-Request-Id header or generate one,
+// and set it into the request toward upstream and the response.
+func requestID(ctx *plugin.Context) string {
+	id := ctx.Request().Header.Get(headerRequestID)
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		ctx.Request().Header.Set(headerRequestID, id)
+	}
+	ctx.ResponseWriter().Header().Set(headerRequestID, id)
+	return id
 }
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/pluginchain"
+	"github.com/jademperor/api-proxier/internal/proxy"
+	"github.com/jademperor/api-proxier/internal/tcpproxy"
+)
+
+func Test_Engine_serveTCPProxies(t *testing.T) {
+	e := &Engine{
+		proxier: proxy.New(nil, nil, nil),
+		running: true,
+		tcpRules: []*tcpproxy.Rule{
+			{Idx: "kept", Addr: "127.0.0.1:0", TargetClusterID: "cls"},
+			{Idx: "changed", Addr: "127.0.0.1:0", TargetClusterID: "cls"},
+			{Idx: "removed", Addr: "127.0.0.1:0", TargetClusterID: "cls"},
+		},
+	}
+	e.serveTCPProxies()
+	defer func() {
+		for _, srv := range e.tcpServers {
+			srv.Close()
+		}
+	}()
+	kept, changed := e.tcpServers["kept"], e.tcpServers["changed"]
+
+	e.tcpRules = []*tcpproxy.Rule{
+		{Idx: "kept", Addr: "127.0.0.1:0", TargetClusterID: "cls"},
+		{Idx: "changed", Addr: "127.0.0.1:0", TargetClusterID: "cls", MaxConns: 1},
+		{Idx: "added", Addr: "127.0.0.1:0", TargetClusterID: "cls"},
+	}
+	e.serveTCPProxies()
+
+	if len(e.tcpServers) != 3 || e.tcpServers["added"] == nil || e.tcpServers["removed"] != nil {
+		t.Errorf("want servers of kept, changed and added, got %v", e.tcpServers)
+	}
+	if e.tcpServers["kept"] != kept {
+		t.Error("want server of rule not changed kept")
+	}
+	if e.tcpServers["changed"] == changed || e.tcpServers["changed"].Rule().MaxConns != 1 {
+		t.Error("want server of rule changed restarted")
+	}
+}
+
+func Test_Engine_shutdownBeforeRun(t *testing.T) {
+	e := &Engine{
+		proxier: proxy.New(nil, nil, nil),
+		chains:  pluginchain.New(nil),
+	}
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- e.Run("127.0.0.1:0") }()
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("want %v, got %v", http.ErrServerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want Run returned after Shutdown")
+	}
+	if e.server != nil || e.running {
+		t.Error("want server never started")
+	}
+}
@@ -0,0 +1,36 @@
+package engine
+
+// Option to configure Engine
+type Option func(e *Engine)
+
+// WithProxyProtocol to accept PROXY protocol v1/v2 header on http listener,
+// so the real client address could be recovered behind L4 balancer.
+func WithProxyProtocol(enabled bool) Option {
+	return func(e *Engine) {
+		e.proxyProtocol = enabled
+	}
+}
+
+// WithUpstreamProxyProtocol to send PROXY protocol header of version (1 or 2)
+// to upstream http instances, 0 means not to send.
+func WithUpstreamProxyProtocol(version int) Option {
+	return func(e *Engine) {
+		e.upstreamProxyProtocol = version
+	}
+}
+
+// WithTrustedProxies to trust forwarding headers from proxies in cidrs
+// while resolving client IP.
+func WithTrustedProxies(cidrs []string) Option {
+	return func(e *Engine) {
+		e.trustedProxies = cidrs
+	}
+}
+
+// WithForwardedHeader to resolve client IP from header maintained by trusted
+// proxies, "X-Forwarded-For" (default) or "Forwarded".
+func WithForwardedHeader(header string) Option {
+	return func(e *Engine) {
+		e.forwardedHeader = header
+	}
+}
@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/pluginchain"
+	"github.com/jademperor/api-proxier/plugin"
+	"github.com/jademperor/common/etcdutils"
+	"github.com/jademperor/common/pkg/utils"
+
+	// built-in plugins registered
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/httplog"
+	_ "github.com/jademperor/api-proxier/internal/stdplugin/ratelimit"
+)
+
+var (
+	// plugins enabled if nothing configured in config source
+	defaultPluginCfgs = []*plugin.Config{
+		{Name: "httplog", Enabled: true, Order: 0},
+		{Name: "ratelimit", Enabled: true, Order: 1,
+			Config: json.RawMessage(`{"capacity": 1000000, "rate": 1000}`)},
+	}
+)
+
+// managedPlugin plugin created from config source
+type managedPlugin struct {
+	cfg *plugin.Config
+	plg plugin.Plugin
+}
+
+// initPlugins install extensions from flags and plugins from config source
+func (e *Engine) initPlugins(pluginsFlag []string) {
+	e.installExtension(pluginsFlag)
+	e.preparePlugins()
+}
+
+func (e *Engine) installExtension(pluginsFlag []string) {
+	for _, plgFlag := range pluginsFlag {
+		plg, err := plugin.InstallExtension(plgFlag)
+		if err != nil {
+			logger.Logger.Errorf("plugin.InstallExtension() got error: %v, skip this", err)
+			continue
+		}
+		if plg == nil {
+			continue
+		}
+		e.plgFlags[plg.Name()] = plgFlag
+
+		// init plugin implements plugin.Lifecycle, disable it if got error
+		cfgData, err := e.pluginConfig(plg)
+		if err == nil {
+			err = plugin.Init(plg, cfgData)
+		}
+		if err != nil {
+			logger.Logger.Errorf("plugin [%s] init got error: %v, disable it", plg.Name(), err)
+			plg.Enable(false)
+		}
+		e.extCfgs[plg.Name()] = cfgData
+		e.extensions = append(e.extensions, plg)
+	}
+}
+
+// preparePlugins load plugin configs from config source and apply them:
+// new plugins are created, changed plugins are reloaded (or recreated if
+// plugin.Lifecycle not implemented), and removed plugins are closed.
+// Default plugins are used if nothing configured.
+func (e *Engine) preparePlugins() {
+	var (
+		plgCfgs = make([]*plugin.Config, 0)
+	)
+
+	e.store.Iter(pluginsKey, 1, func(k, v string, dir bool) {
+		if dir {
+			return
+		}
+		logger.Logger.Info("find plugin cfg instance: ", k)
+		plgCfg := new(plugin.Config)
+		if err := etcdutils.Decode(v, plgCfg); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		plgCfgs = append(plgCfgs, plgCfg)
+	})
+	if len(plgCfgs) == 0 {
+		plgCfgs = defaultPluginCfgs
+	}
+	sort.SliceStable(plgCfgs, func(i, j int) bool {
+		return plgCfgs[i].Order < plgCfgs[j].Order
+	})
+
+	e.plgMutex.Lock()
+	var (
+		managed  = make(map[string]*managedPlugin, len(plgCfgs))
+		plgs     = make([]plugin.Plugin, 0, len(plgCfgs)+len(e.extensions))
+		obsolete []plugin.Plugin
+	)
+	for _, cfg := range plgCfgs {
+		if _, dup := managed[cfg.Name]; dup {
+			logger.Logger.Errorf("duplicate plugin cfg: %s, so skipped", cfg.Name)
+			continue
+		}
+		m, old := applyPlugin(e.managed[cfg.Name], cfg)
+		if old != nil {
+			obsolete = append(obsolete, old)
+		}
+		if m == nil {
+			continue
+		}
+		managed[cfg.Name] = m
+		plgs = append(plgs, m.plg)
+	}
+	for name, m := range e.managed {
+		if _, ok := managed[name]; !ok {
+			logger.Logger.Infof("plugin [%s] removed", name)
+			obsolete = append(obsolete, m.plg)
+		}
+	}
+
+	e.managed = managed
+	e.allPlugins = sortPlugins(append(plgs, e.extensions...), managed)
+	e.numAllPlugin = len(e.allPlugins)
+	allPlugins := e.allPlugins
+	entries := chainEntries(allPlugins, managed, e.extCfgs)
+	e.plgMutex.Unlock()
+
+	// obsolete plugins are closed after requests using them finished
+	e.chains.SetPlugins(entries, obsolete)
+	logger.Logger.Infof("effective plugin order: %v", describePlugins(allPlugins, managed))
+}
+
+// applyPlugin apply cfg to plugin m created before (nil if not), returns
+// the plugin applied and the obsolete plugin to be closed. The plugin
+// created before would be kept if cfg could not be applied.
+func applyPlugin(m *managedPlugin, cfg *plugin.Config) (*managedPlugin, plugin.Plugin) {
+	var cfgData []byte
+	if len(cfg.Config) != 0 {
+		cfgData = cfg.Config
+	}
+
+	switch {
+	case m != nil && bytes.Equal(m.cfg.Config, cfg.Config):
+		// config not changed
+		m.plg.Enable(cfg.Enabled)
+		return &managedPlugin{cfg: cfg, plg: m.plg}, nil
+	case m != nil && isLifecycle(m.plg):
+		if err := plugin.Reload(m.plg, cfgData); err != nil {
+			logger.Logger.Errorf("plugin [%s] reload got error: %v, keep the old config", cfg.Name, err)
+			return m, nil
+		}
+		logger.Logger.Infof("plugin [%s] reloaded", cfg.Name)
+		m.plg.Enable(cfg.Enabled)
+		return &managedPlugin{cfg: cfg, plg: m.plg}, nil
+	}
+
+	factory, ok := plugin.Lookup(cfg.Name)
+	if !ok {
+		logger.Logger.Errorf("plugin [%s] not registered, registered: %v", cfg.Name, plugin.Registered())
+		return m, nil
+	}
+	plg, err := factory(cfgData)
+	if err == nil {
+		if err = plugin.Init(plg, cfgData); err != nil {
+			plugin.Close(plg)
+		}
+	}
+	if err != nil {
+		logger.Logger.Errorf("plugin [%s] create got error: %v", cfg.Name, err)
+		return m, nil
+	}
+	logger.Logger.Infof("plugin [%s] created", cfg.Name)
+	plg.Enable(cfg.Enabled)
+
+	var old plugin.Plugin
+	if m != nil {
+		old = m.plg
+	}
+	return &managedPlugin{cfg: cfg, plg: plg}, old
+}
+
+// sortPlugins validate and sort plugins by phase and priority, which could
+// be overridden by configs of managed plugins. Plugins with duplicate name
+// are dropped.
+func sortPlugins(plgs []plugin.Plugin, managed map[string]*managedPlugin) []plugin.Plugin {
+	var (
+		names  = make(map[string]bool, len(plgs))
+		sorted = make([]plugin.Plugin, 0, len(plgs))
+	)
+	for _, plg := range plgs {
+		if names[plg.Name()] {
+			logger.Logger.Errorf("duplicate plugin name: %s, so skipped", plg.Name())
+			continue
+		}
+		names[plg.Name()] = true
+		sorted = append(sorted, plg)
+	}
+
+	plugin.SortPlugins(sorted, func(plg plugin.Plugin) (plugin.Phase, int) {
+		return phaseOf(plg, managed)
+	})
+	return sorted
+}
+
+// phaseOf get phase and priority of plg, overridden by config if set
+func phaseOf(plg plugin.Plugin, managed map[string]*managedPlugin) (plugin.Phase, int) {
+	phase, priority := plugin.PhaseOf(plg)
+	for _, m := range managed {
+		if m.plg != plg {
+			continue
+		}
+		if m.cfg.Phase != "" {
+			if p, err := plugin.ParsePhase(m.cfg.Phase); err != nil {
+				logger.Logger.Errorf("plugin [%s] got error: %v, use phase %s", m.cfg.Name, err, phase)
+			} else {
+				phase = p
+			}
+		}
+		if m.cfg.Priority != nil {
+			priority = *m.cfg.Priority
+		}
+		break
+	}
+	return phase, priority
+}
+
+// chainEntries of plugins named by name registered for plugin chains,
+// extensions are named by Name() with config in extCfgs
+func chainEntries(plgs []plugin.Plugin, managed map[string]*managedPlugin,
+	extCfgs map[string][]byte) []pluginchain.Entry {
+	byPlugin := make(map[plugin.Plugin]*managedPlugin, len(managed))
+	for _, m := range managed {
+		byPlugin[m.plg] = m
+	}
+	entries := make([]pluginchain.Entry, 0, len(plgs))
+	for _, plg := range plgs {
+		entry := pluginchain.Entry{Name: plg.Name(), Plugin: plg, Config: extCfgs[plg.Name()]}
+		if m, ok := byPlugin[plg]; ok {
+			entry.Name, entry.Config = m.cfg.Name, m.cfg.Config
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// pluginInfo effective order of plugin
+type pluginInfo struct {
+	Name     string           `json:"name"`
+	Phase    string           `json:"phase"`
+	Priority int              `json:"priority"`
+	Enabled  bool             `json:"enabled"`
+	Status   plugin.PlgStatus `json:"status"`
+}
+
+func (i pluginInfo) String() string {
+	return fmt.Sprintf("%s(%s,%d)", i.Name, i.Phase, i.Priority)
+}
+
+func describePlugins(plgs []plugin.Plugin, managed map[string]*managedPlugin) []pluginInfo {
+	infos := make([]pluginInfo, 0, len(plgs))
+	for _, plg := range plgs {
+		phase, priority := phaseOf(plg, managed)
+		infos = append(infos, pluginInfo{
+			Name:     plg.Name(),
+			Phase:    phase.String(),
+			Priority: priority,
+			Enabled:  plg.Enabled(),
+			Status:   plg.Status(),
+		})
+	}
+	return infos
+}
+
+// pluginsHandler expose the effective order of plugins and chains
+func (e *Engine) pluginsHandler(w http.ResponseWriter, req *http.Request) {
+	e.plgMutex.Lock()
+	infos := describePlugins(e.allPlugins, e.managed)
+	e.plgMutex.Unlock()
+
+	utils.ResponseJSON(w, map[string]interface{}{
+		"plugins": infos,
+		"chains":  e.chains.Describe(),
+	})
+}
+
+func isLifecycle(plg plugin.Plugin) bool {
+	_, ok := plg.(plugin.Lifecycle)
+	return ok
+}
+
+// ReloadPlugins reload extensions with config loaded again, and apply
+// plugin configs from config source.
+func (e *Engine) ReloadPlugins() {
+	e.plgMutex.Lock()
+	extensions := e.extensions
+	e.plgMutex.Unlock()
+
+	for _, plg := range extensions {
+		cfgData, err := e.pluginConfig(plg)
+		if err != nil {
+			logger.Logger.Errorf("plugin [%s] load config got error: %v, skip reloading", plg.Name(), err)
+			continue
+		}
+		if err = plugin.Reload(plg, cfgData); err != nil {
+			logger.Logger.Errorf("plugin [%s] reload got error: %v", plg.Name(), err)
+			continue
+		}
+		e.plgMutex.Lock()
+		e.extCfgs[plg.Name()] = cfgData
+		e.plgMutex.Unlock()
+		logger.Logger.Infof("plugin [%s] reloaded, status: %s", plg.Name(), plg.Status())
+	}
+	e.preparePlugins()
+}
+
+// closePlugins close plugins implement plugin.Lifecycle
+func (e *Engine) closePlugins() {
+	e.plgMutex.Lock()
+	allPlugins := e.allPlugins
+	e.plgMutex.Unlock()
+
+	for _, plg := range allPlugins {
+		if err := plugin.Close(plg); err != nil {
+			logger.Logger.Errorf("plugin [%s] close got error: %v", plg.Name(), err)
+		}
+	}
+}
+
+// pluginConfig load config data of extension plg
+func (e *Engine) pluginConfig(plg plugin.Plugin) ([]byte, error) {
+	plgFlag, ok := e.plgFlags[plg.Name()]
+	if !ok {
+		return nil, nil
+	}
+	return plugin.LoadExtensionConfig(plgFlag)
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+	plugin.Register("engine-test", func(cfgData []byte) (plugin.Plugin, error) {
+		return &testPlugin{cfg: string(cfgData), enabled: true}, nil
+	})
+}
+
+type testPlugin struct {
+	cfg     string
+	enabled bool
+}
+
+func (p *testPlugin) Handle(ctx *plugin.Context) { ctx.Next() }
+func (p *testPlugin) Status() plugin.PlgStatus   { return plugin.Working }
+func (p *testPlugin) Enabled() bool              { return p.enabled }
+func (p *testPlugin) Name() string               { return "plugin.engine-test" }
+func (p *testPlugin) Enable(enabled bool)        { p.enabled = enabled }
+
+func Test_applyPlugin(t *testing.T) {
+	cfg := &plugin.Config{Name: "engine-test", Enabled: true, Config: json.RawMessage(`{"v":1}`)}
+	m, old := applyPlugin(nil, cfg)
+	if m == nil || old != nil || m.plg.(*testPlugin).cfg != `{"v":1}` {
+		t.Fatalf("want plugin created, got %+v %v", m, old)
+	}
+	created := m.plg
+
+	// config not changed but disabled
+	m, old = applyPlugin(m, &plugin.Config{Name: "engine-test", Enabled: false, Config: json.RawMessage(`{"v":1}`)})
+	if m.plg != created || old != nil || created.Enabled() {
+		t.Errorf("want the same plugin disabled, got %+v %v", m, old)
+	}
+
+	// config changed, recreated since plugin.Lifecycle not implemented
+	m, old = applyPlugin(m, &plugin.Config{Name: "engine-test", Enabled: true, Config: json.RawMessage(`{"v":2}`)})
+	if m.plg == created || old != created || m.plg.(*testPlugin).cfg != `{"v":2}` {
+		t.Errorf("want plugin recreated, got %+v %v", m, old)
+	}
+
+	// not registered
+	if m, _ = applyPlugin(nil, &plugin.Config{Name: "unknown"}); m != nil {
+		t.Errorf("want nil of unregistered plugin, got %+v", m)
+	}
+}
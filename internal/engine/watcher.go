@@ -12,11 +12,16 @@ import (
 )
 
 var (
-	clusterWatcher  *etcdutils.Watcher // cluster watcher
-	apisWatcher     *etcdutils.Watcher
-	routingsWatcher *etcdutils.Watcher
+	clusterWatcher      *etcdutils.Watcher // cluster watcher
+	apisWatcher         *etcdutils.Watcher
+	routingsWatcher     *etcdutils.Watcher
+	transcodingsWatcher *etcdutils.Watcher
+	tcpProxiesWatcher   *etcdutils.Watcher
+	pluginChainsWatcher *etcdutils.Watcher
+	pluginsWatcher      *etcdutils.Watcher
+	consumersWatcher    *etcdutils.Watcher
+	rbacWatcher         *etcdutils.Watcher
 	// cacheWatcher    *etcdutils.Watcher // cache watcher
-	// rbacWatcher     *etcdutils.Watcher // rabc plugin watcher
 	// etc
 
 	defaultDuration = 2 * time.Second
@@ -28,14 +33,24 @@ func (e *Engine) initialWatchers() {
 	clusterWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, configs.ClustersKey)
 	apisWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, configs.APIsKey)
 	routingsWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, configs.RoutingsKey)
-	// rbacWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, configs.RbacKey)
+	transcodingsWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, transcodingsKey)
+	tcpProxiesWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, tcpProxiesKey)
+	pluginChainsWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, pluginChainsKey)
+	pluginsWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, pluginsKey)
+	consumersWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, consumersKey)
+	rbacWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, rbacKey)
 	// cacheWatcher = etcdutils.NewWatcher(e.store.Kapi, defaultDuration, configs.CacheKey)
 
 	go clusterWatcher.Watch(e.clusterCallback)
 	go apisWatcher.Watch(e.apisCallback)
 	go routingsWatcher.Watch(e.routingsCallback)
+	go transcodingsWatcher.Watch(e.transcodingsCallback)
+	go tcpProxiesWatcher.Watch(e.tcpProxiesCallback)
+	go pluginChainsWatcher.Watch(e.pluginChainsCallback)
+	go pluginsWatcher.Watch(e.pluginsCallback)
+	go consumersWatcher.Watch(e.consumersCallback)
+	go rbacWatcher.Watch(e.rbacCallback)
 	// go cacheWatcher.Watch(e.cacheCallback)
-	// go rbacWatcher.Watch(e.rbacCallback)
 }
 
 func (e *Engine) clusterCallback(op etcdutils.OpCode, k, v string) {
@@ -63,3 +78,39 @@ func (e *Engine) routingsCallback(op etcdutils.OpCode, k, v string) {
 	logger.Logger.Infof("routings Op: %d, key: %s, value: %s", op, k, v)
 	e.prepareRoutings()
 }
+
+func (e *Engine) transcodingsCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("transcodings Op: %d, key: %s, value: %s", op, k, v)
+	e.prepareTranscodings()
+}
+
+func (e *Engine) tcpProxiesCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("tcp proxies Op: %d, key: %s, value: %s", op, k, v)
+	e.prepareTCPProxies()
+	e.serveTCPProxies()
+}
+
+// pluginChainsCallback value is not logged, which may contain secrets in
+// plugin config overrides
+func (e *Engine) pluginChainsCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("plugin chains Op: %d, key: %s", op, k)
+	e.preparePluginChains()
+}
+
+// pluginsCallback value is not logged, which contains secrets in plugin
+// configs, like keys of JWT and password of redis
+func (e *Engine) pluginsCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("plugins Op: %d, key: %s", op, k)
+	e.preparePlugins()
+}
+
+// consumersCallback value is not logged, which contains keys of consumer
+func (e *Engine) consumersCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("consumers Op: %d, key: %s", op, k)
+	e.prepareConsumers()
+}
+
+func (e *Engine) rbacCallback(op etcdutils.OpCode, k, v string) {
+	logger.Logger.Infof("rbac Op: %d, key: %s, value: %s", op, k, v)
+	e.prepareRBAC()
+}
@@ -0,0 +1,47 @@
+// Package netaddr parse addresses of both TCP and unix domain socket
+package netaddr
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// Parse addr into network and address, addr could be like:
+// "unix:/path/to.sock", "unix:///path/to.sock", "http://host:port",
+// "tcp://host:port" or "host:port".
+func Parse(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if strings.HasPrefix(path, "//") {
+			path = strings.TrimPrefix(path, "//")
+		}
+		return "unix", path
+	}
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			return "tcp", u.Host
+		}
+	}
+	return "tcp", addr
+}
+
+// IsUnix check addr is a unix domain socket or not
+func IsUnix(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// Listen on addr, the stale socket file would be removed before
+// listening on unix domain socket.
+func Listen(addr string) (net.Listener, error) {
+	network, address := Parse(addr)
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
@@ -0,0 +1,71 @@
+package netaddr
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Parse(t *testing.T) {
+	cases := []struct {
+		addr        string
+		wantNetwork string
+		wantAddress string
+	}{
+		{"unix:/var/run/app.sock", "unix", "/var/run/app.sock"},
+		{"unix:///var/run/app.sock", "unix", "/var/run/app.sock"},
+		{"unix:app.sock", "unix", "app.sock"},
+		{"http://127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{"tcp://127.0.0.1:6379", "tcp", "127.0.0.1:6379"},
+		{"127.0.0.1:6379", "tcp", "127.0.0.1:6379"},
+		{":9000", "tcp", ":9000"},
+	}
+
+	for _, c := range cases {
+		network, address := Parse(c.addr)
+		if network != c.wantNetwork || address != c.wantAddress {
+			t.Errorf("%s: want %s %s, got %s %s",
+				c.addr, c.wantNetwork, c.wantAddress, network, address)
+		}
+	}
+}
+
+func Test_Listen_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netaddr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxier.sock")
+
+	// leave a stale socket file
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen with stale socket got error: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, _ := ioutil.ReadAll(conn); string(b) != "ok" {
+		t.Errorf("want ok, got %q", b)
+	}
+}
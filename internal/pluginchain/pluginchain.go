@@ -0,0 +1,343 @@
+// Package pluginchain resolve chain of plugins to run for API and routing
+// rules, with include/exclude lists and per-route plugin config overrides.
+package pluginchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+// Rule of plugin chain for an API or routing rule. Plugins are named by
+// the name registered, like "ratelimit" in plugin configs of the config
+// source, or Name() of extensions installed by -plugin flag.
+type Rule struct {
+	Idx       string `json:"idx"`
+	APIID     string `json:"api_id"`     // idx of API rule
+	RoutingID string `json:"routing_id"` // idx of routing rule
+	// Include names of plugins to run only, empty means all plugins
+	Include []string `json:"include"`
+	// Exclude names of plugins to skip
+	Exclude []string `json:"exclude"`
+	// Configs plugin config overrides by plugin name, plugin must
+	// implement plugin.Deriver to be overridden
+	Configs map[string]json.RawMessage `json:"configs"`
+}
+
+// Entry of plugin with name registered, which is used by Rule
+type Entry struct {
+	Name   string
+	Plugin plugin.Plugin
+	// Config data applied to plugin, plugins derived from it are derived
+	// again only if the plugin is replaced or its config changed
+	Config []byte
+}
+
+// New a Resolver with all plugins in order, which is also the default chain
+func New(entries []Entry) *Resolver {
+	r := &Resolver{
+		apiChains:     make(map[string]*chain),
+		routingChains: make(map[string]*chain),
+		derivations:   make(map[string]*derivation),
+		gen:           &generation{done: make(chan struct{})},
+	}
+	r.setEntries(entries)
+	return r
+}
+
+// Resolver of plugin chains
+type Resolver struct {
+	loadMutex     sync.Mutex             // serialize loading
+	rules         []*Rule                // rules loaded, to rebuild chains
+	derivations   map[string]*derivation // plugins derived by rule idx and plugin name
+	mutex         sync.RWMutex
+	entries       []Entry           // all plugins
+	all           *chain            // chain of all plugins
+	apiChains     map[string]*chain // chains by API rule idx
+	routingChains map[string]*chain // chains by routing rule idx
+	gen           *generation       // generation of chains resolved by requests
+}
+
+// chain of plugins, with names registered
+type chain struct {
+	plugins []plugin.Plugin
+	names   []string
+}
+
+// derivation of plugin in chain, reused while rebuilding chains if the
+// parent and configs not changed
+type derivation struct {
+	parent    plugin.Plugin
+	parentCfg []byte
+	cfg       []byte
+	derived   plugin.Plugin // derived by parent, to be closed
+	plg       plugin.Plugin // derived plugin wrapped in chain
+}
+
+// generation of chains, plugins obsolete after a generation replaced are
+// closed after requests of the generation and older ones finished
+type generation struct {
+	wg   sync.WaitGroup // requests resolved chains of the generation
+	prev *generation
+	done chan struct{} // closed after requests of this and older generations finished
+}
+
+// retire the generation, obsolete plugins are closed after requests of it
+// and older generations finished
+func (g *generation) retire(obsolete []plugin.Plugin) {
+	g.wg.Wait()
+	if g.prev != nil {
+		<-g.prev.done
+		g.prev = nil
+	}
+	closePlugins(obsolete)
+	close(g.done)
+}
+
+// setEntries of all plugins, mutex should be held
+func (r *Resolver) setEntries(entries []Entry) {
+	r.entries = entries
+	r.all = &chain{
+		plugins: make([]plugin.Plugin, 0, len(entries)),
+		names:   make([]string, 0, len(entries)),
+	}
+	for _, e := range entries {
+		r.all.plugins = append(r.all.plugins, e.Plugin)
+		r.all.names = append(r.all.names, e.Name)
+	}
+}
+
+// Load rules to build chains, plugins derived by last loading would be
+// closed after requests using them finished, unless they are reused.
+func (r *Resolver) Load(rules []*Rule) {
+	r.loadMutex.Lock()
+	defer r.loadMutex.Unlock()
+	r.rules = rules
+	retire := r.load(nil)
+	go retire()
+}
+
+// SetPlugins set all plugins in order, and rebuild chains with rules
+// loaded, only plugins replaced or with config changed are derived again.
+// obsolete plugins replaced or removed would be closed after requests using
+// the last chains finished.
+func (r *Resolver) SetPlugins(entries []Entry, obsolete []plugin.Plugin) {
+	r.loadMutex.Lock()
+	defer r.loadMutex.Unlock()
+
+	r.mutex.Lock()
+	r.setEntries(entries)
+	r.mutex.Unlock()
+	retire := r.load(obsolete)
+	go retire()
+}
+
+// load chains of rules, returns func to retire the last generation, which
+// blocks until obsolete plugins and plugins derived by the last generation
+// closed. loadMutex should be held.
+func (r *Resolver) load(obsolete []plugin.Plugin) func() {
+	var (
+		apiChains     = make(map[string]*chain)
+		routingChains = make(map[string]*chain)
+		derivations   = make(map[string]*derivation, len(r.derivations))
+	)
+	for _, rule := range r.rules {
+		c := r.build(rule, derivations)
+		if rule.APIID != "" {
+			apiChains[rule.APIID] = c
+		}
+		if rule.RoutingID != "" {
+			routingChains[rule.RoutingID] = c
+		}
+		logger.Logger.Infof("plugin chain [%s] registered with plugins: %v", rule.Idx, c.names)
+	}
+
+	for _, d := range r.derivations {
+		obsolete = append(obsolete, d.derived)
+	}
+	r.derivations = derivations
+
+	r.mutex.Lock()
+	r.apiChains, r.routingChains = apiChains, routingChains
+	old := r.gen
+	r.gen = &generation{prev: old, done: make(chan struct{})}
+	r.mutex.Unlock()
+
+	return func() { old.retire(obsolete) }
+}
+
+// Close plugins derived by chains, chains are cleared also, it blocks until
+// requests using them finished
+func (r *Resolver) Close() {
+	r.loadMutex.Lock()
+	defer r.loadMutex.Unlock()
+	r.rules = nil
+	r.load(nil)()
+}
+
+// Resolve chain of matched route, all plugins returned if route is nil
+// or no chain configured. release must be called after request finished,
+// so obsolete plugins in chain could be closed.
+func (r *Resolver) Resolve(route *plugin.Route) (plugins []plugin.Plugin, release func()) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	r.gen.wg.Add(1)
+	release = r.gen.wg.Done
+
+	var (
+		c  *chain
+		ok bool
+	)
+	if route != nil {
+		switch route.Kind {
+		case plugin.RouteAPI:
+			c, ok = r.apiChains[route.RuleID()]
+		case plugin.RouteRouting:
+			c, ok = r.routingChains[route.RuleID()]
+		}
+	}
+	if !ok {
+		c = r.all
+	}
+	return c.plugins, release
+}
+
+// Describe names of plugins in chains, keyed by "api/{idx}" or
+// "routing/{idx}", and "default" for all plugins.
+func (r *Resolver) Describe() map[string][]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	chains := make(map[string][]string, len(r.apiChains)+len(r.routingChains)+1)
+	chains["default"] = r.all.names
+	for idx, chain := range r.apiChains {
+		chains["api/"+idx] = chain.names
+	}
+	for idx, chain := range r.routingChains {
+		chains["routing/"+idx] = chain.names
+	}
+	return chains
+}
+
+// build chain of rule, plugins derived with config overrides are stored
+// into derivations, derivations of last loading are reused if not changed.
+func (r *Resolver) build(rule *Rule, derivations map[string]*derivation) *chain {
+	var (
+		include = toSet(rule.Include)
+		exclude = toSet(rule.Exclude)
+		c       = &chain{
+			plugins: make([]plugin.Plugin, 0, len(r.entries)),
+			names:   make([]string, 0, len(r.entries)),
+		}
+	)
+	for i, e := range r.entries {
+		name, plg := e.Name, e.Plugin
+		if len(include) != 0 && !include[name] {
+			continue
+		}
+		if exclude[name] {
+			continue
+		}
+
+		if cfgData, ok := rule.Configs[name]; ok {
+			// suffixed with index of entry if duplicated, to be stable across
+			// loadings as long as rules and entries are in the same order
+			key := rule.Idx + "/" + name
+			for _, dup := derivations[key]; dup; _, dup = derivations[key] {
+				key += "#" + strconv.Itoa(i)
+			}
+			if d, ok := r.derivations[key]; ok && d.parent == plg &&
+				bytes.Equal(d.parentCfg, e.Config) && bytes.Equal(d.cfg, cfgData) {
+				delete(r.derivations, key)
+				derivations[key] = d
+				c.add(name, d.plg)
+				continue
+			}
+
+			d, ok := plg.(plugin.Deriver)
+			if !ok {
+				logger.Logger.Errorf("plugin [%s] could not be overridden in chain [%s], use as is",
+					name, rule.Idx)
+				c.add(name, plg)
+				continue
+			}
+			// keep the plugin as is rather than skip it, since it may be
+			// an auth plugin
+			derivedPlg, err := d.Derive(cfgData)
+			if err != nil {
+				logger.Logger.Errorf("plugin [%s] derive in chain [%s] got error: %v, use as is",
+					name, rule.Idx, err)
+				c.add(name, plg)
+				continue
+			}
+			derivations[key] = &derivation{
+				parent:    plg,
+				parentCfg: e.Config,
+				cfg:       cfgData,
+				derived:   derivedPlg,
+				plg:       newDerived(plg, derivedPlg),
+			}
+			plg = derivations[key].plg
+		}
+		c.add(name, plg)
+	}
+	return c
+}
+
+func (c *chain) add(name string, plg plugin.Plugin) {
+	c.plugins = append(c.plugins, plg)
+	c.names = append(c.names, name)
+}
+
+// derivedPlugin in chain, enabled only while the parent is enabled also, so
+// plugin disabled by config or for panicking repeatedly is skipped on
+// routes overriding its config too.
+type derivedPlugin struct {
+	plugin.Plugin
+	parent plugin.Plugin
+}
+
+// derivedResponder derivedPlugin implements plugin.ResponseHandler
+type derivedResponder struct {
+	*derivedPlugin
+	plugin.ResponseHandler
+}
+
+func newDerived(parent, plg plugin.Plugin) plugin.Plugin {
+	d := &derivedPlugin{Plugin: plg, parent: parent}
+	if h, ok := plg.(plugin.ResponseHandler); ok {
+		return &derivedResponder{d, h}
+	}
+	return d
+}
+
+// Enabled ...
+func (d *derivedPlugin) Enabled() bool {
+	return d.parent.Enabled() && d.Plugin.Enabled()
+}
+
+// Enable the parent, since derived plugin follows it
+func (d *derivedPlugin) Enable(enabled bool) {
+	d.parent.Enable(enabled)
+}
+
+func closePlugins(plgs []plugin.Plugin) {
+	for _, plg := range plgs {
+		if err := plugin.Close(plg); err != nil {
+			logger.Logger.Errorf("plugin [%s] close got error: %v", plg.Name(), err)
+		}
+	}
+}
+
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
@@ -0,0 +1,266 @@
+package pluginchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+	"github.com/jademperor/common/models"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+type fakePlugin struct {
+	name     string
+	cfg      string
+	closed   int32 // accessed atomically, closed in background
+	disabled bool
+}
+
+func (p *fakePlugin) Handle(ctx *plugin.Context)  { ctx.Next() }
+func (p *fakePlugin) Status() plugin.PlgStatus    { return plugin.Working }
+func (p *fakePlugin) Enabled() bool               { return !p.disabled }
+func (p *fakePlugin) Name() string                { return "plugin." + p.name }
+func (p *fakePlugin) Enable(enabled bool)         { p.disabled = !enabled }
+func (p *fakePlugin) Init(cfgData []byte) error   { return nil }
+func (p *fakePlugin) Reload(cfgData []byte) error { return nil }
+func (p *fakePlugin) Close() error                { atomic.StoreInt32(&p.closed, 1); return nil }
+
+// isClosed wait a while for p closed in background
+func (p *fakePlugin) isClosed() bool {
+	for i := 0; i < 100 && atomic.LoadInt32(&p.closed) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return atomic.LoadInt32(&p.closed) == 1
+}
+
+func (p *fakePlugin) Derive(cfgData []byte) (plugin.Plugin, error) {
+	return &fakePlugin{name: p.name, cfg: string(cfgData)}, nil
+}
+
+// fakeResponder implements plugin.ResponseHandler
+type fakeResponder struct{ fakePlugin }
+
+func (p *fakeResponder) HandleResponse(ctx *plugin.Context, resp *http.Response) error { return nil }
+
+func (p *fakeResponder) Derive(cfgData []byte) (plugin.Plugin, error) {
+	return &fakeResponder{fakePlugin{name: p.name, cfg: string(cfgData)}}, nil
+}
+
+func apiRoute(idx string) *plugin.Route {
+	return &plugin.Route{Kind: plugin.RouteAPI, API: &models.API{Idx: idx}}
+}
+
+func Test_Resolver(t *testing.T) {
+	var (
+		auth  = &fakePlugin{name: "auth"}
+		limit = &fakePlugin{name: "limit"}
+		log   = &fakePlugin{name: "log"}
+	)
+	// chains use names registered rather than Name() of plugins
+	r := New([]Entry{{Name: "log", Plugin: log}, {Name: "auth", Plugin: auth}, {Name: "limit", Plugin: limit}})
+	r.Load([]*Rule{
+		{Idx: "admin", APIID: "api-admin", Include: []string{"log", "auth"}},
+		{Idx: "health", RoutingID: "routing-health", Exclude: []string{"auth", "limit"}},
+		{Idx: "burst", APIID: "api-burst", Configs: map[string]json.RawMessage{
+			"limit": json.RawMessage(`{"rate":100}`),
+		}},
+	})
+
+	cases := []struct {
+		name  string
+		route *plugin.Route
+		want  string
+	}{
+		{"include", apiRoute("api-admin"), "[log auth]"},
+		{"exclude", &plugin.Route{Kind: plugin.RouteRouting, Routing: &models.Routing{Idx: "routing-health"}}, "[log]"},
+		{"override", apiRoute("api-burst"), "[log auth limit]"},
+		{"unknown", apiRoute("api-unknown"), "[log auth limit]"},
+		{"not matched", nil, "[log auth limit]"},
+		{"transcoding", &plugin.Route{Kind: plugin.RouteTranscoding}, "[log auth limit]"},
+	}
+	for _, c := range cases {
+		var got []string
+		chain, release := r.Resolve(c.route)
+		for _, plg := range chain {
+			got = append(got, strings.TrimPrefix(plg.Name(), "plugin."))
+		}
+		release()
+		if fmt.Sprint(got) != c.want {
+			t.Errorf("%s: want chain %s, got %v", c.name, c.want, got)
+		}
+	}
+	if got := fmt.Sprint(r.Describe()["api/api-admin"]); got != "[log auth]" {
+		t.Errorf("want chain described with names registered, got %s", got)
+	}
+
+	chain, release := r.Resolve(apiRoute("api-burst"))
+	derived := chain[2].(*derivedPlugin).Plugin.(*fakePlugin)
+	if derived == limit || derived.cfg != `{"rate":100}` {
+		t.Errorf("want limit derived with config override, got %+v", derived)
+	}
+
+	// closed after requests using it finished
+	r.Load(nil)
+	if derived.isClosed() {
+		t.Error("want derived plugin not closed while in use")
+	}
+	release()
+	if !derived.isClosed() {
+		t.Error("want derived plugin closed after reloading")
+	}
+	if atomic.LoadInt32(&limit.closed) == 1 {
+		t.Error("want origin plugin not closed")
+	}
+}
+
+func Test_Resolver_rederive(t *testing.T) {
+	var (
+		auth  = &fakePlugin{name: "auth"}
+		limit = &fakePlugin{name: "limit"}
+		rules = []*Rule{{Idx: "burst", APIID: "api-burst", Configs: map[string]json.RawMessage{
+			"auth":  json.RawMessage(`{"scopes":["read"]}`),
+			"limit": json.RawMessage(`{"rate":100}`),
+		}}}
+		derived = func(r *Resolver) (*fakePlugin, *fakePlugin) {
+			chain, release := r.Resolve(apiRoute("api-burst"))
+			defer release()
+			return chain[0].(*derivedPlugin).Plugin.(*fakePlugin),
+				chain[1].(*derivedPlugin).Plugin.(*fakePlugin)
+		}
+	)
+	r := New([]Entry{{Name: "auth", Plugin: auth}, {Name: "limit", Plugin: limit, Config: []byte(`{"rate":10}`)}})
+	r.Load(rules)
+	oldAuth, oldLimit := derived(r)
+
+	// config of limit changed, only limit derived again
+	r.SetPlugins([]Entry{{Name: "auth", Plugin: auth}, {Name: "limit", Plugin: limit, Config: []byte(`{"rate":20}`)}}, nil)
+	newAuth, newLimit := derived(r)
+	if newAuth != oldAuth || oldAuth.isClosed() {
+		t.Error("want derived auth reused and not closed")
+	}
+	if newLimit == oldLimit || !oldLimit.isClosed() {
+		t.Error("want limit derived again and the old closed")
+	}
+
+	// auth replaced
+	auth = &fakePlugin{name: "auth"}
+	r.SetPlugins([]Entry{{Name: "auth", Plugin: auth}, {Name: "limit", Plugin: limit, Config: []byte(`{"rate":20}`)}}, nil)
+	if a, l := derived(r); a == newAuth || l != newLimit || !newAuth.isClosed() {
+		t.Error("want auth derived again, and limit reused")
+	}
+
+	// override changed
+	rules[0].Configs["limit"] = json.RawMessage(`{"rate":200}`)
+	r.Load(rules)
+	if _, l := derived(r); l == newLimit || l.cfg != `{"rate":200}` || !newLimit.isClosed() {
+		t.Error("want limit derived again with override changed")
+	}
+
+	r.Close()
+	if chain, _ := r.Resolve(apiRoute("api-burst")); chain[0] != auth {
+		t.Error("want chains cleared")
+	}
+}
+
+func Test_Resolver_duplicateKey(t *testing.T) {
+	var (
+		limit  = &fakePlugin{name: "limit"}
+		limit2 = &fakePlugin{name: "limit"}
+		rules  = []*Rule{
+			{Idx: "a", APIID: "api-a", Configs: map[string]json.RawMessage{"limit": json.RawMessage(`{"rate":1}`)}},
+			{Idx: "b", APIID: "api-b", Configs: map[string]json.RawMessage{"limit": json.RawMessage(`{"rate":2}`)}},
+		}
+		derived = func(r *Resolver) *fakePlugin {
+			chain, release := r.Resolve(apiRoute("api-b"))
+			defer release()
+			return chain[1].(*derivedPlugin).Plugin.(*fakePlugin)
+		}
+	)
+	// entries registered with the same name are derived separately
+	r := New([]Entry{{Name: "limit", Plugin: limit}, {Name: "limit", Plugin: limit2}})
+	r.Load(rules)
+	old := derived(r)
+
+	// override of another rule removed, derivations of rule b are reused
+	rules[0].Configs = nil
+	r.Load(rules)
+	if d := derived(r); d != old || old.isClosed() {
+		t.Error("want duplicated derivation reused and not closed")
+	}
+}
+
+func Test_Resolver_SetPlugins(t *testing.T) {
+	var (
+		auth  = &fakePlugin{name: "auth"}
+		limit = &fakePlugin{name: "limit"}
+	)
+	r := New([]Entry{{Name: "auth", Plugin: auth}, {Name: "limit", Plugin: limit}})
+	chain, release := r.Resolve(nil)
+	if len(chain) != 2 {
+		t.Fatalf("want all plugins, got %v", chain)
+	}
+
+	// limit removed while still in use
+	r.SetPlugins([]Entry{{Name: "auth", Plugin: auth}}, []plugin.Plugin{limit})
+	if chain, release := r.Resolve(nil); len(chain) != 1 {
+		t.Errorf("want limit removed, got %v", chain)
+	} else {
+		release()
+	}
+	if limit.isClosed() {
+		t.Error("want obsolete plugin not closed while in use")
+	}
+	release()
+	if !limit.isClosed() {
+		t.Error("want obsolete plugin closed after requests finished")
+	}
+	if atomic.LoadInt32(&auth.closed) == 1 {
+		t.Error("want plugin kept not closed")
+	}
+}
+
+func Test_Resolver_derivedEnabled(t *testing.T) {
+	var (
+		limit = &fakePlugin{name: "limit"}
+		cache = &fakeResponder{fakePlugin{name: "cache"}}
+	)
+	r := New([]Entry{{Name: "limit", Plugin: limit}, {Name: "cache", Plugin: cache}})
+	r.Load([]*Rule{{Idx: "burst", APIID: "api-burst", Configs: map[string]json.RawMessage{
+		"limit": json.RawMessage(`{"rate":100}`),
+		"cache": json.RawMessage(`{"ttl":10}`),
+	}}})
+	chain, release := r.Resolve(apiRoute("api-burst"))
+	defer release()
+	if _, ok := chain[1].(plugin.ResponseHandler); !ok {
+		t.Error("want derived plugin still a ResponseHandler")
+	}
+	if _, ok := chain[0].(plugin.ResponseHandler); ok {
+		t.Error("want derived plugin not a ResponseHandler")
+	}
+
+	// parent disabled by config
+	limit.Enable(false)
+	if chain[0].Enabled() {
+		t.Error("want derived plugin disabled with parent")
+	}
+	limit.Enable(true)
+	if !chain[0].Enabled() {
+		t.Error("want derived plugin enabled with parent")
+	}
+
+	// derived disabled for panicking, the parent disabled also
+	chain[1].Enable(false)
+	if cache.Enabled() || chain[1].Enabled() {
+		t.Error("want parent disabled by derived plugin")
+	}
+}
@@ -4,9 +4,11 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	// "fmt"
 	// "log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,6 +17,10 @@ import (
 	"time"
 
 	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/netaddr"
+	"github.com/jademperor/api-proxier/internal/proxyproto"
+	"github.com/jademperor/api-proxier/internal/realip"
+	"github.com/jademperor/api-proxier/internal/transcode"
 	"github.com/jademperor/api-proxier/plugin"
 	"github.com/jademperor/common/models"
 	"github.com/jademperor/common/pkg/code"
@@ -36,7 +42,21 @@ var (
 	ErrNoAvailableCluster = errors.New("No available cluster")
 )
 
-func defaultHandleFunc(w http.ResponseWriter, req *http.Request, params httprouter.Params) {}
+// apiHandle register rule into router, the rule could be captured by
+// calling the handle with *apiCapture
+func apiHandle(rule *models.API) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		if capture, ok := w.(*apiCapture); ok {
+			capture.rule = rule
+		}
+	}
+}
+
+// apiCapture to capture the rule of matched handle
+type apiCapture struct {
+	http.ResponseWriter
+	rule *models.API
+}
 
 func defaultErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
 	utils.ResponseJSON(w,
@@ -51,9 +71,13 @@ func New(
 	routingRules []*models.Routing) *Proxier {
 
 	p := &Proxier{
-		mutex:  &sync.RWMutex{},
-		router: httprouter.New(),
-		status: plugin.Working,
+		mutex:     &sync.RWMutex{},
+		router:    httprouter.New(),
+		status:    plugin.Working,
+		transport: http.DefaultTransport,
+		realIP:    &realip.Resolver{},
+
+		unixTransports: make(map[string]http.RoundTripper),
 	}
 
 	// initial work
@@ -73,50 +97,104 @@ type Proxier struct {
 	clusters     map[string]*models.Cluster // clusters to manage reverseProxies
 	apiRules     map[string]*models.API     // apis configs to proxy
 	routingRules map[string]*models.Routing // routing configs to proxy
+	transcoders  []*transcode.Transcoder    // transcoders of REST/JSON to gRPC
+
+	transport     http.RoundTripper // transport of reverse proxies
+	proxyProtocol int               // version of PROXY protocol to send, 0 means not to send
+	realIP        *realip.Resolver  // resolver of client IP and forwarding headers
+
+	unixMutex      sync.Mutex
+	unixTransports map[string]http.RoundTripper // transports to unix domain sockets by path
 
 	cb map[string]*gobreaker.CircuitBreaker
 }
 
-// Handle proxy to handle with request
+// Handle proxy to handle with request, the route attached to c would be
+// reused if matched before.
 func (p *Proxier) Handle(c *plugin.Context) {
-	defer plugin.Recover("Proxier")
+	defer c.Recover("Proxier")
+
+	route := c.Route()
+	if route == nil {
+		var ok bool
+		if route, ok = p.Match(c.Method, c.Path); !ok {
+			// don't matched any path or server !!!
+			logger.Logger.Infof("could not match API or Routing rule with (method: %s, path: %s)",
+				c.Method, c.Path)
+			c.SetError(ErrPageNotFound)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
 
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
-	// match api reverse proxy
-	if rule, ok := p.matchAPIRule(c.Method, c.Path); ok {
+	var err error
+	switch route.Kind {
+	case plugin.RouteAPI:
 		logger.Logger.Debugln("matched path rules")
-		if rule.NeedCombine {
-			if err := p.callAPIWithCombination(rule, c); err != nil {
-				c.SetError(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-			}
+		if route.API.NeedCombine {
+			err = p.callAPIWithCombination(route.API, c)
 		} else {
-			if err := p.callAPI(rule, c); err != nil {
-				c.SetError(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-			}
+			err = p.callAPI(route.API, c)
 		}
-		return
+	case plugin.RouteTranscoding:
+		logger.Logger.Debugln("matched transcoding rules")
+		target := route.Target.(*transcodingTarget)
+		err = p.callTranscoding(target.t, target.binding, route.Params, c)
+	case plugin.RouteRouting:
+		logger.Logger.Debugln("matched server rules")
+		err = p.callRouting(route.Routing, c)
+	}
+
+	if err != nil {
+		c.SetError(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+	return
+}
+
+// Match rules with method and path in order: API, transcoding and routing
+func (p *Proxier) Match(method, path string) (*plugin.Route, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	// match api reverse proxy
+	if rule, params, ok := p.matchAPIRule(method, path); ok {
+		return &plugin.Route{
+			Kind:      plugin.RouteAPI,
+			API:       rule,
+			Params:    params,
+			ClusterID: rule.TargetClusterID,
+		}, true
+	}
+
+	// match transcoding rule
+	if t, binding, vars, ok := p.matchTranscoding(method, path); ok {
+		return &plugin.Route{
+			Kind:      plugin.RouteTranscoding,
+			Params:    vars,
+			ClusterID: t.ClusterID(),
+			Target:    &transcodingTarget{t: t, binding: binding},
+		}, true
 	}
 
 	// match routing proxy
-	if rule, ok := p.matchRoutingRule(c.Path); ok {
-		logger.Logger.Debugln("matched server rules")
-		if err := p.callRouting(rule, c); err != nil {
-			c.SetError(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-		}
-		return
+	if rule, ok := p.matchRoutingRule(path); ok {
+		return &plugin.Route{
+			Kind:      plugin.RouteRouting,
+			Routing:   rule,
+			ClusterID: rule.ClusterID,
+		}, true
 	}
+	return nil, false
+}
 
-	// don't matched any path or server !!!
-	logger.Logger.Infof("could not match API or Routing rule with (method: %s, path: %s)",
-		c.Method, c.Path)
-	c.SetError(ErrPageNotFound)
-	c.AbortWithStatus(http.StatusNotFound)
-	return
+// transcodingTarget target of matched transcoding rule
+type transcodingTarget struct {
+	t       *transcode.Transcoder
+	binding *transcode.Binding
 }
 
 // Status ...
@@ -127,12 +205,43 @@ func (p *Proxier) Status() plugin.PlgStatus {
 	return status
 }
 
-func (p *Proxier) matchAPIRule(method, path string) (*models.API, bool) {
-	if handle, params, tsr := p.router.Lookup(method, path); handle != nil {
-		_, _ = params, tsr
-		return p.apiRules[path], true
+// Pick an instance of cluster with its breaker, cb is nil if the
+// instance has no breaker opened
+func (p *Proxier) Pick(clsID string) (*models.ServerInstance, *gobreaker.CircuitBreaker, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	cls, ok := p.clusters[strings.ToLower(clsID)]
+	if !ok {
+		return nil, nil, ErrNoAvailableCluster
 	}
-	return nil, false
+	srvIns := cls.Distribute()
+	cb := p.cb[genCbKey(cls.Idx, srvIns.Idx)]
+	return srvIns, cb, nil
+}
+
+func (p *Proxier) matchAPIRule(method, path string) (*models.API, map[string]string, bool) {
+	handle, params, _ := p.router.Lookup(method, path)
+	if handle == nil {
+		return nil, nil, false
+	}
+
+	// call handle to capture the rule, since path of request may be
+	// different from the rule with params like "/users/:id"
+	capture := &apiCapture{}
+	handle(capture, nil, nil)
+	if capture.rule == nil {
+		return nil, nil, false
+	}
+
+	var vars map[string]string
+	if len(params) != 0 {
+		vars = make(map[string]string, len(params))
+		for _, param := range params {
+			vars[param.Key] = param.Value
+		}
+	}
+	return capture.rule, vars, true
 }
 
 func (p *Proxier) matchRoutingRule(path string) (*models.Routing, bool) {
@@ -142,6 +251,83 @@ func (p *Proxier) matchRoutingRule(path string) (*models.Routing, bool) {
 	return rule, ok
 }
 
+func (p *Proxier) matchTranscoding(method, path string) (
+	*transcode.Transcoder, *transcode.Binding, map[string]string, bool) {
+	for _, t := range p.transcoders {
+		if binding, vars, ok := t.Match(method, path); ok {
+			return t, binding, vars, true
+		}
+	}
+	return nil, nil, nil, false
+}
+
+// SetProxyProtocol to send PROXY protocol header of version (1 or 2) to
+// upstream instances, 0 means not to send. Keep-alive is disabled while
+// sending, since the header is sent once per connection.
+func (p *Proxier) SetProxyProtocol(version int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.proxyProtocol = version
+	p.unixMutex.Lock()
+	p.unixTransports = make(map[string]http.RoundTripper)
+	p.unixMutex.Unlock()
+	if version == 0 {
+		p.transport = http.DefaultTransport
+		return
+	}
+	p.transport = p.newTransport(nil)
+}
+
+// newTransport create transport of reverse proxies, dial to unix domain
+// socket at sockPath if it's not nil.
+func (p *Proxier) newTransport(sockPath *string) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := proxyproto.DialContext(dialer.DialContext)
+	if sockPath != nil {
+		path := *sockPath
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+	}
+	if p.proxyProtocol != 0 {
+		dial = proxyproto.Dialer(p.proxyProtocol, dial)
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		DisableKeepAlives:     p.proxyProtocol != 0,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// unixTransport get or create transport to unix domain socket at path
+func (p *Proxier) unixTransport(path string) http.RoundTripper {
+	p.unixMutex.Lock()
+	defer p.unixMutex.Unlock()
+
+	if t, ok := p.unixTransports[path]; ok {
+		return t
+	}
+	t := p.newTransport(&path)
+	p.unixTransports[path] = t
+	return t
+}
+
+// SetRealIP set resolver to resolve client IP with trusted proxies and
+// set forwarding headers toward upstreams
+func (p *Proxier) SetRealIP(r *realip.Resolver) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.realIP = r
+}
+
 // LoadBreakers ...
 func (p *Proxier) LoadBreakers(cfgs map[string][]*models.ServerInstance) {
 	p.mutex.Lock()
@@ -212,7 +398,7 @@ func (p *Proxier) LoadAPIs(rules []*models.API) {
 		}
 		p.apiRules[path] = rule
 		for _, method := range strings.Split(rule.Method, ",") {
-			p.router.Handle(method, path, defaultHandleFunc)
+			p.router.Handle(method, path, apiHandle(rule))
 		}
 
 		logger.Logger.Infof("URI rule:%s_%s registered", path, method)
@@ -244,6 +430,29 @@ func (p *Proxier) LoadRouting(rules []*models.Routing) {
 	}
 }
 
+// LoadTranscodings to load rules (type []transcode.Rule) to initial
+func (p *Proxier) LoadTranscodings(rules []*transcode.Rule) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// release gRPC connections of old transcoders, after calls of routes
+	// matched before finished
+	for _, t := range p.transcoders {
+		t.Close()
+	}
+
+	p.transcoders = make([]*transcode.Transcoder, 0, len(rules))
+	for _, rule := range rules {
+		t, err := transcode.New(rule)
+		if err != nil {
+			logger.Logger.Errorf("transcoding rule [%s] is invalid: %v, so skipped", rule.Idx, err)
+			continue
+		}
+		p.transcoders = append(p.transcoders, t)
+		logger.Logger.Infof("TRANSCODING rule: [%s_%s] registered", rule.TargetClusterID, rule.Idx)
+	}
+}
+
 // callAPIWithCombination
 // [TODO](done): combine two or more response
 func (p *Proxier) callAPIWithCombination(rule *models.API, c *plugin.Context) error {
@@ -301,14 +510,18 @@ func (p *Proxier) callAPIWithCombination(rule *models.API, c *plugin.Context) er
 	}
 
 	// Response
-	c.JSON(http.StatusOK, final)
+	byts, err := json.Marshal(final)
+	if err != nil {
+		return err
+	}
+	respond(c, http.StatusOK, "application/json", byts)
 	return nil
 }
 
 // callAPI reverse proxy to remote server and combine repsonse.
 func (p *Proxier) callAPI(rule *models.API, c *plugin.Context) error {
 	oriPath := strings.ToLower(rule.Path)
-	req := c.Request()
+	req := p.upstreamRequest(c.Request())
 	w := c.ResponseWriter()
 
 	if len(rule.RewritePath) != 0 {
@@ -333,14 +546,22 @@ func (p *Proxier) callAPI(rule *models.API, c *plugin.Context) error {
 	)
 
 	if !exist {
-		reverseProxy := generateReverseProxy(srvIns)
-		reverseProxy.ErrorHandler = defaultErrorHandler
+		reverseProxy := p.generateReverseProxy(srvIns, c)
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err0 error) {
+			if !rejectResponse(c, err0) {
+				defaultErrorHandler(w, req, err0)
+			}
+		}
 		reverseProxy.ServeHTTP(w, req)
 	} else {
 		// cb work pipe
 		_, err = cb.Execute(func() (v interface{}, err1 error) {
-			reverseProxy := generateReverseProxy(srvIns)
+			reverseProxy := p.generateReverseProxy(srvIns, c)
 			reverseProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err0 error) {
+				// response rejected by plugins is not failure of upstream
+				if rejectResponse(c, err0) {
+					return
+				}
 				err1 = err0
 				// defaultErrorHandler(w, req, e)
 			}
@@ -355,7 +576,7 @@ func (p *Proxier) callAPI(rule *models.API, c *plugin.Context) error {
 // cannot combine two server response
 func (p *Proxier) callRouting(rule *models.Routing, c *plugin.Context) error {
 	// need to trim prefix
-	req := c.Request()
+	req := p.upstreamRequest(c.Request())
 	w := c.ResponseWriter()
 	if rule.NeedStripPrefix {
 		req.URL.Path = strings.TrimPrefix(strings.ToLower(req.URL.Path),
@@ -382,15 +603,23 @@ func (p *Proxier) callRouting(rule *models.Routing, c *plugin.Context) error {
 		err error
 	)
 	if !exist {
-		reverseProxy := generateReverseProxy(srvIns)
-		reverseProxy.ErrorHandler = defaultErrorHandler
+		reverseProxy := p.generateReverseProxy(srvIns, c)
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err0 error) {
+			if !rejectResponse(c, err0) {
+				defaultErrorHandler(w, req, err0)
+			}
+		}
 		reverseProxy.ServeHTTP(w, req)
 
 	} else {
 		// cb work pipe
 		_, err = cb.Execute(func() (v interface{}, err1 error) {
-			reverseProxy := generateReverseProxy(srvIns)
+			reverseProxy := p.generateReverseProxy(srvIns, c)
 			reverseProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err0 error) {
+				// response rejected by plugins is not failure of upstream
+				if rejectResponse(c, err0) {
+					return
+				}
 				err1 = err0
 				// defaultErrorHandler(w, req, e)
 			}
@@ -402,17 +631,99 @@ func (p *Proxier) callRouting(rule *models.Routing, c *plugin.Context) error {
 	return err
 }
 
+// callTranscoding to translate request into gRPC call to cluster
+// and write the JSON response
+func (p *Proxier) callTranscoding(t *transcode.Transcoder, binding *transcode.Binding,
+	vars map[string]string, c *plugin.Context) error {
+	clsID := strings.ToLower(t.ClusterID())
+	cls, ok := p.clusters[clsID]
+	if !ok {
+		logger.Logger.Errorf("could not found balancer [%s], and target_cls_id [%s]",
+			binding.Method(), clsID)
+		return ErrNoAvailableCluster
+	}
+	srvIns := cls.Distribute()
+
+	// execute gRPC call
+	cb, exist := p.cb[genCbKey(cls.Idx, srvIns.Idx)]
+	logger.Logger.Debugf("got cb with key: %s, got: %v", genCbKey(cls.Idx, srvIns.Idx), exist)
+
+	var (
+		body []byte
+		err  error
+	)
+	if !exist {
+		body, err = t.Call(srvIns.Addr, binding, vars, c.Request())
+	} else {
+		// cb work pipe
+		_, err = cb.Execute(func() (interface{}, error) {
+			var err1 error
+			body, err1 = t.Call(srvIns.Addr, binding, vars, c.Request())
+			return nil, err1
+		})
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		logger.Logger.Errorf("transcoding call %s got error: %v", binding.Method(), err)
+		status = transcode.HTTPStatus(err)
+		if body, err = json.Marshal(code.NewCodeInfo(code.CodeSystemErr, transcode.ErrorMessage(err))); err != nil {
+			return err
+		}
+	}
+	respond(c, status, "application/json", body)
+	return nil
+}
+
 // generateReverseProxy ...
 // TODO: with cache
-func generateReverseProxy(ins *models.ServerInstance) *httputil.ReverseProxy {
-	target, err := url.Parse(ins.Addr)
-	if err != nil {
-		panic(utils.Fstring("could not parse URL: %s", ins.Addr))
+func (p *Proxier) generateReverseProxy(ins *models.ServerInstance, c *plugin.Context) *httputil.ReverseProxy {
+	var (
+		target    *url.URL
+		transport = p.transport
+	)
+	if netaddr.IsUnix(ins.Addr) {
+		// addr like "unix:///var/run/app.sock", the host is only a placeholder
+		_, path := netaddr.Parse(ins.Addr)
+		target = &url.URL{Scheme: "http", Host: "unix"}
+		transport = p.unixTransport(path)
+	} else {
+		var err error
+		if target, err = url.Parse(ins.Addr); err != nil {
+			panic(utils.Fstring("could not parse URL: %s", ins.Addr))
+		}
 	}
 	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.Transport = transport
+
+	// set forwarding headers consistently
+	director, realIP := reverseProxy.Director, p.realIP
+	reverseProxy.Director = func(req *http.Request) {
+		director(req)
+		realIP.SetHeaders(req, realIP.ClientIP(req))
+	}
+	// response phase of plugins
+	reverseProxy.ModifyResponse = handleResponse(c)
 	return reverseProxy
 }
 
+// upstreamRequest attach client and listener addresses to req if PROXY
+// protocol header need to be sent to upstream
+func (p *Proxier) upstreamRequest(req *http.Request) *http.Request {
+	if p.proxyProtocol == 0 {
+		return req
+	}
+
+	var src, dst net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		src = addr
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst = addr
+	}
+	return req.WithContext(proxyproto.WithAddrs(req.Context(), src, dst))
+}
+
 // const (
 // 	xHeaderKey = "X-Instance-Key"
 // )
@@ -1 +1,122 @@
 package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+	"github.com/jademperor/common/models"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_Proxier_Match(t *testing.T) {
+	p := New([]*models.API{
+		{Idx: "api-user", Path: "/users/:id", Method: "GET", TargetClusterID: "cls-user"},
+		{Idx: "api-list", Path: "/users", Method: "GET,POST", TargetClusterID: "cls-user"},
+	}, nil, []*models.Routing{
+		{Idx: "routing-srv", Prefix: "/srv", ClusterID: "cls-srv"},
+	})
+
+	cases := []struct {
+		method, path string
+		wantKind     plugin.RouteKind
+		wantRule     string
+		wantCluster  string
+		wantParams   map[string]string
+	}{
+		{"GET", "/users/42", plugin.RouteAPI, "api-user", "cls-user", map[string]string{"id": "42"}},
+		{"POST", "/users", plugin.RouteAPI, "api-list", "cls-user", nil},
+		{"GET", "/srv/anything", plugin.RouteRouting, "routing-srv", "cls-srv", nil},
+	}
+
+	for _, c := range cases {
+		route, ok := p.Match(c.method, c.path)
+		if !ok {
+			t.Errorf("%s %s: want matched", c.method, c.path)
+			continue
+		}
+		if route.Kind != c.wantKind || route.RuleID() != c.wantRule || route.ClusterID != c.wantCluster {
+			t.Errorf("%s %s: want %s %s %s, got %s %s %s", c.method, c.path,
+				c.wantKind, c.wantRule, c.wantCluster, route.Kind, route.RuleID(), route.ClusterID)
+		}
+		for k, v := range c.wantParams {
+			if route.Params[k] != v {
+				t.Errorf("%s %s: want param %s=%s, got %s", c.method, c.path, k, v, route.Params[k])
+			}
+		}
+	}
+
+	if _, ok := p.Match("DELETE", "/nothing"); ok {
+		t.Error("want not matched")
+	}
+}
+
+// responseHook plugin to inspect response, and reject it if reject is set
+type responseHook struct {
+	reject bool
+}
+
+func (h *responseHook) Handle(c *plugin.Context) { c.Next() }
+func (h *responseHook) Enabled() bool            { return true }
+func (h *responseHook) Status() plugin.PlgStatus { return plugin.Working }
+func (h *responseHook) Name() string             { return "responseHook" }
+func (h *responseHook) Enable(enabled bool)      {}
+func (h *responseHook) HandleResponse(c *plugin.Context, resp *http.Response) error {
+	resp.Header.Set("X-Hooked", "1")
+	if h.reject {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func Test_Proxier_HandleResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer upstream.Close()
+
+	clusters := map[string][]*models.ServerInstance{
+		"cls-plain":   {{Idx: "ins", Addr: upstream.URL, IsAlive: true}},
+		"cls-breaker": {{Idx: "ins", Addr: upstream.URL, IsAlive: true, OpenBreaker: true}},
+	}
+	p := New([]*models.API{
+		{Idx: "api-plain", Path: "/plain", Method: "GET", TargetClusterID: "cls-plain"},
+		{Idx: "api-comb", Path: "/comb", Method: "GET", NeedCombine: true, CombineReqCfgs: []*models.APICombination{
+			{Path: "/a", Field: "a", Method: "GET", TargetClusterID: "cls-plain"},
+		}},
+	}, clusters, []*models.Routing{
+		{Idx: "routing-breaker", Prefix: "/breaker", ClusterID: "cls-breaker"},
+	})
+
+	serve := func(hook *responseHook, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c := plugin.NewContext(w, httptest.NewRequest("GET", "http://example.com"+path, nil),
+			[]plugin.Plugin{hook})
+		p.Handle(c)
+		return w
+	}
+
+	for _, path := range []string{"/plain", "/breaker/x", "/comb"} {
+		if w := serve(&responseHook{}, path); w.Code != http.StatusOK || w.Header().Get("X-Hooked") != "1" {
+			t.Errorf("%s: want 200 through response hook, got %d %v", path, w.Code, w.Header())
+		}
+		// more than requests to trip the breaker
+		for i := 0; i < CntRequests+1; i++ {
+			if w := serve(&responseHook{reject: true}, path); w.Code != http.StatusBadGateway {
+				t.Fatalf("%s: want rejected with 502, got %d %s", path, w.Code, w.Body)
+			}
+		}
+		// rejections are not failures of upstream
+		if w := serve(&responseHook{}, path); w.Code != http.StatusOK {
+			t.Errorf("%s: want breaker closed, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+// responseError returned by plugins in response phase, to tell it from
+// errors of upstream, so it's never counted as failure of breaker
+type responseError struct {
+	err error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+// handleResponse call response phase of plugins in c, used as
+// ModifyResponse of reverse proxies
+func handleResponse(c *plugin.Context) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if err := c.HandleResponse(resp); err != nil {
+			return &responseError{err: err}
+		}
+		return nil
+	}
+}
+
+// rejectResponse abort c with 502 Bad Gateway if err is returned by plugins
+// in response phase, false returned if not
+func rejectResponse(c *plugin.Context, err error) bool {
+	respErr, ok := err.(*responseError)
+	if !ok {
+		return false
+	}
+	logger.Logger.Errorf("response of %s %s rejected by plugin: %v",
+		c.Method, c.Path, respErr.err)
+	c.String(http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	return true
+}
+
+// respond write response generated by the gateway, like transcoded or
+// combined responses, through response phase of plugins like responses
+// proxied from upstream.
+func respond(c *plugin.Context, status int, contentType string, body []byte) {
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       c.Request(),
+	}
+	if err := handleResponse(c)(resp); err != nil {
+		rejectResponse(c, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	w := c.ResponseWriter()
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	c.AbortWithStatus(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
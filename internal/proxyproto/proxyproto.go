@@ -0,0 +1,337 @@
+// Package proxyproto implements PROXY protocol v1 and v2, to recover the
+// real client address behind L4 load balancer, and to pass it to upstream.
+//
+// reference to: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidHeader the PROXY protocol header could not be parsed
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+	// ErrUnsupportedVersion version is neither 1 nor 2
+	ErrUnsupportedVersion = errors.New("proxyproto: unsupported version")
+	// ErrUntrustedPeer header sent by peer not trusted
+	ErrUntrustedPeer = errors.New("proxyproto: header from untrusted peer")
+
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// default timeout to read header from accepted connection
+	defaultHeaderTimeout = 5 * time.Second
+)
+
+const (
+	v1MaxLength = 107 // max length of v1 header including CRLF
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec   = 0x00
+	v2FamTCPv4    = 0x11
+	v2FamTCPv6    = 0x21
+	v2LenTCPv4    = 12
+	v2LenTCPv6    = 36
+	v2HeaderBytes = 16
+)
+
+// NewListener wrap l to read PROXY protocol header from accepted connections,
+// connections without header are passed through as is. Header is only
+// accepted from peers of IP trusted, or unix socket peers, connections
+// with header from other peers are closed. nil trusted means any peer.
+func NewListener(l net.Listener, headerTimeout time.Duration, trusted func(ip string) bool) net.Listener {
+	if headerTimeout <= 0 {
+		headerTimeout = defaultHeaderTimeout
+	}
+	return &listener{Listener: l, headerTimeout: headerTimeout, trusted: trusted}
+}
+
+type listener struct {
+	net.Listener
+	headerTimeout time.Duration
+	trusted       func(ip string) bool
+}
+
+// Accept returns connection without reading header, the header would be read
+// while first calling Read, RemoteAddr or LocalAddr, so slow clients would not
+// block the accept loop.
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:          conn,
+		r:             bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+		trusted:       l.trusted,
+	}, nil
+}
+
+// Conn wrap net.Conn with addresses from PROXY protocol header
+type Conn struct {
+	net.Conn
+	r             *bufio.Reader
+	headerTimeout time.Duration
+	trusted       func(ip string) bool
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr get source address in header, or the real remote address
+// if no header presented.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr get destination address in header, or the real local address
+// if no header presented.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite shut down the writing side of the underlying connection, like
+// *net.TCPConn, so half-closed connections could be proxied.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("proxyproto: CloseWrite not supported")
+}
+
+// trustedPeer check the real peer is allowed to send header
+func (c *Conn) trustedPeer() bool {
+	if c.trusted == nil {
+		return true
+	}
+	switch addr := c.Conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return c.trusted(addr.IP.String())
+	case *net.UnixAddr:
+		// only local processes could connect
+		return true
+	}
+	return false
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	first, err := c.r.Peek(1)
+	if err != nil {
+		// let the following Read returns the error
+		return
+	}
+
+	var read func(r *bufio.Reader) (net.Addr, net.Addr, error)
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := c.r.Peek(len(v1Prefix)); err == nil && bytes.Equal(prefix, v1Prefix) {
+			read = readV1
+		}
+	case v2Signature[0]:
+		if sig, err := c.r.Peek(len(v2Signature)); err == nil && bytes.Equal(sig, v2Signature) {
+			read = readV2
+		}
+	}
+	switch {
+	case read == nil:
+	case !c.trustedPeer():
+		c.err = ErrUntrustedPeer
+	default:
+		c.src, c.dst, c.err = read(c.r)
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readV1 read header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readV2 read the binary header
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, v2HeaderBytes)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch verCmd {
+	case v2CmdLocal:
+		// health check from balancer itself, keep the real addresses
+		return nil, nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+
+	switch fam {
+	case v2FamTCPv4:
+		if len(payload) < v2LenTCPv4 {
+			return nil, nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case v2FamTCPv6:
+		if len(payload) < v2LenTCPv6 {
+			return nil, nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	}
+	// unsupported address family (UDP, unix), ignore the addresses
+	return nil, nil, nil
+}
+
+// WriteHeader write PROXY protocol header of version with src and dst,
+// "UNKNOWN" (v1) or LOCAL command (v2) would be written if they are
+// not TCP addresses.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+
+	switch version {
+	case 1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto, srcIP, dstIP := "TCP4", srcTCP.IP.To4(), dstTCP.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			proto, srcIP, dstIP = "TCP6", srcTCP.IP.To16(), dstTCP.IP.To16()
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n",
+			proto, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+		return err
+	case 2:
+		buf := bytes.NewBuffer(make([]byte, 0, v2HeaderBytes+v2LenTCPv6))
+		buf.Write(v2Signature)
+		if !known {
+			buf.Write([]byte{v2CmdLocal, v2FamUnspec, 0, 0})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+
+		var (
+			port   [2]byte
+			fam    byte = v2FamTCPv4
+			length      = v2LenTCPv4
+		)
+		srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			fam, length = v2FamTCPv6, v2LenTCPv6
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		}
+		buf.Write([]byte{v2CmdProxy, fam, byte(length >> 8), byte(length)})
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.BigEndian.PutUint16(port[:], uint16(srcTCP.Port))
+		buf.Write(port[:])
+		binary.BigEndian.PutUint16(port[:], uint16(dstTCP.Port))
+		buf.Write(port[:])
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	return ErrUnsupportedVersion
+}
+
+type ctxKey struct{}
+
+type addrs struct {
+	src, dst net.Addr
+}
+
+// WithAddrs returns a copy of ctx with the addresses to be sent to upstream
+func WithAddrs(ctx context.Context, src, dst net.Addr) context.Context {
+	return context.WithValue(ctx, ctxKey{}, addrs{src: src, dst: dst})
+}
+
+// DialContext func type like net.Dialer.DialContext
+type DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dialer wrap dial to write PROXY protocol header of version after connected,
+// with the addresses of ctx set by WithAddrs.
+func Dialer(version int, dial DialContext) DialContext {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		a, _ := ctx.Value(ctxKey{}).(addrs)
+		if err = WriteHeader(conn, version, a.src, a.dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
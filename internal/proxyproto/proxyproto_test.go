@@ -0,0 +1,117 @@
+package proxyproto
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Listener(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+
+	cases := []struct {
+		name     string
+		version  int // 0 means no header
+		src, dst net.Addr
+		wantSrc  string
+	}{
+		{"v1 tcp4", 1, src, dst, "10.1.2.3:56324"},
+		{"v1 tcp6", 1, src6, dst6, "[2001:db8::1]:1000"},
+		{"v2 tcp4", 2, src, dst, "10.1.2.3:56324"},
+		{"v2 tcp6", 2, src6, dst6, "[2001:db8::1]:1000"},
+		{"v2 local", 2, nil, nil, ""},
+		{"no header", 0, nil, nil, ""},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, time.Second, nil)
+	defer pl.Close()
+
+	for _, c := range cases {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.version != 0 {
+			if err = WriteHeader(client, c.version, c.src, c.dst); err != nil {
+				t.Fatal(err)
+			}
+		}
+		client.Write([]byte("PUT /payload"))
+		client.Close()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSrc := c.wantSrc
+		if wantSrc == "" {
+			wantSrc = client.LocalAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != wantSrc {
+			t.Errorf("%s: want remote addr %s, got %s", c.name, wantSrc, got)
+		}
+		payload, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Errorf("%s: read got error: %v", c.name, err)
+		}
+		if string(payload) != "PUT /payload" {
+			t.Errorf("%s: want payload %q, got %q", c.name, "PUT /payload", payload)
+		}
+		conn.Close()
+	}
+}
+
+func Test_Listener_trusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, time.Second, func(ip string) bool { return ip == "10.0.0.1" })
+	defer pl.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	for _, version := range []int{0, 1, 2} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 0 {
+			WriteHeader(client, version, src, dst)
+		}
+		client.Write([]byte("PUT /payload"))
+		client.(*net.TCPConn).CloseWrite()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := ioutil.ReadAll(conn)
+		if version == 0 {
+			if err != nil || string(payload) != "PUT /payload" {
+				t.Errorf("want no header passed through, got %q %v", payload, err)
+			}
+			// half-closed by server, and the client reads EOF
+			if err = conn.(*Conn).CloseWrite(); err != nil {
+				t.Errorf("want CloseWrite of TCP conn, got error: %v", err)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("want EOF after CloseWrite, got %d %v", n, err)
+			}
+		} else if err != ErrUntrustedPeer {
+			t.Errorf("v%d: want header from untrusted peer rejected, got %q %v", version, payload, err)
+		}
+		client.Close()
+		conn.Close()
+	}
+}
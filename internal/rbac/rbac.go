@@ -0,0 +1,236 @@
+// Package rbac of role-based access control, roles grant methods and path
+// patterns to consumers, which are loaded from the config source by engine,
+// and used by the rbac plugin to authorize requests.
+package rbac
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+var (
+	// DefaultStore loaded by engine and used by plugins
+	DefaultStore = NewStore()
+)
+
+// AnyConsumer bind role to all consumers authenticated
+const AnyConsumer = "*"
+
+// Role with rules, bound to consumers
+type Role struct {
+	// Idx name of role, like "admin", also the role name in token claims
+	Idx string `json:"idx"`
+	// Consumers bound to role, "*" means any consumer authenticated
+	Consumers []string `json:"consumers"`
+	// Rules of role, a request is allowed if any rule of roles allows, and
+	// no rule denies
+	Rules []*Rule `json:"rules"`
+}
+
+// Rule of methods and paths allowed or denied
+type Rule struct {
+	// Methods like "GET", empty or "*" means any
+	Methods []string `json:"methods"`
+	// Paths patterns, "*" matches a segment, and "**" at the end matches
+	// any segments left, like "/orders/*/items" or "/orders/**", matched
+	// case-insensitively as the router does
+	Paths []string `json:"paths"`
+	// Deny methods and paths, overrides rules allowed
+	Deny bool `json:"deny"`
+}
+
+func (r *Rule) validate() error {
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("paths must be set")
+	}
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path must start with /: %s", p)
+		}
+		if i := strings.Index(p, "**"); i >= 0 && i != len(p)-2 {
+			return fmt.Errorf("** must be at the end of path: %s", p)
+		}
+	}
+	return nil
+}
+
+// match method and path cleaned
+func (r *Rule) match(method, path string) bool {
+	if len(r.Methods) != 0 {
+		matched := false
+		for _, m := range r.Methods {
+			if m == "*" || strings.EqualFold(m, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, p := range r.Paths {
+		if matchPath(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath of pattern segment by segment, case-insensitively as the
+// router matches, path should be cleaned with cleanPath
+func matchPath(pattern, path string) bool {
+	var (
+		ps = strings.Split(strings.Trim(pattern, "/"), "/")
+		ss = strings.Split(strings.Trim(path, "/"), "/")
+	)
+	for i, p := range ps {
+		if p == "**" {
+			return true
+		}
+		if i >= len(ss) || (p != "*" && !strings.EqualFold(p, ss[i])) {
+			return false
+		}
+	}
+	return len(ps) == len(ss)
+}
+
+// cleanPath collapse duplicated slashes and "." segments, paths with ".."
+// segments are rejected, as upstream may resolve them to paths not matched
+func cleanPath(p string) (string, bool) {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	return path.Clean("/" + p), true
+}
+
+// Decision of request, explains why it's allowed or denied
+type Decision struct {
+	Allowed  bool     `json:"allowed"`
+	Consumer string   `json:"consumer,omitempty"`
+	Roles    []string `json:"roles"`
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	// Role and Rule index of the rule decided, Rule is -1 if no rule matched
+	Role   string `json:"role,omitempty"`
+	Rule   int    `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// Store of roles indexed by name and consumers bound
+type Store struct {
+	mutex    sync.RWMutex
+	roles    map[string]*Role
+	bindings map[string][]string // consumer to roles bound
+}
+
+// NewStore ...
+func NewStore() *Store {
+	return &Store{
+		roles:    make(map[string]*Role),
+		bindings: make(map[string][]string),
+	}
+}
+
+// Load roles to replace all loaded, roles duplicated or with invalid rules
+// are ignored
+func (s *Store) Load(roles []*Role) {
+	var (
+		byName   = make(map[string]*Role)
+		bindings = make(map[string][]string)
+	)
+	for _, r := range roles {
+		if _, ok := byName[r.Idx]; ok {
+			logger.Logger.Errorf("role [%s] duplicated, ignored", r.Idx)
+			continue
+		}
+		valid := true
+		for i, rule := range r.Rules {
+			if err := rule.validate(); err != nil {
+				logger.Logger.Errorf("rule %d of role [%s] invalid: %v, role ignored", i, r.Idx, err)
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		byName[r.Idx] = r
+		for _, c := range r.Consumers {
+			bindings[c] = append(bindings[c], r.Idx)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.roles, s.bindings = byName, bindings
+}
+
+// Decide whether consumer with roles, besides roles bound to consumer, is
+// allowed to request method and path. Path is cleaned before matched, and
+// denied if it has ".." segments. Rules denied are checked first, then
+// rules allowed, roles in name order.
+func (s *Store) Decide(consumer string, roles []string, method, path string) *Decision {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	d := &Decision{Consumer: consumer, Method: method, Path: path, Rule: -1}
+	seen := make(map[string]bool)
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				d.Roles = append(d.Roles, name)
+			}
+		}
+	}
+	add(roles)
+	if consumer != "" {
+		add(s.bindings[consumer])
+		add(s.bindings[AnyConsumer])
+	}
+	sort.Strings(d.Roles)
+
+	if len(d.Roles) == 0 {
+		d.Reason = "no role granted"
+		if consumer == "" {
+			d.Reason = "no consumer authenticated"
+		}
+		return d
+	}
+	clean, ok := cleanPath(path)
+	if !ok {
+		d.Reason = "invalid path"
+		return d
+	}
+	d.Path, path = clean, clean
+
+	for _, deny := range []bool{true, false} {
+		for _, name := range d.Roles {
+			role, ok := s.roles[name]
+			if !ok {
+				continue
+			}
+			for i, rule := range role.Rules {
+				if rule.Deny != deny || !rule.match(method, path) {
+					continue
+				}
+				d.Allowed, d.Role, d.Rule = !deny, name, i
+				if deny {
+					d.Reason = fmt.Sprintf("denied by rule %d of role %s", i, name)
+				} else {
+					d.Reason = fmt.Sprintf("allowed by rule %d of role %s", i, name)
+				}
+				return d
+			}
+		}
+	}
+	d.Reason = fmt.Sprintf("no rule of roles allows %s %s", method, path)
+	return d
+}
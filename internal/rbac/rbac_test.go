@@ -0,0 +1,116 @@
+package rbac
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_matchPath(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/orders", "/orders", true},
+		{"/orders", "/orders/", true},
+		{"/orders", "/orders/1", false},
+		{"/orders/*", "/orders/1", true},
+		{"/orders/*", "/orders", false},
+		{"/orders/*/items", "/orders/1/items", true},
+		{"/orders/*/items", "/orders/1/users", false},
+		{"/orders/**", "/orders", true},
+		{"/orders/**", "/orders/1/items/2", true},
+		{"/orders/**", "/users/1", false},
+		{"/**", "/anything", true},
+		{"/orders/*", "/ORDERS/1", true},
+		{"/Orders", "/orders", true},
+	}
+	for _, c := range cases {
+		if got := matchPath(c.pattern, c.path); got != c.want {
+			t.Errorf("matchPath(%q, %q) want %v, got %v", c.pattern, c.path, c.want, got)
+		}
+	}
+}
+
+func Test_Store_Decide(t *testing.T) {
+	s := NewStore()
+	s.Load([]*Role{
+		{Idx: "reader", Consumers: []string{AnyConsumer}, Rules: []*Rule{
+			{Methods: []string{"GET"}, Paths: []string{"/orders/**"}},
+		}},
+		{Idx: "writer", Consumers: []string{"alice"}, Rules: []*Rule{
+			{Methods: []string{"POST", "put"}, Paths: []string{"/orders/**"}},
+			{Deny: true, Paths: []string{"/orders/*/audit"}},
+		}},
+		{Idx: "admin", Rules: []*Rule{{Paths: []string{"/**"}}}},
+		// invalid rule, role ignored
+		{Idx: "broken", Consumers: []string{"alice"}, Rules: []*Rule{{Paths: []string{"/a/**/b"}}}},
+		// duplicated role is ignored
+		{Idx: "reader", Consumers: []string{"alice"}, Rules: []*Rule{{Paths: []string{"/**"}}}},
+	})
+
+	cases := []struct {
+		name     string
+		consumer string
+		roles    []string
+		method   string
+		path     string
+		allowed  bool
+		role     string
+		rule     int
+	}{
+		{"any consumer", "bob", nil, "GET", "/orders/1", true, "reader", 0},
+		{"not allowed", "bob", nil, "POST", "/orders", false, "", -1},
+		{"bound", "alice", nil, "PUT", "/orders/1", true, "writer", 0},
+		{"deny overrides", "alice", nil, "GET", "/orders/1/audit", false, "writer", 1},
+		{"claimed role", "bob", []string{"admin"}, "DELETE", "/users/1", true, "admin", 0},
+		{"unknown role", "bob", []string{"root"}, "DELETE", "/users/1", false, "", -1},
+		{"upper case", "alice", nil, "GET", "/ORDERS/1/Audit", false, "writer", 1},
+		{"duplicated slashes", "alice", nil, "GET", "/orders//1/audit", false, "writer", 1},
+		{"dot segments", "alice", nil, "GET", "/orders/./1/audit/", false, "writer", 1},
+		{"parent segments", "bob", nil, "GET", "/orders/../users/1", false, "", -1},
+		{"anonymous", "", nil, "GET", "/orders", false, "", -1},
+		{"anonymous with role", "", []string{"admin"}, "GET", "/orders", true, "admin", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := s.Decide(c.consumer, c.roles, c.method, c.path)
+			if d.Allowed != c.allowed || d.Role != c.role || d.Rule != c.rule {
+				t.Errorf("want %v %q %d, got %+v", c.allowed, c.role, c.rule, d)
+			}
+		})
+	}
+
+	d := s.Decide("alice", []string{"admin"}, "GET", "/")
+	if want := []string{"admin", "reader", "writer"}; !reflect.DeepEqual(d.Roles, want) {
+		t.Errorf("want roles %v, got %v", want, d.Roles)
+	}
+}
+
+func Test_cleanPath(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/orders/1", "/orders/1", true},
+		{"//orders///1/", "/orders/1", true},
+		{"/orders/./1", "/orders/1", true},
+		{"orders", "/orders", true},
+		{"", "/", true},
+		{"/public/../admin", "", false},
+		{"/orders/..", "", false},
+	}
+	for _, c := range cases {
+		if got, ok := cleanPath(c.path); got != c.want || ok != c.ok {
+			t.Errorf("cleanPath(%q) want %q %v, got %q %v", c.path, c.want, c.ok, got, ok)
+		}
+	}
+}
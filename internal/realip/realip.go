@@ -0,0 +1,206 @@
+// Package realip resolve the real client IP behind trusted proxies,
+// and set forwarding headers toward upstreams.
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedProto = "X-Forwarded-Proto"
+	headerXForwardedHost  = "X-Forwarded-Host"
+	headerXRealIP         = "X-Real-Ip"
+	headerForwarded       = "Forwarded"
+)
+
+// New a Resolver trust proxies in cidrs, single IP like "10.0.0.1" is
+// also accepted. header is the forwarding header maintained by trusted
+// proxies to walk the chain from, "X-Forwarded-For" (default if empty) or
+// "Forwarded", the other one is never used since it may be sent by client.
+func New(cidrs []string, header string) (*Resolver, error) {
+	r := &Resolver{header: headerXForwardedFor}
+	if header != "" {
+		r.header = http.CanonicalHeaderKey(header)
+	}
+	if r.header != headerXForwardedFor && r.header != headerForwarded {
+		return nil, fmt.Errorf("invalid forwarded header: %s", header)
+	}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", cidr)
+		}
+		r.trusted = append(r.trusted, ipnet)
+	}
+	return r, nil
+}
+
+// Resolver resolve client IP with trusted proxies
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string // forwarding header to walk the chain from
+}
+
+// Trusted check ip is a trusted proxy or not
+func (r *Resolver) Trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipnet := range r.trusted {
+		if ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolve the real client IP of req. Forwarding headers are only
+// used if the peer is trusted, and the chain is walked from right to left
+// skipping trusted proxies, so the client could not spoof it.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := peerIP(req)
+	if !r.Trusted(peer) {
+		return peer
+	}
+
+	chain := forwardedChain(req.Header, r.header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !r.Trusted(chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) != 0 {
+		// all proxies are trusted, the leftmost one is the client
+		return chain[0]
+	}
+	if realIP := strings.TrimSpace(req.Header.Get(headerXRealIP)); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+// SetHeaders set forwarding headers of outreq toward upstream, headers
+// from untrusted peer are dropped. X-Forwarded-For would be appended with
+// peer IP by httputil.ReverseProxy.
+func (r *Resolver) SetHeaders(outreq *http.Request, clientIP string) {
+	var (
+		peer    = peerIP(outreq)
+		trusted = r.Trusted(peer)
+		proto   = "http"
+		host    = outreq.Host
+	)
+	if outreq.TLS != nil {
+		proto = "https"
+	}
+
+	if trusted {
+		if v := outreq.Header.Get(headerXForwardedProto); v != "" {
+			proto = v
+		}
+		if v := outreq.Header.Get(headerXForwardedHost); v != "" {
+			host = v
+		}
+	} else {
+		outreq.Header.Del(headerXForwardedFor)
+		outreq.Header.Del(headerForwarded)
+	}
+
+	outreq.Header.Set(headerXForwardedProto, proto)
+	outreq.Header.Set(headerXForwardedHost, host)
+	outreq.Header.Set(headerXRealIP, clientIP)
+
+	// Forwarded: for=192.0.2.60;proto=http;host=example.com
+	elem := fmt.Sprintf("for=%s;proto=%s;host=%s", forwardedNode(peer), proto, quote(host))
+	// prior elements may be sent in multiple lines
+	if prior := outreq.Header[headerForwarded]; len(prior) != 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	outreq.Header.Set(headerForwarded, elem)
+}
+
+// peerIP get IP of the direct peer
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// forwardedChain get proxy chain from header, Forwarded or X-Forwarded-For
+func forwardedChain(h http.Header, header string) []string {
+	var chain []string
+	if header == headerXForwardedFor {
+		for _, v := range h[headerXForwardedFor] {
+			for _, ip := range strings.Split(v, ",") {
+				if ip = strings.TrimSpace(ip); net.ParseIP(ip) != nil {
+					chain = append(chain, ip)
+				}
+			}
+		}
+		return chain
+	}
+
+	for _, v := range h[headerForwarded] {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				if ip := parseNode(kv[1]); ip != "" {
+					chain = append(chain, ip)
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseNode parse node of Forwarded like `"[2001:db8::1]:4711"` or `192.0.2.43`
+func parseNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// forwardedNode format ip as node of Forwarded, IPv6 must be quoted, and
+// "unknown" for peers without IP like unix socket (RFC 7239 section 6.3)
+func forwardedNode(ip string) string {
+	if net.ParseIP(ip) == nil {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, ":;,\" ") {
+		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	}
+	return s
+}
@@ -0,0 +1,120 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Resolver_ClientIP(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8", "192.168.1.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := New([]string{"10.0.0.0/8"}, "forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		r          *Resolver
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"untrusted peer", r, "1.2.3.4:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"trusted peer", r, "10.0.0.2:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"spoofed chain", r, "10.0.0.2:1000", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.3"}, "5.6.7.8"},
+		{"all trusted", r, "192.168.1.1:1000", map[string]string{"X-Forwarded-For": "10.0.0.5, 10.0.0.3"}, "10.0.0.5"},
+		{"x-real-ip", r, "10.0.0.2:1000", map[string]string{"X-Real-Ip": "5.6.7.8"}, "5.6.7.8"},
+		{"no headers", r, "10.0.0.2:1000", nil, "10.0.0.2"},
+		// Forwarded sent by client is never used behind proxies appending X-Forwarded-For
+		{"spoofed forwarded", r, "10.0.0.2:1000",
+			map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"forwarded", fwd, "10.0.0.2:1000", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.0.0.9`}, "2001:db8::1"},
+		{"spoofed x-forwarded-for", fwd, "10.0.0.2:1000",
+			map[string]string{"Forwarded": "for=5.6.7.8", "X-Forwarded-For": "1.2.3.4"}, "5.6.7.8"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = c.remoteAddr
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		if got := c.r.ClientIP(req); got != c.want {
+			t.Errorf("%s: want client IP %s, got %s", c.name, c.want, got)
+		}
+	}
+
+	if _, err := New(nil, "X-Real-Ip"); err == nil {
+		t.Error("want error of invalid forwarded header")
+	}
+}
+
+func Test_Resolver_SetHeaders(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// untrusted peer could not spoof forwarding headers
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "1.2.3.4:1000"
+	req.Header.Set("X-Forwarded-For", "9.9.9.9")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r.SetHeaders(req, r.ClientIP(req))
+
+	want := map[string]string{
+		"X-Forwarded-For":   "",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "example.com",
+		"X-Real-Ip":         "1.2.3.4",
+		"Forwarded":         "for=1.2.3.4;proto=http;host=example.com",
+	}
+	for k, v := range want {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("untrusted: want header %s: %q, got %q", k, v, got)
+		}
+	}
+
+	// trusted peer keeps the forwarding headers
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:1000"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "api.example.com")
+	r.SetHeaders(req, r.ClientIP(req))
+
+	want = map[string]string{
+		"X-Forwarded-For":   "5.6.7.8",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "api.example.com",
+		"X-Real-Ip":         "5.6.7.8",
+		"Forwarded":         "for=10.0.0.2;proto=https;host=api.example.com",
+	}
+	for k, v := range want {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("trusted: want header %s: %q, got %q", k, v, got)
+		}
+	}
+
+	// prior Forwarded in multiple lines are all kept
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:1000"
+	req.Header.Add("Forwarded", "for=5.6.7.8")
+	req.Header.Add("Forwarded", "for=10.0.0.3")
+	r.SetHeaders(req, r.ClientIP(req))
+	if got, want := req.Header.Get("Forwarded"),
+		"for=5.6.7.8, for=10.0.0.3, for=10.0.0.2;proto=http;host=example.com"; got != want {
+		t.Errorf("multiple lines: want Forwarded %q, got %q", want, got)
+	}
+
+	// peer of unix socket has no IP
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "@"
+	r.SetHeaders(req, r.ClientIP(req))
+	if got, want := req.Header.Get("Forwarded"), "for=unknown;proto=http;host=example.com"; got != want {
+		t.Errorf("unix socket: want Forwarded %q, got %q", want, got)
+	}
+}
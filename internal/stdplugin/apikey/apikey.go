@@ -0,0 +1,231 @@
+// Package apikey to authenticate request with API key of consumers, which
+// are stored in the config source and loaded into consumer.DefaultStore.
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/consumer"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &APIKey{}
+	_ plugin.Lifecycle = &APIKey{}
+	_ plugin.Deriver   = &APIKey{}
+	_ plugin.Phaser    = &APIKey{}
+
+	errNoKey = errors.New("missing key")
+
+	// default header to read key
+	defaultHeader = "X-Api-Key"
+)
+
+func init() {
+	plugin.Register("apikey", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of APIKey
+type Config struct {
+	// Header to read key, default is X-Api-Key
+	Header string `json:"header"`
+	// Query parameter to read key, tried after Header, empty means not read
+	Query string `json:"query"`
+	// KeepKey pass key to upstream, it's stripped by default
+	KeepKey bool `json:"keep_key"`
+	// ConsumerHeader header to forward consumer idx, empty means not
+	// forwarded
+	ConsumerHeader string `json:"consumer_header"`
+	// PlanHeader header to forward plan of consumer, empty means not
+	// forwarded
+	PlanHeader string `json:"plan_header"`
+}
+
+// New an APIKey with cfgData of Config
+func New(cfgData []byte) (*APIKey, error) {
+	a := &APIKey{
+		store:   consumer.DefaultStore,
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := a.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// APIKey plugin to authenticate request with API key
+type APIKey struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	store   *consumer.Store
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (a *APIKey) Init(cfgData []byte) error {
+	return a.apply(cfgData)
+}
+
+// Reload config with cfgData
+func (a *APIKey) Reload(cfgData []byte) error {
+	a.setStatus(plugin.Reloading)
+	err := a.apply(cfgData)
+	a.Enable(a.Enabled())
+	return err
+}
+
+// Close ...
+func (a *APIKey) Close() error {
+	a.setStatus(plugin.Stopped)
+	return nil
+}
+
+// Derive a new APIKey with config fields overridden by cfgData
+func (a *APIKey) Derive(cfgData []byte) (plugin.Plugin, error) {
+	a.mutex.RLock()
+	cfg, store := *a.cfg, a.store
+	a.mutex.RUnlock()
+
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(&cfg)
+	d, err := New(byts)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+	return d, nil
+}
+
+// Handle identify consumer with key, reject with 401 if unknown, revoked
+// or expired.
+func (a *APIKey) Handle(ctx *plugin.Context) {
+	a.mutex.RLock()
+	cfg, store := a.cfg, a.store
+	a.mutex.RUnlock()
+
+	req := ctx.Request()
+	key := req.Header.Get(cfg.Header)
+	if key == "" && cfg.Query != "" {
+		key = req.URL.Query().Get(cfg.Query)
+	}
+	if key == "" {
+		unauthorized(ctx, errNoKey)
+		return
+	}
+	c, err := store.Lookup(key, time.Now())
+	if err != nil {
+		unauthorized(ctx, err)
+		return
+	}
+
+	ctx.SetValue(plugin.KeyConsumer, c.Idx)
+	ctx.SetValue(plugin.KeyPlan, c.Plan)
+	if !cfg.KeepKey {
+		strip(ctx, cfg)
+	}
+	for header, v := range map[string]string{cfg.ConsumerHeader: c.Idx, cfg.PlanHeader: c.Plan} {
+		if header != "" {
+			req.Header.Set(header, v)
+		}
+	}
+	ctx.Next()
+}
+
+// strip key from request and form, so it's neither proxied nor logged
+func strip(ctx *plugin.Context, cfg *Config) {
+	req := ctx.Request()
+	req.Header.Del(cfg.Header)
+	if cfg.Query == "" {
+		return
+	}
+	if query := req.URL.Query(); query.Get(cfg.Query) != "" {
+		query.Del(cfg.Query)
+		req.URL.RawQuery = query.Encode()
+	}
+	if ctx.Form != nil {
+		ctx.Form.Del(cfg.Query)
+	}
+}
+
+func unauthorized(ctx *plugin.Context, err error) {
+	ctx.String(http.StatusUnauthorized, "Unauthorized: "+err.Error())
+}
+
+// Enabled ...
+func (a *APIKey) Enabled() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.enabled
+}
+
+// Status ...
+func (a *APIKey) Status() plugin.PlgStatus {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.status
+}
+
+// Name ...
+func (a *APIKey) Name() string {
+	return "plugin.apikey"
+}
+
+// Enable ...
+func (a *APIKey) Enable(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.enabled = enabled
+	if !enabled {
+		a.status = plugin.Stopped
+	} else {
+		a.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (a *APIKey) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority ...
+func (a *APIKey) Priority() int {
+	return 0
+}
+
+func (a *APIKey) setStatus(status plugin.PlgStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.status = status
+}
+
+// apply Config in cfgData, defaults are used if cfgData is empty
+func (a *APIKey) apply(cfgData []byte) error {
+	if len(cfgData) == 0 && a.cfg != nil {
+		return nil
+	}
+
+	cfg := new(Config)
+	if len(cfgData) != 0 {
+		if err := json.Unmarshal(cfgData, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Header == "" {
+		cfg.Header = defaultHeader
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.cfg = cfg
+	return nil
+}
@@ -0,0 +1,72 @@
+package apikey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/consumer"
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_APIKey(t *testing.T) {
+	store := consumer.NewStore()
+	store.Load([]*consumer.Consumer{
+		{Idx: "partner", Plan: "pro", Keys: []*consumer.Key{
+			{Hash: consumer.Hash("good")},
+			{Key: "old", Revoked: true},
+		}},
+	})
+	a, err := New([]byte(`{"query": "api_key", "consumer_header": "X-Consumer-Id", "plan_header": "X-Plan"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.store = store
+
+	serve := func(req *http.Request) (*plugin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		ctx := plugin.NewContext(w, req, []plugin.Plugin{a})
+		ctx.Next()
+		return ctx, w
+	}
+
+	// key in header, stripped and consumer forwarded
+	req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+	req.Header.Set("X-Api-Key", "good")
+	req.Header.Set("X-Consumer-Id", "forged")
+	ctx, w := serve(req)
+	if ctx.Aborted() {
+		t.Fatalf("want allowed, got %d", w.Code)
+	}
+	if ctx.GetString(plugin.KeyConsumer) != "partner" || ctx.GetString(plugin.KeyPlan) != "pro" {
+		t.Errorf("want consumer partner of plan pro, got %s %s",
+			ctx.GetString(plugin.KeyConsumer), ctx.GetString(plugin.KeyPlan))
+	}
+	if h := ctx.Request().Header; h.Get("X-Api-Key") != "" || h.Get("X-Consumer-Id") != "partner" || h.Get("X-Plan") != "pro" {
+		t.Errorf("want key stripped and consumer forwarded, got %v", h)
+	}
+
+	// key in query, stripped from query and form
+	ctx, w = serve(httptest.NewRequest("GET", "http://example.com/orders?api_key=good&page=2", nil))
+	if ctx.Aborted() {
+		t.Fatalf("want allowed, got %d", w.Code)
+	}
+	if q := ctx.Request().URL.RawQuery; q != "page=2" || ctx.Form.Get("api_key") != "" {
+		t.Errorf("want key stripped from query and form, got %s %v", q, ctx.Form)
+	}
+
+	for key, want := range map[string]string{"": "missing key", "old": "revoked key", "bad": "unknown key"} {
+		req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+		req.Header.Set("X-Api-Key", key)
+		if _, w := serve(req); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%q: want 401 of %s, got %d %s", key, want, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Package concurrency to cap in-flight requests per route or cluster, so
+// slow backends are protected, which rate limits could not do.
+//
+// Requests over the limit wait in a queue briefly, then shed with 503. In
+// adaptive mode, the limit is adjusted by observed upstream latency with
+// AIMD or gradient, to shed load before backends fall over. Requests of
+// priority classes with larger share of the limit, like health checks and
+// critical routes, are shed last.
+package concurrency
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+// keys to limit by
+const (
+	KeyByRoute   = "route"
+	KeyByCluster = "cluster"
+	KeyByGlobal  = "global"
+)
+
+var (
+	_ plugin.Plugin    = &Limiter{}
+	_ plugin.Lifecycle = &Limiter{}
+	_ plugin.Deriver   = &Limiter{}
+	_ plugin.Phaser    = &Limiter{}
+
+	errInvalidConcurrency = errors.New("concurrency: min, initial and max concurrency must be positive and in order")
+	errInvalidShare       = errors.New("concurrency: share must be in (0, 1]")
+
+	// shed requests count by key
+	shedCounter = expvar.NewMap("concurrency_shed")
+
+	// default max requests in-flight
+	defaultMaxConcurrency = 100
+	// default milliseconds to wait in queue
+	defaultQueueTimeout = 100
+	// default ratio to decrease limit of AIMD
+	defaultBackoffRatio = 0.9
+	// default share of limit without priority class matched
+	defaultShare = 1.0
+	// default share of limit without priority class matched, if any
+	// priority class configured, to reserve capacity for them
+	defaultShareWithPriorities = 0.9
+)
+
+func init() {
+	plugin.Register("concurrency", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of Limiter
+type Config struct {
+	// KeyBy one of "route", "cluster" and "global", default is "route"
+	KeyBy string `json:"key_by"`
+	// MaxConcurrency max requests in-flight of a key, default is 100
+	MaxConcurrency int `json:"max_concurrency"`
+	// QueueSize max requests waiting for a slot of a key, 0 means shed
+	// immediately
+	QueueSize int `json:"queue_size"`
+	// QueueTimeout milliseconds to wait in queue, default is 100
+	QueueTimeout int `json:"queue_timeout"`
+
+	// Adaptive one of "aimd" and "gradient", empty means fixed limit
+	Adaptive string `json:"adaptive"`
+	// MinConcurrency min limit of adaptive mode, default is 1
+	MinConcurrency int `json:"min_concurrency"`
+	// InitialConcurrency initial limit of adaptive mode, default is
+	// MaxConcurrency
+	InitialConcurrency int `json:"initial_concurrency"`
+	// LatencyThreshold milliseconds of latency to decrease limit of AIMD,
+	// 0 means only failures (5xx) decrease the limit
+	LatencyThreshold int `json:"latency_threshold"`
+	// BackoffRatio to decrease limit of AIMD, default is 0.9
+	BackoffRatio float64 `json:"backoff_ratio"`
+
+	// Priorities classes of request, the first matched is used
+	Priorities []*Priority `json:"priorities"`
+	// DefaultShare share of limit without priority class matched, default
+	// is 0.9 if any priority class configured, or 1
+	DefaultShare float64 `json:"default_share"`
+}
+
+// Priority class of request, matched by path prefix, route or header
+type Priority struct {
+	Name string `json:"name"`
+	// Share of limit could be used by requests of the class, requests with
+	// smaller share are shed first
+	Share float64 `json:"share"`
+	// Paths prefixes of request path
+	Paths []string `json:"paths"`
+	// Routes like "api/idx" or "routing/idx"
+	Routes []string `json:"routes"`
+	// Header name and Values to match
+	Header string   `json:"header"`
+	Values []string `json:"values"`
+}
+
+func (p *Priority) match(ctx *plugin.Context) bool {
+	for _, prefix := range p.Paths {
+		if strings.HasPrefix(ctx.Path, prefix) {
+			return true
+		}
+	}
+	if route := ctx.Route(); route != nil && len(p.Routes) != 0 {
+		id := string(route.Kind) + "/" + route.RuleID()
+		for _, r := range p.Routes {
+			if r == id {
+				return true
+			}
+		}
+	}
+	if p.Header != "" {
+		v := ctx.Request().Header.Get(p.Header)
+		for _, want := range p.Values {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// New a Limiter with cfgData of Config
+func New(cfgData []byte) (*Limiter, error) {
+	l := &Limiter{
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := l.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Limiter plugin to cap in-flight requests and shed load
+type Limiter struct {
+	mutex    sync.RWMutex
+	cfg      *Config
+	limiters map[string]*limiter // limiters by key
+	enabled  bool
+	status   plugin.PlgStatus
+}
+
+// Init ...
+func (l *Limiter) Init(cfgData []byte) error {
+	return l.apply(cfgData)
+}
+
+// Reload config with cfgData, limits are reset
+func (l *Limiter) Reload(cfgData []byte) error {
+	l.setStatus(plugin.Reloading)
+	err := l.apply(cfgData)
+	l.Enable(l.Enabled())
+	return err
+}
+
+// Close ...
+func (l *Limiter) Close() error {
+	l.setStatus(plugin.Stopped)
+	return nil
+}
+
+// Derive a new Limiter with config fields overridden by cfgData, requests
+// are limited separately. Config is decoded again from JSON of the parent,
+// so priorities of the parent are never shared or modified.
+func (l *Limiter) Derive(cfgData []byte) (plugin.Plugin, error) {
+	l.mutex.RLock()
+	parent, err := json.Marshal(l.cfg)
+	l.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(parent, cfg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(cfg)
+	return New(byts)
+}
+
+// Handle acquire a slot and release it after request proxied, or shed the
+// request with 503.
+func (l *Limiter) Handle(ctx *plugin.Context) {
+	var (
+		key   = l.key(ctx)
+		lim   = l.limiter(key)
+		share = l.share(ctx)
+	)
+	if !lim.acquire(ctx.Request().Context(), share) {
+		shedCounter.Add(key, 1)
+		ctx.ResponseWriter().Header().Set("Retry-After", "1")
+		ctx.String(http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+
+	var (
+		sw    = &statusWriter{ResponseWriter: ctx.ResponseWriter(), status: http.StatusOK}
+		start = time.Now()
+	)
+	ctx.SetResponseWriter(sw)
+	ctx.OnFinish(func() {
+		lim.release(time.Since(start), sw.status >= http.StatusInternalServerError)
+	})
+	ctx.Next()
+}
+
+// key of ctx to limit by
+func (l *Limiter) key(ctx *plugin.Context) string {
+	l.mutex.RLock()
+	keyBy := l.cfg.KeyBy
+	l.mutex.RUnlock()
+
+	route := ctx.Route()
+	switch {
+	case keyBy == KeyByGlobal || route == nil:
+		return ""
+	case keyBy == KeyByCluster:
+		return route.ClusterID
+	}
+	return string(route.Kind) + "/" + route.RuleID()
+}
+
+// limiter of key, created if not exists
+func (l *Limiter) limiter(key string) *limiter {
+	l.mutex.RLock()
+	lim, ok := l.limiters[key]
+	l.mutex.RUnlock()
+	if ok {
+		return lim
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if lim, ok = l.limiters[key]; !ok {
+		lim = newLimiter(l.cfg)
+		l.limiters[key] = lim
+	}
+	return lim
+}
+
+// share of limit for ctx, of the first priority class matched
+func (l *Limiter) share(ctx *plugin.Context) float64 {
+	l.mutex.RLock()
+	cfg := l.cfg
+	l.mutex.RUnlock()
+
+	for _, p := range cfg.Priorities {
+		if p.match(ctx) {
+			return p.Share
+		}
+	}
+	return cfg.DefaultShare
+}
+
+// Enabled ...
+func (l *Limiter) Enabled() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.enabled
+}
+
+// Status ...
+func (l *Limiter) Status() plugin.PlgStatus {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.status
+}
+
+// Name ...
+func (l *Limiter) Name() string {
+	return "plugin.concurrency"
+}
+
+// Enable ...
+func (l *Limiter) Enable(enabled bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.enabled = enabled
+	if !enabled {
+		l.status = plugin.Stopped
+	} else {
+		l.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (l *Limiter) Phase() plugin.Phase {
+	return plugin.PhaseRateLimit
+}
+
+// Priority lower than ratelimit, so requests limited by rate never take
+// a slot
+func (l *Limiter) Priority() int {
+	return -10
+}
+
+func (l *Limiter) setStatus(status plugin.PlgStatus) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.status = status
+}
+
+// apply Config in cfgData, defaults are used if cfgData is empty
+func (l *Limiter) apply(cfgData []byte) error {
+	if len(cfgData) == 0 && l.cfg != nil {
+		return nil
+	}
+
+	cfg := new(Config)
+	if len(cfgData) != 0 {
+		if err := json.Unmarshal(cfgData, cfg); err != nil {
+			return err
+		}
+	}
+	if err := complete(cfg); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.cfg == nil || l.cfg.KeyBy != cfg.KeyBy {
+		l.limiters = make(map[string]*limiter)
+	} else {
+		// limiters are kept with requests in-flight counted, or the limit
+		// would be exceeded right after reloading
+		for _, lim := range l.limiters {
+			lim.reconfigure(cfg)
+		}
+	}
+	l.cfg = cfg
+	return nil
+}
+
+// complete cfg with defaults and validate it
+func complete(cfg *Config) error {
+	switch cfg.KeyBy {
+	case "":
+		cfg.KeyBy = KeyByRoute
+	case KeyByRoute, KeyByCluster, KeyByGlobal:
+	default:
+		return fmt.Errorf("concurrency: unknown key_by: %s", cfg.KeyBy)
+	}
+	switch cfg.Adaptive {
+	case "", AdaptiveAIMD, AdaptiveGradient:
+	default:
+		return fmt.Errorf("concurrency: unknown adaptive: %s", cfg.Adaptive)
+	}
+
+	if cfg.MaxConcurrency == 0 {
+		cfg.MaxConcurrency = defaultMaxConcurrency
+	}
+	if cfg.MinConcurrency == 0 {
+		cfg.MinConcurrency = 1
+	}
+	if cfg.InitialConcurrency == 0 {
+		cfg.InitialConcurrency = cfg.MaxConcurrency
+	}
+	if cfg.MinConcurrency < 1 || cfg.MinConcurrency > cfg.InitialConcurrency ||
+		cfg.InitialConcurrency > cfg.MaxConcurrency {
+		return errInvalidConcurrency
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+	if cfg.BackoffRatio <= 0 || cfg.BackoffRatio >= 1 {
+		cfg.BackoffRatio = defaultBackoffRatio
+	}
+
+	if cfg.DefaultShare == 0 {
+		cfg.DefaultShare = defaultShare
+		if len(cfg.Priorities) != 0 {
+			cfg.DefaultShare = defaultShareWithPriorities
+		}
+	}
+	if cfg.DefaultShare < 0 || cfg.DefaultShare > 1 {
+		return errInvalidShare
+	}
+	for _, p := range cfg.Priorities {
+		if p.Share <= 0 || p.Share > 1 {
+			return errInvalidShare
+		}
+	}
+	return nil
+}
+
+// statusWriter to observe status of response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush to support streaming response
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
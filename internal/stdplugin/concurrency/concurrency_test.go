@@ -0,0 +1,198 @@
+package concurrency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func newContext(l *Limiter, path string) (*plugin.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	w := httptest.NewRecorder()
+	return plugin.NewContext(w, req, []plugin.Plugin{l}), w
+}
+
+func Test_Limiter(t *testing.T) {
+	l, err := New([]byte(`{"max_concurrency": 4, "queue_size": 1, "queue_timeout": 50,
+		"priorities": [{"name": "health", "share": 1, "paths": ["/health"]}],
+		"default_share": 0.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// default class could use half of the limit
+	var inflight []*plugin.Context
+	for i := 0; i < 2; i++ {
+		ctx, _ := newContext(l, "/orders")
+		ctx.Next()
+		if ctx.Aborted() {
+			t.Fatalf("#%d want admitted", i)
+		}
+		inflight = append(inflight, ctx)
+	}
+	ctx, w := newContext(l, "/orders")
+	ctx.Next()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("want shed after queue timeout, got %d", w.Code)
+	}
+
+	// health checks are shed last
+	ctx, _ = newContext(l, "/health")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Error("want health check admitted")
+	}
+	inflight = append(inflight, ctx)
+
+	// waiting in queue until slots released, the health check is counted
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		inflight[0].Finish()
+		inflight[2].Finish()
+	}()
+	ctx, _ = newContext(l, "/orders")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Error("want admitted from queue")
+	}
+
+	if _, err := New([]byte(`{"priorities": [{"name": "bad", "share": 2}]}`)); err != errInvalidShare {
+		t.Errorf("want error %v, got %v", errInvalidShare, err)
+	}
+	if _, err := New([]byte(`{"adaptive": "unknown"}`)); err == nil {
+		t.Error("want error of unknown adaptive")
+	}
+}
+
+func Test_Limiter_Derive(t *testing.T) {
+	l, err := New([]byte(`{"max_concurrency": 4,
+		"priorities": [{"name": "health", "share": 1, "paths": ["/health"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := l.Derive([]byte(`{"priorities": [{"name": "batch", "share": 0.2, "paths": ["/batch"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := d.(*Limiter).cfg.Priorities[0]; p.Name != "batch" || p.Share != 0.2 {
+		t.Errorf("want priority overridden, got %+v", p)
+	}
+	// the parent is never modified by the override
+	if p := l.cfg.Priorities[0]; p.Name != "health" || p.Share != 1 || p.Paths[0] != "/health" {
+		t.Errorf("want priority of parent unchanged, got %+v", p)
+	}
+}
+
+func Test_Limiter_Reload(t *testing.T) {
+	l, err := New([]byte(`{"max_concurrency": 2, "queue_size": 0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func() *plugin.Context {
+		ctx, _ := newContext(l, "/orders")
+		ctx.Next()
+		return ctx
+	}
+	for i := 0; i < 2; i++ {
+		if serve().Aborted() {
+			t.Fatalf("#%d want admitted", i)
+		}
+	}
+
+	// requests in-flight are still counted after reloading
+	if err := l.Reload([]byte(`{"max_concurrency": 3, "queue_size": 0}`)); err != nil {
+		t.Fatal(err)
+	}
+	if serve().Aborted() {
+		t.Error("want admitted with limit raised")
+	}
+	if !serve().Aborted() {
+		t.Error("want shed with in-flight requests counted")
+	}
+}
+
+func Test_limiter_priority(t *testing.T) {
+	cfg := &Config{MaxConcurrency: 1, QueueSize: 2, QueueTimeout: 1000}
+	complete(cfg)
+	lim := newLimiter(cfg)
+	lim.acquire(context.Background(), 1)
+
+	admitted := make(chan float64, 2)
+	for _, share := range []float64{0.5, 1} {
+		share := share
+		go func() {
+			if lim.acquire(context.Background(), share) {
+				admitted <- share
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the waiter with larger share goes first
+	lim.release(time.Millisecond, false)
+	if share := <-admitted; share != 1 {
+		t.Errorf("want share 1 admitted first, got %v", share)
+	}
+	lim.release(time.Millisecond, false)
+	if share := <-admitted; share != 0.5 {
+		t.Errorf("want share 0.5 admitted then, got %v", share)
+	}
+}
+
+func Test_limiter_aimd(t *testing.T) {
+	cfg := &Config{MaxConcurrency: 100, InitialConcurrency: 10, Adaptive: AdaptiveAIMD,
+		LatencyThreshold: 100}
+	if err := complete(cfg); err != nil {
+		t.Fatal(err)
+	}
+	lim := newLimiter(cfg)
+
+	// increased while the limit is used
+	lim.inflight = 5
+	lim.adjust(10*time.Millisecond, false)
+	if limit, _, _ := lim.stats(); limit != 11 {
+		t.Errorf("want limit 11, got %v", limit)
+	}
+
+	// decreased by slow or failed upstream
+	lim.adjust(200*time.Millisecond, false)
+	lim.adjust(10*time.Millisecond, true)
+	if limit, _, _ := lim.stats(); limit < 8.9 || limit > 8.92 {
+		t.Errorf("want limit 8.91, got %v", limit)
+	}
+
+	for i := 0; i < 100; i++ {
+		lim.adjust(time.Second, true)
+	}
+	if limit, _, _ := lim.stats(); limit != 1 {
+		t.Errorf("want min limit 1, got %v", limit)
+	}
+}
+
+func Test_limiter_gradient(t *testing.T) {
+	cfg := &Config{MaxConcurrency: 100, InitialConcurrency: 50, Adaptive: AdaptiveGradient}
+	if err := complete(cfg); err != nil {
+		t.Fatal(err)
+	}
+	lim := newLimiter(cfg)
+
+	for i := 0; i < 50; i++ {
+		lim.adjust(10*time.Millisecond, false)
+	}
+	steady, _, _ := lim.stats()
+	if steady != 100 {
+		t.Errorf("want limit grown to max with steady latency, got %v", steady)
+	}
+
+	// latency increased, load shed
+	for i := 0; i < 20; i++ {
+		lim.adjust(100*time.Millisecond, false)
+	}
+	if limit, _, _ := lim.stats(); limit >= steady/2 {
+		t.Errorf("want limit decreased, got %v", limit)
+	}
+}
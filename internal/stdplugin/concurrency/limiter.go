@@ -0,0 +1,196 @@
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// adaptive algorithms of limit
+const (
+	AdaptiveAIMD     = "aimd"
+	AdaptiveGradient = "gradient"
+)
+
+const (
+	// samples of the long-term latency of gradient
+	gradientLongWindow = 600
+	// max ratio of the current latency to the long-term one, as tolerance
+	gradientTolerance = 1.5
+	// weight of new limit of gradient
+	gradientSmoothing = 0.2
+)
+
+// limiter cap in-flight requests, requests over the limit wait in queue
+// ordered by share, the limit would be adjusted by observed latency in
+// adaptive mode.
+type limiter struct {
+	mutex    sync.Mutex
+	cfg      *Config
+	limit    float64 // current limit, fixed if not adaptive
+	inflight int
+	waiters  *list.List // *waiter ordered by share, FIFO in same share
+
+	longRTT float64 // long-term latency in nanosecond of gradient
+}
+
+type waiter struct {
+	share    float64
+	ready    chan struct{}
+	admitted bool
+}
+
+func newLimiter(cfg *Config) *limiter {
+	limit := float64(cfg.MaxConcurrency)
+	if cfg.Adaptive != "" {
+		limit = float64(cfg.InitialConcurrency)
+	}
+	return &limiter{cfg: cfg, limit: limit, waiters: list.New()}
+}
+
+// capacity of requests in-flight for share of limit
+func (l *limiter) capacity(share float64) int {
+	c := int(l.limit * share)
+	if c < 1 {
+		c = 1
+	}
+	return c
+}
+
+// acquire a slot with share of limit, waiting in queue until deadline if
+// there is no slot, false returned if shed.
+func (l *limiter) acquire(ctx context.Context, share float64) bool {
+	l.mutex.Lock()
+	// waiters with share not less than it go first
+	front := l.waiters.Front()
+	if l.inflight < l.capacity(share) && (front == nil || front.Value.(*waiter).share < share) {
+		l.inflight++
+		l.mutex.Unlock()
+		return true
+	}
+	if l.waiters.Len() >= l.cfg.QueueSize {
+		l.mutex.Unlock()
+		return false
+	}
+	timeout := time.Duration(l.cfg.QueueTimeout) * time.Millisecond
+
+	w := &waiter{share: share, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	for e := elem.Prev(); e != nil && e.Value.(*waiter).share < share; e = elem.Prev() {
+		l.waiters.MoveBefore(elem, e)
+	}
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if w.admitted {
+		return true
+	}
+	l.waiters.Remove(elem)
+	return false
+}
+
+// release the slot acquired, latency and failure of upstream are observed
+// to adjust limit in adaptive mode.
+func (l *limiter) release(latency time.Duration, failed bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.adjust(latency, failed)
+	l.inflight--
+	l.admit()
+}
+
+// reconfigure with cfg, requests in-flight and waiting are kept, so the
+// limit is never exceeded after reloading.
+func (l *limiter) reconfigure(cfg *Config) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case cfg.Adaptive == "":
+		l.limit = float64(cfg.MaxConcurrency)
+	case cfg.Adaptive != l.cfg.Adaptive:
+		l.limit, l.longRTT = float64(cfg.InitialConcurrency), 0
+	default:
+		// the limit adjusted is kept within the new bounds
+		l.limit = math.Max(float64(cfg.MinConcurrency),
+			math.Min(float64(cfg.MaxConcurrency), l.limit))
+	}
+	l.cfg = cfg
+	l.admit()
+}
+
+// admit waiters in order, the head blocks others to keep priority, mutex
+// should be held
+func (l *limiter) admit() {
+	for e := l.waiters.Front(); e != nil; e = l.waiters.Front() {
+		w := e.Value.(*waiter)
+		if l.inflight >= l.capacity(w.share) {
+			return
+		}
+		l.waiters.Remove(e)
+		l.inflight++
+		w.admitted = true
+		close(w.ready)
+	}
+}
+
+func (l *limiter) adjust(latency time.Duration, failed bool) {
+	var (
+		cfg   = l.cfg
+		limit = l.limit
+	)
+	switch cfg.Adaptive {
+	case AdaptiveAIMD:
+		threshold := time.Duration(cfg.LatencyThreshold) * time.Millisecond
+		if failed || (threshold > 0 && latency > threshold) {
+			limit *= cfg.BackoffRatio
+		} else if float64(l.inflight)*2 >= limit {
+			// only increase while the limit is used
+			limit++
+		}
+
+	case AdaptiveGradient:
+		rtt := float64(latency)
+		if l.longRTT == 0 {
+			l.longRTT = rtt
+		}
+		l.longRTT += (rtt - l.longRTT) / gradientLongWindow
+		if l.longRTT > 2*rtt {
+			// latency recovered, so speed up the long-term latency to follow
+			l.longRTT *= 0.95
+		}
+
+		gradient := math.Max(0.5, math.Min(1, gradientTolerance*l.longRTT/rtt))
+		if failed {
+			gradient = 0.5
+		}
+		newLimit := limit*gradient + math.Sqrt(limit)
+		limit = limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+
+	default:
+		return
+	}
+
+	l.limit = math.Max(float64(cfg.MinConcurrency),
+		math.Min(float64(cfg.MaxConcurrency), limit))
+}
+
+// stats of limiter
+func (l *limiter) stats() (limit float64, inflight, waiting int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit, l.inflight, l.waiters.Len()
+}
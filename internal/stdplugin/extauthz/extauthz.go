@@ -0,0 +1,376 @@
+// Package extauthz to authorize request by calling out an external HTTP
+// service, like ext_authz of Envoy, so policies could be written in any
+// language.
+//
+// Request metadata is posted to service as JSON of CheckRequest, the
+// service responds with 200 and JSON of Decision. Any other status or
+// error is treated as failure, see Config.FailureModeAllow.
+package extauthz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &ExtAuthz{}
+	_ plugin.Lifecycle = &ExtAuthz{}
+	_ plugin.Deriver   = &ExtAuthz{}
+	_ plugin.Phaser    = &ExtAuthz{}
+
+	errNoURL = errors.New("extauthz: url must be set")
+
+	// default timeout to call out, default is 200 millisecond
+	defaultTimeout = 200 * time.Millisecond
+	// default max bytes of body sent to service
+	defaultMaxBodyBytes int64 = 8192
+)
+
+func init() {
+	plugin.Register("extauthz", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of ExtAuthz
+type Config struct {
+	// URL of authorization service
+	URL string `json:"url"`
+	// Timeout to call out in millisecond
+	Timeout int `json:"timeout"`
+	// IncludeBody send request body to service or not
+	IncludeBody bool `json:"include_body"`
+	// MaxBodyBytes max bytes of body to send, body larger would be truncated
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// AllowedHeaders request headers to send, empty means all
+	AllowedHeaders []string `json:"allowed_headers"`
+	// FailureModeAllow allow request while service failed
+	FailureModeAllow bool `json:"failure_mode_allow"`
+	// StatusOnError status of response while service failed, default is 403
+	StatusOnError int `json:"status_on_error"`
+}
+
+// CheckRequest posted to authorization service
+type CheckRequest struct {
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Query     string            `json:"query"`
+	Host      string            `json:"host"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+	ClientIP  string            `json:"client_ip"`
+	RequestID string            `json:"request_id"`
+	RouteKind string            `json:"route_kind,omitempty"`
+	RuleID    string            `json:"rule_id,omitempty"`
+	ClusterID string            `json:"cluster_id,omitempty"`
+}
+
+// Decision responded by authorization service
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Status of denied response, default is 403
+	Status int `json:"status"`
+	// Body of denied response
+	Body string `json:"body"`
+	// Headers to set on upstream request if allowed, or on response if denied
+	Headers map[string]string `json:"headers"`
+	// RemoveHeaders to remove from upstream request if allowed
+	RemoveHeaders []string `json:"remove_headers"`
+	// Consumer authenticated, would be stored with plugin.KeyConsumer
+	Consumer string `json:"consumer"`
+}
+
+// New an ExtAuthz with cfgData of Config
+func New(cfgData []byte) (*ExtAuthz, error) {
+	a := &ExtAuthz{
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := a.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ExtAuthz plugin to authorize request by external service
+type ExtAuthz struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	client  *http.Client
+	allowed map[string]bool // canonical allowed headers
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (a *ExtAuthz) Init(cfgData []byte) error {
+	return a.apply(cfgData)
+}
+
+// Reload config with cfgData
+func (a *ExtAuthz) Reload(cfgData []byte) error {
+	a.setStatus(plugin.Reloading)
+	err := a.apply(cfgData)
+	a.Enable(a.Enabled())
+	return err
+}
+
+// Close idle connections to service
+func (a *ExtAuthz) Close() error {
+	a.mutex.RLock()
+	client := a.client
+	a.mutex.RUnlock()
+	if client != nil {
+		if t, ok := client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// Derive a new ExtAuthz with config fields overridden by cfgData. Config is
+// decoded again from JSON of the parent, so allowed headers of the parent
+// are never shared or modified.
+func (a *ExtAuthz) Derive(cfgData []byte) (plugin.Plugin, error) {
+	a.mutex.RLock()
+	parent, err := json.Marshal(a.cfg)
+	a.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(parent, cfg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(cfg)
+	return New(byts)
+}
+
+// Handle ...
+func (a *ExtAuthz) Handle(ctx *plugin.Context) {
+	a.mutex.RLock()
+	cfg, client, allowed := a.cfg, a.client, a.allowed
+	a.mutex.RUnlock()
+
+	decision, err := a.check(ctx, cfg, client, allowed)
+	if err != nil {
+		logger.Logger.Errorf("extauthz call %s got error: %v", cfg.URL, err)
+		if cfg.FailureModeAllow {
+			ctx.Next()
+			return
+		}
+		status := cfg.StatusOnError
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		ctx.String(status, http.StatusText(status))
+		return
+	}
+
+	if !decision.Allow {
+		status := decision.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		body := decision.Body
+		if body == "" {
+			body = http.StatusText(status)
+		}
+		for k, v := range decision.Headers {
+			ctx.ResponseWriter().Header().Set(k, v)
+		}
+		ctx.String(status, body)
+		return
+	}
+
+	req := ctx.Request()
+	for _, k := range decision.RemoveHeaders {
+		req.Header.Del(k)
+	}
+	for k, v := range decision.Headers {
+		req.Header.Set(k, v)
+	}
+	if decision.Consumer != "" {
+		ctx.SetValue(plugin.KeyConsumer, decision.Consumer)
+	}
+	ctx.Next()
+}
+
+// check post CheckRequest to service and get the Decision
+func (a *ExtAuthz) check(ctx *plugin.Context, cfg *Config, client *http.Client,
+	allowed map[string]bool) (*Decision, error) {
+	req := ctx.Request()
+	checkReq := &CheckRequest{
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Host:      req.Host,
+		Headers:   make(map[string]string, len(req.Header)),
+		ClientIP:  ctx.ClientIP,
+		RequestID: ctx.GetString(plugin.KeyRequestID),
+	}
+	for k, v := range req.Header {
+		if len(allowed) != 0 && !allowed[k] {
+			continue
+		}
+		checkReq.Headers[k] = strings.Join(v, ",")
+	}
+	if route := ctx.Route(); route != nil {
+		checkReq.RouteKind = string(route.Kind)
+		checkReq.RuleID = route.RuleID()
+		checkReq.ClusterID = route.ClusterID
+	}
+	if cfg.IncludeBody && req.Body != nil && req.Body != http.NoBody {
+		body, truncated, err := peekBody(req, cfg.MaxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+		checkReq.Body, checkReq.Truncated = string(body), truncated
+	}
+
+	byts, err := json.Marshal(checkReq)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(cfg.URL, "application/json", bytes.NewReader(byts))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	decision := new(Decision)
+	if err = json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+// Enabled ...
+func (a *ExtAuthz) Enabled() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.enabled
+}
+
+// Status ...
+func (a *ExtAuthz) Status() plugin.PlgStatus {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.status
+}
+
+// Name ...
+func (a *ExtAuthz) Name() string {
+	return "plugin.extauthz"
+}
+
+// Enable ...
+func (a *ExtAuthz) Enable(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.enabled = enabled
+	if !enabled {
+		a.status = plugin.Stopped
+	} else {
+		a.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (a *ExtAuthz) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority ...
+func (a *ExtAuthz) Priority() int {
+	return 0
+}
+
+func (a *ExtAuthz) setStatus(status plugin.PlgStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.status = status
+}
+
+// apply Config in cfgData, empty cfgData would be ignored
+func (a *ExtAuthz) apply(cfgData []byte) error {
+	if len(cfgData) == 0 {
+		if a.cfg == nil {
+			return errNoURL
+		}
+		return nil
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		return errNoURL
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	timeout := defaultTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	allowed := make(map[string]bool, len(cfg.AllowedHeaders))
+	for _, k := range cfg.AllowedHeaders {
+		allowed[http.CanonicalHeaderKey(k)] = true
+	}
+
+	a.mutex.Lock()
+	old := a.client
+	a.cfg = cfg
+	a.allowed = allowed
+	a.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: 64},
+	}
+	a.mutex.Unlock()
+
+	if old != nil {
+		old.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	return nil
+}
+
+// peekBody read at most max bytes of req body, and restore the body so
+// it could be read again by upstream.
+func peekBody(req *http.Request, max int64) ([]byte, bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if int64(len(body)) > max {
+		return body[:max], true, nil
+	}
+	return body, false, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
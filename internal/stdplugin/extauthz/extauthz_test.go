@@ -0,0 +1,118 @@
+package extauthz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+// authzServer stand-in service allow request with header "X-Token: good"
+func authzServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		checkReq := new(CheckRequest)
+		if err := json.NewDecoder(req.Body).Decode(checkReq); err != nil {
+			t.Errorf("decode check request got error: %v", err)
+		}
+		switch {
+		case checkReq.Headers["X-Token"] == "good":
+			json.NewEncoder(w).Encode(&Decision{
+				Allow:         true,
+				Headers:       map[string]string{"X-User": "alice"},
+				RemoveHeaders: []string{"X-Token"},
+				Consumer:      "alice",
+			})
+		case checkReq.Headers["X-Token"] == "crash":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(&Decision{
+				Allow:  false,
+				Status: http.StatusUnauthorized,
+				Body:   "bad token: " + checkReq.Body,
+			})
+		}
+	}))
+}
+
+func newContext(a *ExtAuthz, token, body string) (*plugin.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("POST", "http://example.com/orders", strings.NewReader(body))
+	req.Header.Set("X-Token", token)
+	w := httptest.NewRecorder()
+	return plugin.NewContext(w, req, []plugin.Plugin{a}), w
+}
+
+func Test_ExtAuthz(t *testing.T) {
+	srv := authzServer(t)
+	defer srv.Close()
+
+	a, err := New([]byte(`{"url": "` + srv.URL + `", "include_body": true,
+		"allowed_headers": ["X-Parent", "X-Token"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// allowed with headers mutated, body is still readable
+	ctx, w := newContext(a, "good", "payload")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Fatalf("want allowed, got status %d", w.Code)
+	}
+	req := ctx.Request()
+	if req.Header.Get("X-User") != "alice" || req.Header.Get("X-Token") != "" {
+		t.Errorf("want headers mutated, got %v", req.Header)
+	}
+	if got := ctx.GetString(plugin.KeyConsumer); got != "alice" {
+		t.Errorf("want consumer alice, got %q", got)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "payload" {
+		t.Errorf("want body restored, got %q", body)
+	}
+
+	// denied with status and body
+	ctx, w = newContext(a, "bad", "payload")
+	ctx.Next()
+	if !ctx.Aborted() || w.Code != http.StatusUnauthorized || w.Body.String() != "bad token: payload" {
+		t.Errorf("want denied with 401, got %d %q", w.Code, w.Body.String())
+	}
+
+	// failure closed
+	ctx, w = newContext(a, "crash", "")
+	ctx.Next()
+	if !ctx.Aborted() || w.Code != http.StatusForbidden {
+		t.Errorf("want denied with 403 while service failed, got %d", w.Code)
+	}
+
+	// failure open
+	d, err := a.Derive([]byte(`{"failure_mode_allow": true, "allowed_headers": ["X-Token"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, w = newContext(d.(*ExtAuthz), "crash", "")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Errorf("want allowed while service failed, got %d", w.Code)
+	}
+	// the parent is never modified by the override
+	if got := a.cfg.AllowedHeaders; len(got) != 2 || got[0] != "X-Parent" {
+		t.Errorf("want allowed headers of parent unchanged, got %v", got)
+	}
+}
+
+func Test_ExtAuthz_config(t *testing.T) {
+	if _, err := New(nil); err != errNoURL {
+		t.Errorf("want error %v, got %v", errNoURL, err)
+	}
+	if _, err := New([]byte(`{"timeout": 100}`)); err != errNoURL {
+		t.Errorf("want error %v, got %v", errNoURL, err)
+	}
+}
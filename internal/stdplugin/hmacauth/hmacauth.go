@@ -0,0 +1,391 @@
+// Package hmacauth to verify HMAC signature of request signed by
+// server-to-server partners, in format of HTTP signatures:
+//
+//	Authorization: Signature keyId="partner",algorithm="hmac-sha256",
+//		headers="(request-target) host date digest",signature="base64"
+//
+// The signature is over method, path, selected headers, date and digest
+// of body. Requests with date out of clock skew are rejected, and replays
+// in the window are rejected by a nonce cache. Secrets are looked up by
+// keyId in consumer.DefaultStore, or configured inline.
+package hmacauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/consumer"
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &HMACAuth{}
+	_ plugin.Lifecycle = &HMACAuth{}
+	_ plugin.Deriver   = &HMACAuth{}
+	_ plugin.Phaser    = &HMACAuth{}
+
+	errBodyTooLarge   = errors.New("body too large")
+	errNonceCacheFull = errors.New("nonce cache full")
+
+	// default seconds of clock skew allowed
+	defaultClockSkew = 300
+	// default max bytes of body to buffer
+	defaultMaxBodyBytes int64 = 1 << 20
+	// default max nonces cached
+	defaultNonceCacheSize = 100000
+	// default headers must be signed
+	defaultRequiredHeaders = []string{requestTarget, "date"}
+)
+
+func init() {
+	plugin.Register("hmac", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of HMACAuth
+type Config struct {
+	// Secrets inline by keyId, looked up before consumers
+	Secrets map[string]string `json:"secrets"`
+	// Algorithms allowed, default is "hmac-sha256" and "hmac-sha512"
+	Algorithms []string `json:"algorithms"`
+	// RequiredHeaders must be signed, default is "(request-target)" and
+	// "date". "date" is always required since it's checked in clock skew,
+	// and "digest" is always required if request has body
+	RequiredHeaders []string `json:"required_headers"`
+	// ClockSkew seconds allowed between Date header and now, default is 300
+	ClockSkew int `json:"clock_skew"`
+	// MaxBodyBytes max bytes of body to buffer for digest, default is 1MB
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// NonceHeader header of nonce must be signed, empty means signature is
+	// used as nonce
+	NonceHeader string `json:"nonce_header"`
+	// NonceCacheSize max nonces cached, default is 100000. Nonces are kept
+	// for twice of ClockSkew, requests are rejected with 503 if full, so it
+	// should be greater than 2 * ClockSkew * peak requests per second.
+	NonceCacheSize int `json:"nonce_cache_size"`
+}
+
+// New a HMACAuth with cfgData of Config
+func New(cfgData []byte) (*HMACAuth, error) {
+	a := &HMACAuth{
+		store:   consumer.DefaultStore,
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := a.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// HMACAuth plugin to verify HMAC signature of request
+type HMACAuth struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	nonces  *nonceCache
+	store   *consumer.Store
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (a *HMACAuth) Init(cfgData []byte) error {
+	return a.apply(cfgData)
+}
+
+// Reload config with cfgData, nonces cached are kept
+func (a *HMACAuth) Reload(cfgData []byte) error {
+	a.setStatus(plugin.Reloading)
+	err := a.apply(cfgData)
+	a.Enable(a.Enabled())
+	return err
+}
+
+// Close ...
+func (a *HMACAuth) Close() error {
+	a.setStatus(plugin.Stopped)
+	return nil
+}
+
+// Derive a new HMACAuth with config fields overridden by cfgData. Config is
+// decoded again from JSON of the parent, so secrets and headers of the parent
+// are never shared or modified.
+func (a *HMACAuth) Derive(cfgData []byte) (plugin.Plugin, error) {
+	a.mutex.RLock()
+	parent, err := json.Marshal(a.cfg)
+	store := a.store
+	a.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(parent, cfg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(cfg)
+	d, err := New(byts)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+	return d, nil
+}
+
+// Handle verify signature, reject with 401 if invalid, reasons are only
+// logged in debug level.
+func (a *HMACAuth) Handle(ctx *plugin.Context) {
+	a.mutex.RLock()
+	cfg, nonces, store := a.cfg, a.nonces, a.store
+	a.mutex.RUnlock()
+
+	c, err := verify(ctx.Request(), cfg, nonces, store, time.Now())
+	if err != nil {
+		logger.Logger.Debugf("hmac verify request %s %s failed: %v",
+			ctx.GetString(plugin.KeyRequestID), ctx.Path, err)
+		switch err {
+		case errBodyTooLarge:
+			ctx.String(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		case errNonceCacheFull:
+			logger.Logger.Errorf("hmac nonce cache full, nonce_cache_size %d is too small for the rate",
+				cfg.NonceCacheSize)
+			ctx.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		ctx.ResponseWriter().Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Signature headers="%s"`, strings.Join(cfg.RequiredHeaders, " ")))
+		ctx.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	if c != nil {
+		ctx.SetValue(plugin.KeyConsumer, c.Idx)
+		ctx.SetValue(plugin.KeyPlan, c.Plan)
+	}
+	ctx.Next()
+}
+
+// verify signature of req, consumer returned if secret is of consumer
+func verify(req *http.Request, cfg *Config, nonces *nonceCache, store *consumer.Store,
+	now time.Time) (*consumer.Consumer, error) {
+	sig, err := parseSignature(req)
+	if err != nil {
+		return nil, err
+	}
+	newHash, ok := algorithms[sig.algorithm]
+	if !ok || !contains(cfg.Algorithms, sig.algorithm) {
+		return nil, errAlgorithm
+	}
+	for _, h := range cfg.RequiredHeaders {
+		if !sig.signs(h) {
+			return nil, fmt.Errorf("header %s must be signed", h)
+		}
+	}
+
+	// date in clock skew
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return nil, errDate
+	}
+	skew := time.Duration(cfg.ClockSkew) * time.Second
+	if d := now.Sub(date); d > skew || d < -skew {
+		return nil, fmt.Errorf("%v: %v", errClockSkew, d)
+	}
+
+	// digest of body, body is restored to be proxied
+	body, err := readBody(req, cfg.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 0 || req.Header.Get("Digest") != "" {
+		if !sig.signs("digest") {
+			return nil, fmt.Errorf("header digest must be signed with body")
+		}
+		if err := verifyDigest(req.Header.Get("Digest"), body); err != nil {
+			return nil, err
+		}
+	}
+
+	// secret of keyId
+	var (
+		c      *consumer.Consumer
+		secret []byte
+	)
+	if s, ok := cfg.Secrets[sig.keyID]; ok {
+		secret = []byte(s)
+	} else if c, secret, err = store.Secret(sig.keyID); err != nil {
+		return nil, fmt.Errorf("keyId %s: %v", sig.keyID, err)
+	}
+
+	signing, err := signingString(req, sig.headers)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(signing))
+	if !hmac.Equal(mac.Sum(nil), sig.signature) {
+		return nil, fmt.Errorf("%v of keyId %s, signing string: %q", errMismatch, sig.keyID, signing)
+	}
+
+	// replays, checked after verified so forged requests never fill cache
+	nonce := string(sig.signature)
+	if cfg.NonceHeader != "" {
+		if nonce = req.Header.Get(cfg.NonceHeader); nonce == "" || !sig.signs(strings.ToLower(cfg.NonceHeader)) {
+			return nil, errNonce
+		}
+	}
+	if err := nonces.add(sig.keyID+"\n"+nonce, now); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readBody read body of req at most max bytes, and restore it so it could
+// be read again by upstream
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, errBodyTooLarge
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled ...
+func (a *HMACAuth) Enabled() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.enabled
+}
+
+// Status ...
+func (a *HMACAuth) Status() plugin.PlgStatus {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.status
+}
+
+// Name ...
+func (a *HMACAuth) Name() string {
+	return "plugin.hmac"
+}
+
+// Enable ...
+func (a *HMACAuth) Enable(enabled bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.enabled = enabled
+	if !enabled {
+		a.status = plugin.Stopped
+	} else {
+		a.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (a *HMACAuth) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority ...
+func (a *HMACAuth) Priority() int {
+	return 0
+}
+
+func (a *HMACAuth) setStatus(status plugin.PlgStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.status = status
+}
+
+// apply Config in cfgData, defaults are used if cfgData is empty
+func (a *HMACAuth) apply(cfgData []byte) error {
+	if len(cfgData) == 0 && a.cfg != nil {
+		return nil
+	}
+
+	cfg := new(Config)
+	if len(cfgData) != 0 {
+		if err := json.Unmarshal(cfgData, cfg); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = []string{"hmac-sha256", "hmac-sha512"}
+	}
+	for _, alg := range cfg.Algorithms {
+		if _, ok := algorithms[alg]; !ok {
+			return fmt.Errorf("hmac: unsupported algorithm: %s", alg)
+		}
+	}
+	required := make([]string, 0, len(cfg.RequiredHeaders))
+	for _, h := range cfg.RequiredHeaders {
+		required = append(required, strings.ToLower(h))
+	}
+	if len(required) == 0 {
+		required = append(required, defaultRequiredHeaders...)
+	}
+	// date is checked in clock skew, so it must be signed to be trusted
+	if !contains(required, "date") {
+		required = append(required, "date")
+	}
+	cfg.RequiredHeaders = required
+	if cfg.ClockSkew <= 0 {
+		cfg.ClockSkew = defaultClockSkew
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if cfg.NonceCacheSize <= 0 {
+		cfg.NonceCacheSize = defaultNonceCacheSize
+	}
+
+	// a request is valid in [date - skew, date + skew], so keep its nonce
+	// for twice of the skew
+	ttl := 2 * time.Duration(cfg.ClockSkew) * time.Second
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.nonces == nil || a.nonces.max != cfg.NonceCacheSize || a.nonces.ttl != ttl {
+		a.nonces = newNonceCache(cfg.NonceCacheSize, ttl)
+	}
+	a.cfg = cfg
+	return nil
+}
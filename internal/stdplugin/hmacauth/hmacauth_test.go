@@ -0,0 +1,224 @@
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/consumer"
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+// signed request with headers signed by secret of keyID
+func signed(t *testing.T, method, url, body, keyID, secret string, headers []string,
+	date time.Time) *http.Request {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	if body != "" {
+		sum := sha256.Sum256([]byte(body))
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	signing, err := signingString(req, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signing))
+	req.Header.Set("Authorization", `Signature keyId="`+keyID+`",algorithm="hmac-sha256",headers="`+
+		strings.Join(headers, " ")+`",signature="`+base64.StdEncoding.EncodeToString(mac.Sum(nil))+`"`)
+	return req
+}
+
+func Test_HMACAuth(t *testing.T) {
+	store := consumer.NewStore()
+	store.Load([]*consumer.Consumer{
+		{Idx: "partner", Plan: "gold", Secrets: []*consumer.Secret{{ID: "p1", Secret: "partner-secret"}}},
+	})
+	a, err := New([]byte(`{"secrets": {"inline": "inline-secret"}, "max_body_bytes": 16}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.store = store
+
+	serve := func(req *http.Request) (*plugin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		ctx := plugin.NewContext(w, req, []plugin.Plugin{a})
+		ctx.Next()
+		return ctx, w
+	}
+	var (
+		now     = time.Now()
+		headers = []string{"(request-target)", "host", "date", "digest"}
+	)
+
+	// body verified with digest and restored
+	req := signed(t, "POST", "http://example.com/orders?id=1", `{"n": 1}`, "p1", "partner-secret", headers, now)
+	ctx, w := serve(req)
+	if ctx.Aborted() {
+		t.Fatalf("want verified, got %d", w.Code)
+	}
+	if body, _ := ioutil.ReadAll(ctx.Request().Body); string(body) != `{"n": 1}` {
+		t.Errorf("want body restored, got %q", body)
+	}
+	if ctx.GetString(plugin.KeyConsumer) != "partner" || ctx.GetString(plugin.KeyPlan) != "gold" {
+		t.Errorf("want consumer partner, got %q", ctx.GetString(plugin.KeyConsumer))
+	}
+
+	// replayed
+	req = signed(t, "POST", "http://example.com/orders?id=1", `{"n": 1}`, "p1", "partner-secret", headers, now)
+	if _, w = serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("want replay rejected, got %d", w.Code)
+	}
+
+	// inline secret without body
+	req = signed(t, "GET", "http://example.com/orders", "", "inline", "inline-secret", []string{"(request-target)", "date"}, now)
+	if ctx, w = serve(req); ctx.Aborted() {
+		t.Errorf("want verified with inline secret, got %d", w.Code)
+	}
+
+	rejected := map[string]*http.Request{
+		"clock skew":      signed(t, "GET", "http://example.com/a", "", "p1", "partner-secret", headers[:3], now.Add(-10*time.Minute)),
+		"wrong secret":    signed(t, "GET", "http://example.com/b", "", "p1", "wrong", headers[:3], now),
+		"unknown key":     signed(t, "GET", "http://example.com/c", "", "p2", "partner-secret", headers[:3], now),
+		"date unsigned":   signed(t, "GET", "http://example.com/d", "", "p1", "partner-secret", headers[:2], now),
+		"digest unsigned": signed(t, "POST", "http://example.com/e", "body", "p1", "partner-secret", headers[:3], now),
+	}
+	tampered := signed(t, "POST", "http://example.com/f", "body", "p1", "partner-secret", headers, now)
+	tampered.Body = ioutil.NopCloser(strings.NewReader("evil"))
+	rejected["body tampered"] = tampered
+	moved := signed(t, "GET", "http://example.com/g", "", "p1", "partner-secret", headers[:3], now)
+	moved.URL.Path = "/admin"
+	rejected["path changed"] = moved
+	for name, req := range rejected {
+		if _, w := serve(req); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: want 401, got %d", name, w.Code)
+		}
+	}
+
+	req = signed(t, "POST", "http://example.com/orders", strings.Repeat("x", 17), "p1", "partner-secret", headers, now)
+	if _, w = serve(req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want 413, got %d", w.Code)
+	}
+}
+
+func Test_HMACAuth_dateRequired(t *testing.T) {
+	a, err := New([]byte(`{"secrets": {"k": "s"}, "required_headers": ["(request-target)"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(headers []string) int {
+		req := signed(t, "GET", "http://example.com/orders", "", "k", "s", headers, time.Now())
+		w := httptest.NewRecorder()
+		plugin.NewContext(w, req, []plugin.Plugin{a}).Next()
+		return w.Code
+	}
+
+	// date unsigned could be replaced to pass the clock skew check
+	if code := serve([]string{"(request-target)"}); code != http.StatusUnauthorized {
+		t.Errorf("want date unsigned rejected, got %d", code)
+	}
+	if code := serve([]string{"(request-target)", "date"}); code != http.StatusOK {
+		t.Errorf("want verified, got %d", code)
+	}
+}
+
+func Test_HMACAuth_Derive(t *testing.T) {
+	a, err := New([]byte(`{"secrets": {"k": "s"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := a.Derive([]byte(`{"secrets": {"route": "r"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(p plugin.Plugin, keyID, secret string) int {
+		req := signed(t, "GET", "http://example.com/orders", "", keyID, secret,
+			[]string{"(request-target)", "date"}, time.Now())
+		w := httptest.NewRecorder()
+		plugin.NewContext(w, req, []plugin.Plugin{p}).Next()
+		return w.Code
+	}
+
+	if code := serve(d, "route", "r"); code != http.StatusOK {
+		t.Errorf("want verified by derived, got %d", code)
+	}
+	// the parent is never modified by the override
+	if code := serve(a, "route", "r"); code != http.StatusUnauthorized {
+		t.Errorf("want route-only secret rejected by parent, got %d", code)
+	}
+}
+
+func Test_HMACAuth_nonce(t *testing.T) {
+	a, err := New([]byte(`{"secrets": {"k": "s"}, "nonce_header": "X-Nonce", "nonce_cache_size": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(nonce string, headers []string) int {
+		req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		signing, _ := signingString(req, headers)
+		mac := hmac.New(sha256.New, []byte("s"))
+		mac.Write([]byte(signing))
+		req.Header.Set("Signature", `keyId="k",headers="`+strings.Join(headers, " ")+
+			`",signature="`+base64.StdEncoding.EncodeToString(mac.Sum(nil))+`"`)
+		w := httptest.NewRecorder()
+		plugin.NewContext(w, req, []plugin.Plugin{a}).Next()
+		return w.Code
+	}
+
+	headers := []string{"(request-target)", "date", "x-nonce"}
+	if code := serve("n1", headers); code != http.StatusOK {
+		t.Errorf("want verified, got %d", code)
+	}
+	if code := serve("n1", headers); code != http.StatusUnauthorized {
+		t.Errorf("want nonce replayed rejected, got %d", code)
+	}
+	if code := serve("n2", headers[:2]); code != http.StatusUnauthorized {
+		t.Errorf("want unsigned nonce rejected, got %d", code)
+	}
+	// replays are never accepted even if the cache is full
+	if code := serve("n2", headers); code != http.StatusOK {
+		t.Errorf("want verified, got %d", code)
+	}
+	if code := serve("n3", headers); code != http.StatusServiceUnavailable {
+		t.Errorf("want rejected while nonce cache full, got %d", code)
+	}
+	if code := serve("n1", headers); code != http.StatusUnauthorized {
+		t.Errorf("want nonce replayed rejected while full, got %d", code)
+	}
+}
+
+func Test_nonceCache(t *testing.T) {
+	var (
+		c   = newNonceCache(2, time.Minute)
+		now = time.Now()
+	)
+	if c.add("a", now) != nil || c.add("a", now) != errReplay {
+		t.Error("want a added once")
+	}
+	c.add("b", now)
+	// rejected if full, nonces not expired are never evicted
+	if err := c.add("c", now.Add(time.Second)); err != errNonceCacheFull {
+		t.Errorf("want rejected if full, got %v", err)
+	}
+	if err := c.add("a", now.Add(time.Second)); err != errReplay {
+		t.Errorf("want a replayed while full, got %v", err)
+	}
+	// expired
+	if c.add("c", now.Add(time.Minute)) != nil || len(c.seen) != 1 {
+		t.Errorf("want expired removed, got %d", len(c.seen))
+	}
+}
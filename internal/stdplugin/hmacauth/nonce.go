@@ -0,0 +1,56 @@
+package hmacauth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// nonceCache of requests seen in clock skew window to reject replays,
+// bounded by max entries. Nonces are never evicted before expired, since
+// a replay would be accepted then, so new requests are rejected if full.
+type nonceCache struct {
+	mutex sync.Mutex
+	max   int
+	ttl   time.Duration
+	seen  map[string]*list.Element
+	order *list.List // *nonce in order of expires
+}
+
+type nonce struct {
+	key     string
+	expires time.Time
+}
+
+func newNonceCache(max int, ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		max:   max,
+		ttl:   ttl,
+		seen:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// add key of request, errReplay returned if seen, or errNonceCacheFull if
+// no nonce expired to make room
+func (c *nonceCache) add(key string, now time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for e := c.order.Front(); e != nil && !now.Before(e.Value.(*nonce).expires); e = c.order.Front() {
+		c.remove(e)
+	}
+	if _, ok := c.seen[key]; ok {
+		return errReplay
+	}
+	if c.order.Len() >= c.max {
+		return errNonceCacheFull
+	}
+	c.seen[key] = c.order.PushBack(&nonce{key: key, expires: now.Add(c.ttl)})
+	return nil
+}
+
+func (c *nonceCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.seen, e.Value.(*nonce).key)
+}
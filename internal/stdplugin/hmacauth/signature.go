@@ -0,0 +1,149 @@
+package hmacauth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// pseudo header of method and request URI
+const requestTarget = "(request-target)"
+
+var (
+	errNoSignature   = errors.New("signature missing")
+	errMalformed     = errors.New("malformed signature")
+	errAlgorithm     = errors.New("algorithm not allowed")
+	errMismatch      = errors.New("signature mismatch")
+	errDate          = errors.New("date missing or invalid")
+	errClockSkew     = errors.New("date out of clock skew")
+	errDigest        = errors.New("digest missing or invalid")
+	errDigestUnknown = errors.New("digest algorithm unknown")
+	errReplay        = errors.New("request replayed")
+	errNonce         = errors.New("nonce missing")
+)
+
+// algorithms of signature
+var algorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// algorithms of Digest header
+var digests = map[string]func() hash.Hash{
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// signature params of header like:
+//
+//	Signature keyId="partner",algorithm="hmac-sha256",headers="(request-target) date",signature="..."
+type signature struct {
+	keyID     string
+	algorithm string
+	headers   []string
+	signature []byte
+}
+
+// parseSignature from Authorization header with "Signature " prefix, or
+// Signature header
+func parseSignature(req *http.Request) (*signature, error) {
+	v := req.Header.Get("Signature")
+	if auth := req.Header.Get("Authorization"); v == "" && len(auth) > 10 &&
+		strings.EqualFold(auth[:10], "Signature ") {
+		v = auth[10:]
+	}
+	if v == "" {
+		return nil, errNoSignature
+	}
+
+	sig := &signature{algorithm: "hmac-sha256", headers: []string{"date"}}
+	for _, param := range strings.Split(v, ",") {
+		idx := strings.Index(param, "=")
+		if idx < 0 {
+			return nil, errMalformed
+		}
+		name := strings.TrimSpace(param[:idx])
+		value := strings.Trim(strings.TrimSpace(param[idx+1:]), `"`)
+		switch name {
+		case "keyId":
+			sig.keyID = value
+		case "algorithm":
+			sig.algorithm = strings.ToLower(value)
+		case "headers":
+			sig.headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			b, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, errMalformed
+			}
+			sig.signature = b
+		}
+	}
+	if sig.keyID == "" || len(sig.signature) == 0 {
+		return nil, errMalformed
+	}
+	return sig, nil
+}
+
+// signs header or not
+func (s *signature) signs(header string) bool {
+	for _, h := range s.headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// signingString of headers signed, one line for each
+func signingString(req *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		var v string
+		switch h {
+		case requestTarget:
+			v = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			v = req.Host
+		default:
+			values, ok := req.Header[http.CanonicalHeaderKey(h)]
+			if !ok {
+				return "", fmt.Errorf("header %s signed but missing", h)
+			}
+			v = strings.Join(values, ", ")
+		}
+		lines = append(lines, h+": "+v)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// verifyDigest of Digest header like "SHA-256=base64", multiple digests
+// separated by comma, all known ones must match
+func verifyDigest(header string, body []byte) error {
+	verified := false
+	for _, d := range strings.Split(header, ",") {
+		idx := strings.Index(d, "=")
+		if idx < 0 {
+			return errDigest
+		}
+		newHash, ok := digests[strings.ToUpper(strings.TrimSpace(d[:idx]))]
+		if !ok {
+			continue
+		}
+		h := newHash()
+		h.Write(body)
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != strings.TrimSpace(d[idx+1:]) {
+			return errDigest
+		}
+		verified = true
+	}
+	if !verified {
+		return errDigestUnknown
+	}
+	return nil
+}
@@ -3,17 +3,39 @@ package httplog
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"time"
 
+	proxierlogger "github.com/jademperor/api-proxier/internal/logger"
 	"github.com/jademperor/api-proxier/plugin"
 	"github.com/jademperor/common/pkg/logger"
 )
 
 var (
 	_ plugin.Plugin = &HTTPLogger{}
+	_ plugin.Phaser = &HTTPLogger{}
 )
 
+func init() {
+	plugin.Register("httplog", func(cfgData []byte) (plugin.Plugin, error) {
+		cfg := &Config{LogResponse: true}
+		if len(cfgData) != 0 {
+			if err := json.Unmarshal(cfgData, cfg); err != nil {
+				return nil, err
+			}
+		}
+		h := New(proxierlogger.Logger)
+		h.logResponse = cfg.LogResponse
+		return h, nil
+	})
+}
+
+// Config of HTTPLogger
+type Config struct {
+	LogResponse bool `json:"log_response"` // log response body or not, default is true
+}
+
 // New func: generate a new HTTPLogger
 func New(logger *logger.Entity) *HTTPLogger {
 	return &HTTPLogger{
@@ -34,8 +56,6 @@ type HTTPLogger struct {
 
 // Handle ...
 func (h *HTTPLogger) Handle(ctx *plugin.Context) {
-	defer plugin.Recover("HTTPLogger")
-
 	var (
 		rbw *respBodyWriter
 	)
@@ -54,10 +74,14 @@ func (h *HTTPLogger) Handle(ctx *plugin.Context) {
 	path := ctx.Path
 	end := time.Now()
 	latency := end.Sub(start)
-	clientIP := ctx.Request().RemoteAddr
+	clientIP := ctx.ClientIP
 	fields := make(map[string]interface{})
 
 	fields["requestForm"] = ctx.Form
+	fields["requestID"] = ctx.GetString(plugin.KeyRequestID)
+	if consumer := ctx.GetString(plugin.KeyConsumer); consumer != "" {
+		fields["consumer"] = consumer
+	}
 	if h.logResponse {
 		// set response
 		fields["responseBody"] = rbw.body.String()
@@ -99,6 +123,16 @@ func (h *HTTPLogger) Enable(enabled bool) {
 	}
 }
 
+// Phase ...
+func (h *HTTPLogger) Phase() plugin.Phase {
+	return plugin.PhaseLog
+}
+
+// Priority ...
+func (h *HTTPLogger) Priority() int {
+	return 0
+}
+
 // type respBodyWriter to write log ...
 type respBodyWriter struct {
 	http.ResponseWriter
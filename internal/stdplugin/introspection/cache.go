@@ -0,0 +1,64 @@
+package introspection
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cache of introspection results with TTL, bounded by max entries, the
+// least recently used one would be evicted if full.
+type cache struct {
+	mutex sync.Mutex
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	result  *Result
+	expires time.Time
+}
+
+func newCache(max int) *cache {
+	return &cache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get result of key not expired
+func (c *cache) get(key string, now time.Time) (*Result, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.result, true
+}
+
+func (c *cache) set(key string, result *Result, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.ll.Remove(elem)
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, result: result, expires: expires})
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,438 @@
+// Package introspection to validate opaque bearer token via OAuth 2.0
+// token introspection endpoint (RFC 7662), results are cached with TTL,
+// and scopes required are enforced per route.
+package introspection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &Introspection{}
+	_ plugin.Lifecycle = &Introspection{}
+	_ plugin.Deriver   = &Introspection{}
+	_ plugin.Phaser    = &Introspection{}
+
+	errNoURL = errors.New("introspection: url must be set")
+
+	// default timeout to call endpoint in millisecond
+	defaultTimeout = 500
+	// default seconds to cache active result
+	defaultCacheTTL = 60
+	// default seconds to cache inactive result
+	defaultNegativeTTL = 10
+	// default max results cached
+	defaultCacheSize = 10000
+)
+
+func init() {
+	plugin.Register("introspection", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of Introspection
+type Config struct {
+	// URL of introspection endpoint
+	URL string `json:"url"`
+	// ClientID and ClientSecret to authenticate to endpoint with basic auth
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Timeout to call endpoint in millisecond, default is 500
+	Timeout int `json:"timeout"`
+
+	// CacheTTL seconds to cache active result, never after token expired,
+	// default is 60
+	CacheTTL int `json:"cache_ttl"`
+	// NegativeTTL seconds to cache inactive result, default is 10
+	NegativeTTL int `json:"negative_ttl"`
+	// CacheSize max results cached, default is 10000
+	CacheSize int `json:"cache_size"`
+
+	// Scopes required for all routes
+	Scopes []string `json:"scopes"`
+	// RouteScopes scopes required for route like "api/idx" or "routing/idx"
+	RouteScopes map[string][]string `json:"route_scopes"`
+
+	// ConsumerField field stored with plugin.KeyConsumer, default is "sub",
+	// "client_id" is used if it's empty
+	ConsumerField string `json:"consumer_field"`
+	// ForwardFields fields forwarded to upstream, field name to header
+	ForwardFields map[string]string `json:"forward_fields"`
+	// StripToken remove Authorization header from upstream request
+	StripToken bool `json:"strip_token"`
+}
+
+// Result of introspection
+type Result struct {
+	Active bool
+	Scopes []string
+	// Exp and Nbf unix seconds, 0 means not responded
+	Exp int64
+	Nbf int64
+	// Fields all responded
+	Fields map[string]interface{}
+}
+
+func parseResult(data []byte) (*Result, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	r := &Result{Fields: fields}
+	r.Active, _ = fields["active"].(bool)
+	if scope, ok := fields["scope"].(string); ok {
+		r.Scopes = strings.Fields(scope)
+	}
+	if exp, ok := fields["exp"].(float64); ok {
+		r.Exp = int64(exp)
+	}
+	if nbf, ok := fields["nbf"].(float64); ok {
+		r.Nbf = int64(nbf)
+	}
+	return r, nil
+}
+
+// valid at now, active and in [nbf, exp)
+func (r *Result) valid(now time.Time) bool {
+	return r.Active && (r.Exp == 0 || now.Unix() < r.Exp) && (r.Nbf == 0 || now.Unix() >= r.Nbf)
+}
+
+// missing scopes of required
+func (r *Result) missing(required []string) []string {
+	var missing []string
+	for _, s := range required {
+		granted := false
+		for _, g := range r.Scopes {
+			if g == s {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// New an Introspection with cfgData of Config
+func New(cfgData []byte) (*Introspection, error) {
+	i := &Introspection{
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := i.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Introspection plugin to validate opaque bearer token
+type Introspection struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	client  *http.Client
+	cache   *cache
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (i *Introspection) Init(cfgData []byte) error {
+	return i.apply(cfgData)
+}
+
+// Reload config with cfgData, results cached are dropped
+func (i *Introspection) Reload(cfgData []byte) error {
+	i.setStatus(plugin.Reloading)
+	err := i.apply(cfgData)
+	i.Enable(i.Enabled())
+	return err
+}
+
+// Close idle connections to endpoint
+func (i *Introspection) Close() error {
+	i.mutex.RLock()
+	client := i.client
+	i.mutex.RUnlock()
+	if client != nil {
+		if t, ok := client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// Derive a new Introspection with config fields overridden by cfgData,
+// like scopes required of route. Config is decoded again from JSON of the
+// parent, so scopes and fields of the parent are never shared or modified.
+func (i *Introspection) Derive(cfgData []byte) (plugin.Plugin, error) {
+	i.mutex.RLock()
+	parent, err := json.Marshal(i.cfg)
+	i.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(parent, cfg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(cfg)
+	return New(byts)
+}
+
+// Handle validate token, reject with 401 if inactive, 403 if scopes
+// missing, or 503 if endpoint failed.
+func (i *Introspection) Handle(ctx *plugin.Context) {
+	i.mutex.RLock()
+	cfg, client, cache := i.cfg, i.client, i.cache
+	i.mutex.RUnlock()
+
+	req := ctx.Request()
+	token := bearer(req)
+	if token == "" {
+		challenge(ctx, http.StatusUnauthorized, `Bearer`)
+		return
+	}
+
+	now := time.Now()
+	result, err := i.introspect(cfg, client, cache, token, now)
+	if err != nil {
+		logger.Logger.Errorf("introspection call %s got error: %v", cfg.URL, err)
+		ctx.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return
+	}
+	if !result.valid(now) {
+		challenge(ctx, http.StatusUnauthorized, `Bearer error="invalid_token"`)
+		return
+	}
+	required := cfg.Scopes
+	if route := ctx.Route(); route != nil {
+		required = append(required[:len(required):len(required)],
+			cfg.RouteScopes[string(route.Kind)+"/"+route.RuleID()]...)
+	}
+	if missing := result.missing(required); len(missing) != 0 {
+		challenge(ctx, http.StatusForbidden,
+			fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(required, " ")))
+		return
+	}
+
+	ctx.SetValue(plugin.KeyClaims, result.Fields)
+	consumer, _ := result.Fields[cfg.ConsumerField].(string)
+	if consumer == "" {
+		consumer, _ = result.Fields["client_id"].(string)
+	}
+	if consumer != "" {
+		ctx.SetValue(plugin.KeyConsumer, consumer)
+	}
+
+	if cfg.StripToken {
+		req.Header.Del("Authorization")
+	}
+	for field, header := range cfg.ForwardFields {
+		req.Header.Del(header)
+		if v, ok := result.Fields[field]; ok {
+			req.Header.Set(header, fieldString(v))
+		}
+	}
+	ctx.Next()
+}
+
+// introspect token with cache, errors are not cached
+func (i *Introspection) introspect(cfg *Config, client *http.Client, cache *cache,
+	token string, now time.Time) (*Result, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if result, ok := cache.get(key, now); ok {
+		return result, nil
+	}
+
+	result, err := call(cfg, client, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(cfg.NegativeTTL) * time.Second
+	if result.valid(now) {
+		ttl = time.Duration(cfg.CacheTTL) * time.Second
+	}
+	expires := now.Add(ttl)
+	if result.Exp != 0 && time.Unix(result.Exp, 0).Before(expires) {
+		expires = time.Unix(result.Exp, 0)
+	}
+	cache.set(key, result, expires)
+	return result, nil
+}
+
+// call introspection endpoint
+func call(cfg *Config, client *http.Client, token string) (*Result, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseResult(data)
+}
+
+func bearer(req *http.Request) string {
+	v := req.Header.Get("Authorization")
+	if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		return strings.TrimSpace(v[7:])
+	}
+	return ""
+}
+
+func challenge(ctx *plugin.Context, status int, challenge string) {
+	ctx.ResponseWriter().Header().Set("WWW-Authenticate", challenge)
+	ctx.String(status, http.StatusText(status))
+}
+
+// fieldString format field as header value, arrays joined with comma, JSON
+// for other non-string fields
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			ss = append(ss, fieldString(e))
+		}
+		return strings.Join(ss, ",")
+	}
+	byts, _ := json.Marshal(v)
+	return string(byts)
+}
+
+// Enabled ...
+func (i *Introspection) Enabled() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.enabled
+}
+
+// Status ...
+func (i *Introspection) Status() plugin.PlgStatus {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.status
+}
+
+// Name ...
+func (i *Introspection) Name() string {
+	return "plugin.introspection"
+}
+
+// Enable ...
+func (i *Introspection) Enable(enabled bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.enabled = enabled
+	if !enabled {
+		i.status = plugin.Stopped
+	} else {
+		i.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (i *Introspection) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority ...
+func (i *Introspection) Priority() int {
+	return 0
+}
+
+func (i *Introspection) setStatus(status plugin.PlgStatus) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.status = status
+}
+
+// apply Config in cfgData, empty cfgData would be ignored
+func (i *Introspection) apply(cfgData []byte) error {
+	if len(cfgData) == 0 {
+		if i.cfg == nil {
+			return errNoURL
+		}
+		return nil
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		return errNoURL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultCacheTTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = defaultNegativeTTL
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = defaultCacheSize
+	}
+	if cfg.ConsumerField == "" {
+		cfg.ConsumerField = "sub"
+	}
+
+	i.mutex.Lock()
+	old := i.client
+	i.cfg = cfg
+	i.cache = newCache(cfg.CacheSize)
+	i.client = &http.Client{
+		Timeout:   time.Duration(cfg.Timeout) * time.Millisecond,
+		Transport: &http.Transport{MaxIdleConnsPerHost: 64},
+	}
+	i.mutex.Unlock()
+
+	if old != nil {
+		old.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	return nil
+}
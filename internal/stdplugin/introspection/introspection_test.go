@@ -0,0 +1,193 @@
+package introspection
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+	"github.com/jademperor/common/models"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+// introspectServer stand-in endpoint, token "good" is active with scopes
+// "read write", "reader" with scope "read", "crash" fails and others are
+// inactive. calls are counted to verify the cache.
+func introspectServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if id, secret, _ := req.BasicAuth(); id != "proxier" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.PostFormValue("token") {
+		case "good":
+			w.Write([]byte(`{"active": true, "scope": "read write", "sub": "alice",
+				"client_id": "app", "roles": ["admin", "dev"], "exp": 4102444800}`))
+		case "reader":
+			w.Write([]byte(`{"active": true, "scope": "read", "client_id": "app"}`))
+		case "crash":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"active": false}`))
+		}
+	}))
+}
+
+func serve(i *Introspection, token string, route *plugin.Route) (*plugin.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("X-User", "root")
+	w := httptest.NewRecorder()
+	ctx := plugin.NewContext(w, req, []plugin.Plugin{i})
+	if route != nil {
+		ctx.SetRoute(route)
+	}
+	ctx.Next()
+	return ctx, w
+}
+
+func newIntrospection(t *testing.T, url string, extra string) *Introspection {
+	i, err := New([]byte(`{"url": "` + url + `", "client_id": "proxier", "client_secret": "s3cret",
+		"forward_fields": {"sub": "X-User", "roles": "X-Roles"}, "strip_token": true` + extra + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func Test_Introspection(t *testing.T) {
+	var calls int32
+	srv := introspectServer(t, &calls)
+	defer srv.Close()
+	i := newIntrospection(t, srv.URL, `, "scopes": ["read"]`)
+
+	ctx, w := serve(i, "good", nil)
+	if ctx.Aborted() {
+		t.Fatalf("want active token passed, got %d", w.Code)
+	}
+	req := ctx.Request()
+	if req.Header.Get("X-User") != "alice" || req.Header.Get("X-Roles") != "admin,dev" ||
+		req.Header.Get("Authorization") != "" {
+		t.Errorf("want fields forwarded and token stripped, got %v", req.Header)
+	}
+	if ctx.GetString(plugin.KeyConsumer) != "alice" {
+		t.Errorf("want consumer alice, got %q", ctx.GetString(plugin.KeyConsumer))
+	}
+	if v, _ := ctx.Value(plugin.KeyClaims); v.(map[string]interface{})["client_id"] != "app" {
+		t.Errorf("want result stored, got %v", v)
+	}
+
+	// consumer falls back to client_id, forged header removed
+	ctx, _ = serve(i, "reader", nil)
+	if ctx.GetString(plugin.KeyConsumer) != "app" || ctx.Request().Header.Get("X-User") != "" {
+		t.Errorf("want consumer app and forged header removed, got %q %v",
+			ctx.GetString(plugin.KeyConsumer), ctx.Request().Header)
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+		auth   string
+	}{
+		{"missing", "", http.StatusUnauthorized, `Bearer`},
+		{"inactive", "revoked", http.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"failed", "crash", http.StatusServiceUnavailable, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, w := serve(i, c.token, nil)
+			if w.Code != c.status || w.Header().Get("WWW-Authenticate") != c.auth {
+				t.Errorf("want %d %q, got %d %q", c.status, c.auth, w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func Test_Introspection_cache(t *testing.T) {
+	var calls int32
+	srv := introspectServer(t, &calls)
+	defer srv.Close()
+	i := newIntrospection(t, srv.URL, `, "negative_ttl": 1`)
+
+	for n := 0; n < 3; n++ {
+		serve(i, "good", nil)
+		serve(i, "revoked", nil)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("want positive and negative results cached, got %d calls", got)
+	}
+
+	// failure is never cached
+	serve(i, "crash", nil)
+	serve(i, "crash", nil)
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("want failure not cached, got %d calls", got)
+	}
+
+	// negative result expired
+	now := time.Now().Add(2 * time.Second)
+	if _, err := i.introspect(i.cfg, i.client, i.cache, "revoked", now); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 5 {
+		t.Errorf("want negative result expired, got %d calls", got)
+	}
+
+	// reload drops results cached
+	if err := i.Reload([]byte(`{"url": "` + srv.URL + `", "client_id": "proxier", "client_secret": "s3cret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	serve(i, "good", nil)
+	if got := atomic.LoadInt32(&calls); got != 6 {
+		t.Errorf("want cache dropped after reload, got %d calls", got)
+	}
+}
+
+func Test_Introspection_scopes(t *testing.T) {
+	var calls int32
+	srv := introspectServer(t, &calls)
+	defer srv.Close()
+	i := newIntrospection(t, srv.URL, `, "scopes": ["read"], "route_scopes": {"api/orders-write": ["write"]}`)
+
+	var (
+		read  = &plugin.Route{Kind: plugin.RouteAPI, API: &models.API{Idx: "orders-read"}}
+		write = &plugin.Route{Kind: plugin.RouteAPI, API: &models.API{Idx: "orders-write"}}
+	)
+	if ctx, w := serve(i, "reader", read); ctx.Aborted() {
+		t.Errorf("want scope read granted, got %d", w.Code)
+	}
+	if ctx, _ := serve(i, "good", write); ctx.Aborted() {
+		t.Error("want scopes read and write granted")
+	}
+	_, w := serve(i, "reader", write)
+	if want := `Bearer error="insufficient_scope", scope="read write"`; w.Code != http.StatusForbidden ||
+		w.Header().Get("WWW-Authenticate") != want {
+		t.Errorf("want 403 %q, got %d %q", want, w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	// derived for route with scopes overridden
+	d, err := i.Derive([]byte(`{"scopes": ["admin"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, w := serve(d.(*Introspection), "good", read); w.Code != http.StatusForbidden ||
+		!strings.Contains(w.Header().Get("WWW-Authenticate"), `scope="admin"`) {
+		t.Errorf("want 403 with derived scopes, got %d", w.Code)
+	}
+	// the parent is never modified by the override
+	if ctx, w := serve(i, "reader", read); ctx.Aborted() {
+		t.Errorf("want scopes of parent unchanged, got %d", w.Code)
+	}
+}
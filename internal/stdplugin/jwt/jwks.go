@@ -0,0 +1,253 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+var (
+	// default seconds to refresh JWKS from URL
+	defaultJWKSRefresh = 300
+	// min interval to refresh JWKS from URL while kid not found, to
+	// avoid fetching for every token with unknown kid
+	minJWKSRefresh = 10 * time.Second
+	// timeout to fetch JWKS from URL
+	jwksTimeout = 5 * time.Second
+	// kty of keys supported
+	supportedKty = map[string]bool{"RSA": true, "EC": true, "oct": true}
+)
+
+// key to verify token
+type key struct {
+	kid    string
+	kty    string
+	secret []byte
+	rsa    *rsa.PublicKey
+	ec     *ecdsa.PublicKey
+}
+
+// jwk JSON Web Key, only fields of public keys and secret are used
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// parseJWKS parse keys of JWKS data, keys not for signature or of
+// unsupported kty are ignored, so they could be published with others
+func parseJWKS(data []byte) ([]*key, error) {
+	var jwks struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*key, 0, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if !supportedKty[k.Kty] {
+			logger.Logger.Infof("jwt skip key [%s] of unsupported kty: %s", k.Kid, k.Kty)
+			continue
+		}
+		parsed, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: invalid key [%s]: %v", k.Kid, err)
+		}
+		keys = append(keys, parsed)
+	}
+	return keys, nil
+}
+
+func (k *jwk) parse() (*key, error) {
+	parsed := &key{kid: k.Kid, kty: k.Kty}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		parsed.rsa = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var crv elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			crv = elliptic.P256()
+		case "P-384":
+			crv = elliptic.P384()
+		case "P-521":
+			crv = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown crv: %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !crv.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve %s", k.Crv)
+		}
+		parsed.ec = &ecdsa.PublicKey{Curve: crv, X: x, Y: y}
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		parsed.secret = secret
+	default:
+		return nil, fmt.Errorf("unknown kty: %s", k.Kty)
+	}
+	return parsed, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	byts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(byts), nil
+}
+
+// keySet keys to verify token, keys of JWKS URL are cached and refreshed.
+// Keys are fetched without holding the mutex, and only one fetch runs at a
+// time, so requests with known kid are never blocked by fetching.
+type keySet struct {
+	mutex    sync.Mutex
+	static   []*key // keys of secret and JWKS file
+	remote   []*key // keys fetched from url
+	url      string
+	refresh  time.Duration // interval to refresh keys from url
+	fetched  time.Time     // last time keys fetched, even failed
+	fetching chan struct{} // closed after keys fetched, nil if not fetching
+	client   *http.Client
+}
+
+// newKeySet with static keys, and keys fetched from JWKS url if set,
+// error of fetching would be logged and retried later.
+func newKeySet(static []*key, url string, refresh time.Duration) *keySet {
+	ks := &keySet{
+		static:  static,
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksTimeout},
+	}
+	if url != "" {
+		ks.mutex.Lock()
+		done := ks.fetch(time.Now())
+		ks.mutex.Unlock()
+		<-done
+	}
+	return ks
+}
+
+// find keys to verify token with kid, keys without kid are candidates too.
+// Expired keys are refreshed in background and used meanwhile, while an
+// unknown kid waits for keys fetched again.
+func (ks *keySet) find(kid string, now time.Time) []*key {
+	ks.mutex.Lock()
+	if ks.url != "" {
+		switch {
+		case kid != "" && !ks.has(kid) && now.Sub(ks.fetched) >= minJWKSRefresh:
+			done := ks.fetch(now)
+			ks.mutex.Unlock()
+			<-done
+			ks.mutex.Lock()
+		case now.Sub(ks.fetched) >= ks.refresh:
+			ks.fetch(now)
+		}
+	}
+	defer ks.mutex.Unlock()
+
+	var found []*key
+	for _, keys := range [][]*key{ks.static, ks.remote} {
+		for _, k := range keys {
+			if kid == "" || k.kid == "" || k.kid == kid {
+				found = append(found, k)
+			}
+		}
+	}
+	return found
+}
+
+func (ks *keySet) has(kid string) bool {
+	for _, keys := range [][]*key{ks.static, ks.remote} {
+		for _, k := range keys {
+			if k.kid == kid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetch keys from url in background unless fetching already, called with
+// mutex held. Channel closed after keys fetched returned, keys are kept if
+// failed.
+func (ks *keySet) fetch(now time.Time) <-chan struct{} {
+	if ks.fetching != nil {
+		return ks.fetching
+	}
+	ks.fetched = now
+	fetching := make(chan struct{})
+	ks.fetching = fetching
+
+	go func() {
+		keys, err := ks.get()
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+		if err != nil {
+			logger.Logger.Errorf("jwt fetch JWKS %s got error: %v", ks.url, err)
+		} else {
+			ks.remote = keys
+		}
+		ks.fetching = nil
+		close(fetching)
+	}()
+	return fetching
+}
+
+func (ks *keySet) get() ([]*key, error) {
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
@@ -0,0 +1,350 @@
+// Package jwt to authenticate request with JSON Web Token, signed with
+// HS256/384/512, RS256/384/512 or ES256/384/512.
+//
+// Token is read from Authorization header, cookie or query parameter,
+// verified with secret, keys of a local JWKS file or a JWKS URL, then
+// claims are stored with plugin.KeyClaims and selected claims forwarded
+// to upstream as headers.
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &JWT{}
+	_ plugin.Lifecycle = &JWT{}
+	_ plugin.Deriver   = &JWT{}
+	_ plugin.Phaser    = &JWT{}
+
+	errNoKeys  = errors.New("jwt: secret, jwks_file or jwks_url must be set")
+	errNoToken = errors.New("token missing")
+)
+
+func init() {
+	plugin.Register("jwt", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of JWT
+type Config struct {
+	// Secret of HS algorithms
+	Secret string `json:"secret"`
+	// JWKSFile path of local JWKS file
+	JWKSFile string `json:"jwks_file"`
+	// JWKSURL to fetch JWKS, cached and refreshed
+	JWKSURL string `json:"jwks_url"`
+	// JWKSRefresh seconds to refresh JWKS from URL, default is 300
+	JWKSRefresh int `json:"jwks_refresh"`
+	// Algorithms allowed, default is all supported
+	Algorithms []string `json:"algorithms"`
+
+	// Header to read token with "Bearer " prefix, default is Authorization
+	Header string `json:"header"`
+	// Cookie name to read token, tried after Header
+	Cookie string `json:"cookie"`
+	// Query parameter to read token, tried after Cookie
+	Query string `json:"query"`
+
+	// Issuers allowed of "iss", empty means not checked
+	Issuers []string `json:"issuers"`
+	// Audiences allowed of "aud", any matched is ok, empty means not checked
+	Audiences []string `json:"audiences"`
+	// RequireExp reject token without "exp"
+	RequireExp bool `json:"require_exp"`
+	// Leeway seconds of clock skew for "exp" and "nbf"
+	Leeway int `json:"leeway"`
+
+	// ConsumerClaim claim stored with plugin.KeyConsumer, default is "sub"
+	ConsumerClaim string `json:"consumer_claim"`
+	// ForwardClaims claims forwarded to upstream, claim name to header
+	ForwardClaims map[string]string `json:"forward_claims"`
+	// StripToken remove token of Header from upstream request
+	StripToken bool `json:"strip_token"`
+}
+
+// New a JWT with cfgData of Config
+func New(cfgData []byte) (*JWT, error) {
+	j := &JWT{
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := j.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// JWT plugin to authenticate request with JSON Web Token
+type JWT struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	keys    *keySet
+	algs    map[string]*algorithm // algorithms allowed
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (j *JWT) Init(cfgData []byte) error {
+	return j.apply(cfgData)
+}
+
+// Reload config with cfgData, keys are loaded again
+func (j *JWT) Reload(cfgData []byte) error {
+	j.setStatus(plugin.Reloading)
+	err := j.apply(cfgData)
+	j.Enable(j.Enabled())
+	return err
+}
+
+// Close ...
+func (j *JWT) Close() error {
+	j.setStatus(plugin.Stopped)
+	return nil
+}
+
+// Derive a new JWT with config fields overridden by cfgData, like
+// audiences of route. Config is decoded again from JSON of the parent, so
+// slices and maps of the parent are never shared or modified.
+func (j *JWT) Derive(cfgData []byte) (plugin.Plugin, error) {
+	j.mutex.RLock()
+	parent, err := json.Marshal(j.cfg)
+	j.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(parent, cfg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(cfg)
+	return New(byts)
+}
+
+// Handle verify token, reject with 401 if invalid
+func (j *JWT) Handle(ctx *plugin.Context) {
+	j.mutex.RLock()
+	cfg, keys, algs := j.cfg, j.keys, j.algs
+	j.mutex.RUnlock()
+
+	raw := extract(ctx.Request(), cfg)
+	if raw == "" {
+		unauthorized(ctx, errNoToken)
+		return
+	}
+	claims, err := verify(raw, cfg, keys, algs, time.Now())
+	if err != nil {
+		unauthorized(ctx, err)
+		return
+	}
+
+	ctx.SetValue(plugin.KeyClaims, claims)
+	if consumer, ok := claims[cfg.ConsumerClaim].(string); ok && consumer != "" {
+		ctx.SetValue(plugin.KeyConsumer, consumer)
+	}
+
+	req := ctx.Request()
+	if cfg.StripToken {
+		req.Header.Del(cfg.Header)
+	}
+	for claim, header := range cfg.ForwardClaims {
+		req.Header.Del(header)
+		if v, ok := claims[claim]; ok {
+			req.Header.Set(header, claimString(v))
+		}
+	}
+	ctx.Next()
+}
+
+// extract raw token from header, cookie or query
+func extract(req *http.Request, cfg *Config) string {
+	if v := req.Header.Get(cfg.Header); v != "" {
+		if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	if cfg.Cookie != "" {
+		if c, err := req.Cookie(cfg.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if cfg.Query != "" {
+		return req.URL.Query().Get(cfg.Query)
+	}
+	return ""
+}
+
+// verify raw token and validate claims, claims returned if ok
+func verify(raw string, cfg *Config, keys *keySet, algs map[string]*algorithm,
+	now time.Time) (map[string]interface{}, error) {
+	t, err := parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	alg, ok := algs[t.header.Alg]
+	if !ok {
+		return nil, errAlgorithm
+	}
+
+	err = errNoKey
+	for _, k := range keys.find(t.header.Kid, now) {
+		if err = t.verify(alg, k); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(cfg, now); err != nil {
+		return nil, err
+	}
+	return t.claims, nil
+}
+
+func unauthorized(ctx *plugin.Context, err error) {
+	challenge := `Bearer`
+	if err != errNoToken {
+		challenge = fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error())
+	}
+	ctx.ResponseWriter().Header().Set("WWW-Authenticate", challenge)
+	ctx.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+}
+
+// claimString format claim as header value, JSON for non-string claims
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			ss = append(ss, claimString(e))
+		}
+		return strings.Join(ss, ",")
+	}
+	byts, _ := json.Marshal(v)
+	return string(byts)
+}
+
+// Enabled ...
+func (j *JWT) Enabled() bool {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	return j.enabled
+}
+
+// Status ...
+func (j *JWT) Status() plugin.PlgStatus {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	return j.status
+}
+
+// Name ...
+func (j *JWT) Name() string {
+	return "plugin.jwt"
+}
+
+// Enable ...
+func (j *JWT) Enable(enabled bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.enabled = enabled
+	if !enabled {
+		j.status = plugin.Stopped
+	} else {
+		j.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (j *JWT) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority ...
+func (j *JWT) Priority() int {
+	return 0
+}
+
+func (j *JWT) setStatus(status plugin.PlgStatus) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status = status
+}
+
+// apply Config in cfgData, empty cfgData would be ignored
+func (j *JWT) apply(cfgData []byte) error {
+	if len(cfgData) == 0 {
+		if j.cfg == nil {
+			return errNoKeys
+		}
+		return nil
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return err
+	}
+	if cfg.Secret == "" && cfg.JWKSFile == "" && cfg.JWKSURL == "" {
+		return errNoKeys
+	}
+	if cfg.Header == "" {
+		cfg.Header = "Authorization"
+	}
+	if cfg.ConsumerClaim == "" {
+		cfg.ConsumerClaim = "sub"
+	}
+	if cfg.JWKSRefresh <= 0 {
+		cfg.JWKSRefresh = defaultJWKSRefresh
+	}
+
+	algs := algorithms
+	if len(cfg.Algorithms) != 0 {
+		algs = make(map[string]*algorithm, len(cfg.Algorithms))
+		for _, name := range cfg.Algorithms {
+			alg, ok := algorithms[name]
+			if !ok {
+				return fmt.Errorf("jwt: unsupported algorithm: %s", name)
+			}
+			algs[name] = alg
+		}
+	}
+
+	var static []*key
+	if cfg.Secret != "" {
+		static = append(static, &key{kty: "oct", secret: []byte(cfg.Secret)})
+	}
+	if cfg.JWKSFile != "" {
+		data, err := ioutil.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return err
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return err
+		}
+		static = append(static, keys...)
+	}
+	keys := newKeySet(static, cfg.JWKSURL, time.Duration(cfg.JWKSRefresh)*time.Second)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.cfg, j.keys, j.algs = cfg, keys, algs
+	return nil
+}
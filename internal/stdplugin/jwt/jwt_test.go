@@ -0,0 +1,322 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+var b64 = base64.RawURLEncoding
+
+// sign claims with alg and key of []byte, *rsa.PrivateKey or
+// *ecdsa.PrivateKey
+func sign(t *testing.T, alg, kid string, k interface{}, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signing := b64.EncodeToString(hdr) + "." + b64.EncodeToString(payload)
+
+	var sig []byte
+	switch k := k.(type) {
+	case []byte:
+		mac := hmac.New(algorithms[alg].hash.New, k)
+		mac.Write([]byte(signing))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := algorithms[alg].hash.New()
+		h.Write([]byte(signing))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, algorithms[alg].hash, h.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		h := algorithms[alg].hash.New()
+		h.Write([]byte(signing))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signing + "." + b64.EncodeToString(sig)
+}
+
+func rsaJWK(kid string, k *rsa.PublicKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "RSA", "use": "sig",
+		"n": b64.EncodeToString(k.N.Bytes()),
+		"e": b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "EC", "crv": "P-256",
+		"x": b64.EncodeToString(k.X.Bytes()), "y": b64.EncodeToString(k.Y.Bytes())}
+}
+
+func jwks(keys ...map[string]string) []byte {
+	byts, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return byts
+}
+
+func serve(j *JWT, req *http.Request) (*plugin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	ctx := plugin.NewContext(w, req, []plugin.Plugin{j})
+	ctx.Next()
+	return ctx, w
+}
+
+func bearer(token string) *http.Request {
+	req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func Test_JWT_secret(t *testing.T) {
+	j, err := New([]byte(`{"secret": "s3cret", "issuers": ["auth"], "audiences": ["orders"],
+		"forward_claims": {"sub": "X-User", "roles": "X-Roles"}, "strip_token": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		secret = []byte("s3cret")
+		now    = time.Now().Unix()
+		claims = map[string]interface{}{"sub": "alice", "iss": "auth",
+			"aud": []string{"orders", "users"}, "exp": now + 60, "roles": []string{"admin", "dev"}}
+	)
+
+	ctx, w := serve(j, bearer(sign(t, "HS256", "", secret, claims)))
+	if ctx.Aborted() {
+		t.Fatalf("want verified, got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	req := ctx.Request()
+	if req.Header.Get("X-User") != "alice" || req.Header.Get("X-Roles") != "admin,dev" ||
+		req.Header.Get("Authorization") != "" {
+		t.Errorf("want claims forwarded and token stripped, got %v", req.Header)
+	}
+	if ctx.GetString(plugin.KeyConsumer) != "alice" {
+		t.Errorf("want consumer alice, got %q", ctx.GetString(plugin.KeyConsumer))
+	}
+	if v, _ := ctx.Value(plugin.KeyClaims); v.(map[string]interface{})["iss"] != "auth" {
+		t.Errorf("want claims stored, got %v", v)
+	}
+
+	// forged header is removed
+	req = bearer(sign(t, "HS256", "", secret, map[string]interface{}{"iss": "auth", "aud": "orders"}))
+	req.Header.Set("X-User", "root")
+	if ctx, _ = serve(j, req); ctx.Request().Header.Get("X-User") != "" {
+		t.Error("want forged header removed")
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"expired", sign(t, "HS256", "", secret, map[string]interface{}{"iss": "auth", "aud": "orders", "exp": now - 1}), errExpired},
+		{"not valid yet", sign(t, "HS256", "", secret, map[string]interface{}{"iss": "auth", "aud": "orders", "nbf": now + 60}), errNotValidYet},
+		{"issuer", sign(t, "HS256", "", secret, map[string]interface{}{"iss": "evil", "aud": "orders"}), errIssuer},
+		{"audience", sign(t, "HS256", "", secret, map[string]interface{}{"iss": "auth", "aud": "users"}), errAudience},
+		{"signature", sign(t, "HS256", "", []byte("wrong"), claims), errSignature},
+		{"none", strings.Replace(sign(t, "HS256", "", secret, claims), b64.EncodeToString([]byte(`{"alg":"HS256","kid":"","typ":"JWT"}`)),
+			b64.EncodeToString([]byte(`{"alg":"none"}`)), 1), errAlgorithm},
+		{"malformed", "abc", errMalformed},
+	}
+	for _, c := range cases {
+		_, w := serve(j, bearer(c.token))
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), c.err.Error()) {
+			t.Errorf("%s: want 401 with %v, got %d %s", c.name, c.err, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	_, w = serve(j, httptest.NewRequest("GET", "http://example.com/orders", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("want 401 without error, got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func Test_JWT_Derive(t *testing.T) {
+	j, err := New([]byte(`{"secret": "s3cret", "audiences": ["orders"], "forward_claims": {"sub": "X-User"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := j.Derive([]byte(`{"audiences": ["evil"], "forward_claims": {"role": "X-Role"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sign(t, "HS256", "", []byte("s3cret"), map[string]interface{}{"aud": "evil", "role": "admin"})
+
+	if ctx, w := serve(d.(*JWT), bearer(token)); ctx.Aborted() {
+		t.Errorf("want verified by derived, got %d", w.Code)
+	}
+	// the parent is never modified by the override
+	if _, w := serve(j, bearer(token)); w.Code != http.StatusUnauthorized {
+		t.Errorf("want route-only audience rejected by parent, got %d", w.Code)
+	}
+	if len(j.cfg.ForwardClaims) != 1 {
+		t.Errorf("want forward claims of parent unchanged, got %v", j.cfg.ForwardClaims)
+	}
+}
+
+func Test_JWT_jwksURL(t *testing.T) {
+	old := minJWKSRefresh
+	minJWKSRefresh = 0
+	defer func() { minJWKSRefresh = old }()
+
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var (
+		fetched int32
+		keys    atomic.Value
+	)
+	keys.Store(jwks(rsaJWK("k1", &key1.PublicKey)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.Write(keys.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	j, err := New([]byte(`{"jwks_url": "` + srv.URL + `", "query": "access_token"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"sub": "bob"}
+	for i := 0; i < 3; i++ {
+		if ctx, w := serve(j, bearer(sign(t, "RS256", "k1", key1, claims))); ctx.Aborted() {
+			t.Fatalf("want verified, got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("want JWKS cached, got %d fetched", n)
+	}
+
+	// key rotated, fetched again for unknown kid
+	keys.Store(jwks(rsaJWK("k1", &key1.PublicKey), rsaJWK("k2", &key2.PublicKey)))
+	req := httptest.NewRequest("GET", "http://example.com/orders?access_token="+sign(t, "RS512", "k2", key2, claims), nil)
+	if ctx, w := serve(j, req); ctx.Aborted() {
+		t.Fatalf("want verified with rotated key, got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	// public key must not be used as HMAC secret
+	forged := sign(t, "HS256", "k1", key1.PublicKey.N.Bytes(), claims)
+	if _, w := serve(j, bearer(forged)); w.Code != http.StatusUnauthorized {
+		t.Errorf("want forged HS256 token rejected, got %d", w.Code)
+	}
+}
+
+func Test_parseJWKS(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	okp := map[string]string{"kid": "o1", "kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	enc := map[string]string{"kid": "k0", "kty": "RSA", "use": "enc"}
+	keys, err := parseJWKS(jwks(okp, enc, rsaJWK("k1", &key1.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].kid != "k1" {
+		t.Errorf("want only key k1 parsed, got %d", len(keys))
+	}
+
+	if _, err := parseJWKS(jwks(map[string]string{"kid": "k2", "kty": "RSA", "n": "!"})); err == nil {
+		t.Error("want error of invalid key with supported kty")
+	}
+}
+
+func Test_keySet_fetch(t *testing.T) {
+	old := minJWKSRefresh
+	minJWKSRefresh = 0
+	defer func() { minJWKSRefresh = old }()
+
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var (
+		fetched int32
+		blocked = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&fetched, 1) > 1 {
+			<-blocked
+		}
+		w.Write(jwks(rsaJWK("k1", &key1.PublicKey)))
+	}))
+	defer srv.Close()
+
+	ks := newKeySet(nil, srv.URL, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	// expired keys are refreshed in background, and used meanwhile
+	if keys := ks.find("k1", time.Now()); len(keys) != 1 {
+		t.Fatalf("want stale key while refreshing, got %d", len(keys))
+	}
+
+	// unknown kid waits for the fetching in flight, without blocking others
+	done := make(chan []*key)
+	go func() { done <- ks.find("k2", time.Now()) }()
+	start := time.Now()
+	if keys := ks.find("k1", time.Now()); len(keys) != 1 || time.Since(start) > time.Second {
+		t.Errorf("want known kid found without waiting, got %d in %v", len(keys), time.Since(start))
+	}
+	select {
+	case <-done:
+		t.Fatal("want unknown kid waiting for fetching")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocked)
+	if keys := <-done; len(keys) != 0 {
+		t.Errorf("want no key for unknown kid, got %d", len(keys))
+	}
+	if n := atomic.LoadInt32(&fetched); n != 2 {
+		t.Errorf("want fetching shared, got %d fetched", n)
+	}
+}
+
+func Test_JWT_jwksFile(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, jwks(ecJWK("e1", &key.PublicKey)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := New([]byte(`{"jwks_file": "` + file + `", "cookie": "session", "algorithms": ["ES256"], "require_exp": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+	req.AddCookie(&http.Cookie{Name: "session",
+		Value: sign(t, "ES256", "e1", key, map[string]interface{}{"sub": "carol", "exp": time.Now().Unix() + 60})})
+	if ctx, w := serve(j, req); ctx.Aborted() {
+		t.Fatalf("want verified, got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	if _, w := serve(j, bearer(sign(t, "ES256", "e1", key, map[string]interface{}{"sub": "carol"}))); w.Code != http.StatusUnauthorized {
+		t.Errorf("want token without exp rejected, got %d", w.Code)
+	}
+
+	if _, err := New([]byte(`{"jwks_file": "` + file + `", "algorithms": ["PS256"]}`)); err == nil {
+		t.Error("want error of unsupported algorithm")
+	}
+}
@@ -0,0 +1,216 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash functions of algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformed     = errors.New("malformed token")
+	errAlgorithm     = errors.New("algorithm not allowed")
+	errSignature     = errors.New("invalid signature")
+	errNoKey         = errors.New("no key to verify")
+	errExpired       = errors.New("token expired")
+	errNotValidYet   = errors.New("token not valid yet")
+	errNoExpiration  = errors.New("exp required")
+	errIssuer        = errors.New("invalid issuer")
+	errAudience      = errors.New("invalid audience")
+	errInvalidClaims = errors.New("invalid claims")
+)
+
+// algorithm to sign token
+type algorithm struct {
+	hash crypto.Hash
+	kty  string         // key type, "oct", "RSA" or "EC"
+	crv  elliptic.Curve // curve of "EC"
+}
+
+// algorithms supported
+var algorithms = map[string]*algorithm{
+	"HS256": {hash: crypto.SHA256, kty: "oct"},
+	"HS384": {hash: crypto.SHA384, kty: "oct"},
+	"HS512": {hash: crypto.SHA512, kty: "oct"},
+	"RS256": {hash: crypto.SHA256, kty: "RSA"},
+	"RS384": {hash: crypto.SHA384, kty: "RSA"},
+	"RS512": {hash: crypto.SHA512, kty: "RSA"},
+	"ES256": {hash: crypto.SHA256, kty: "EC", crv: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, kty: "EC", crv: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, kty: "EC", crv: elliptic.P521()},
+}
+
+// header of token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// token parsed but not verified
+type token struct {
+	header    header
+	claims    map[string]interface{}
+	signing   string // signing input, header and payload
+	signature []byte
+}
+
+func parse(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+
+	t := &token{signing: parts[0] + "." + parts[1]}
+	if err := decodeSegment(parts[0], &t.header); err != nil {
+		return nil, errMalformed
+	}
+	if err := decodeSegment(parts[1], &t.claims); err != nil {
+		return nil, errMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+	t.signature = sig
+	return t, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	byts, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, v)
+}
+
+// verify signature of token with key, the key type must match the
+// algorithm, so that a public key would never be used as HMAC secret.
+func (t *token) verify(alg *algorithm, k *key) error {
+	if k.kty != alg.kty {
+		return errNoKey
+	}
+
+	if alg.kty == "oct" {
+		mac := hmac.New(alg.hash.New, k.secret)
+		mac.Write([]byte(t.signing))
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return errSignature
+		}
+		return nil
+	}
+
+	h := alg.hash.New()
+	h.Write([]byte(t.signing))
+	digest := h.Sum(nil)
+
+	switch alg.kty {
+	case "RSA":
+		if err := rsa.VerifyPKCS1v15(k.rsa, alg.hash, digest, t.signature); err != nil {
+			return errSignature
+		}
+	case "EC":
+		if k.ec.Curve != alg.crv {
+			return errNoKey
+		}
+		size := (alg.crv.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k.ec, digest, r, s) {
+			return errSignature
+		}
+	}
+	return nil
+}
+
+// validate registered claims of token
+func (t *token) validate(cfg *Config, now time.Time) error {
+	leeway := time.Duration(cfg.Leeway) * time.Second
+
+	exp, ok, err := t.numericDate("exp")
+	switch {
+	case err != nil:
+		return err
+	case !ok && cfg.RequireExp:
+		return errNoExpiration
+	case ok && !now.Before(exp.Add(leeway)):
+		return errExpired
+	}
+	nbf, ok, err := t.numericDate("nbf")
+	switch {
+	case err != nil:
+		return err
+	case ok && now.Add(leeway).Before(nbf):
+		return errNotValidYet
+	}
+
+	if len(cfg.Issuers) != 0 {
+		iss, _ := t.claims["iss"].(string)
+		if !contains(cfg.Issuers, iss) {
+			return errIssuer
+		}
+	}
+	if len(cfg.Audiences) != 0 {
+		matched := false
+		for _, aud := range t.audiences() {
+			if contains(cfg.Audiences, aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errAudience
+		}
+	}
+	return nil
+}
+
+func (t *token) numericDate(name string) (time.Time, bool, error) {
+	v, ok := t.claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, errInvalidClaims
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true, nil
+}
+
+// audiences of "aud" claim, which is a string or array of strings
+func (t *token) audiences() []string {
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		auds := make([]string, 0, len(aud))
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
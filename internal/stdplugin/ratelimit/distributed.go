@@ -0,0 +1,253 @@
+package ratelimit
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+var (
+	// default tokens to pre-allocate from backend per round trip
+	defaultBatch = 10
+	// default prefix of backend keys
+	defaultPrefix = "ratelimit"
+	// backoff to retry backend after failure, calls fail fast meanwhile
+	defaultBackoff = time.Second
+
+	errBackendDown = errors.New("ratelimit: backend unreachable, retry later")
+)
+
+// Backend to count requests of distributed limits shared by gateway
+// instances.
+type Backend interface {
+	// Incr count of key by n, key would be expired after window, count
+	// after increased returned
+	Incr(key string, n int, window time.Duration) (int64, error)
+	// Close the Backend
+	Close() error
+}
+
+// BackendConfig of distributed limits
+type BackendConfig struct {
+	// Addr of redis, like "127.0.0.1:6379" or "unix:/var/run/redis.sock"
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Timeout milliseconds of dial, read and write, default is 100
+	Timeout int `json:"timeout"`
+	// PoolSize idle connections to keep, default is 16
+	PoolSize int `json:"pool_size"`
+	// Batch tokens to pre-allocate locally per round trip, default is 10
+	Batch int `json:"batch"`
+	// FailOpen allow requests if backend is unreachable, or reject them
+	// with 503
+	FailOpen bool `json:"fail_open"`
+	// Prefix of backend keys, default is "ratelimit", keys are also
+	// namespaced with hash of limit config, and the route matched if the
+	// plugin is overridden for routes. Gateways sharing a backend but not
+	// limits should use different prefixes.
+	Prefix string `json:"prefix"`
+}
+
+// distributed counts of keyed limiter with backend
+type distributed struct {
+	backend  Backend
+	batch    int
+	failOpen bool
+	healthy  int32 // 1 if backend healthy, accessed atomically
+	backoff  time.Duration
+	retryAt  int64 // unix nano to retry backend after failure, accessed atomically
+}
+
+func newDistributed(cfg *BackendConfig, backend Backend) *distributed {
+	batch := cfg.Batch
+	if batch <= 0 {
+		batch = defaultBatch
+	}
+	return &distributed{
+		backend:  backend,
+		batch:    batch,
+		failOpen: cfg.FailOpen,
+		healthy:  1,
+		backoff:  defaultBackoff,
+	}
+}
+
+// incr count of key in backend, and log while backend health changed.
+// After a failure, calls fail fast with errBackendDown until backoff
+// elapsed, then only one call probes the backend.
+func (d *distributed) incr(key string, n int, window time.Duration) (int64, error) {
+	if retryAt := atomic.LoadInt64(&d.retryAt); retryAt != 0 {
+		now := time.Now().UnixNano()
+		if now < retryAt || !atomic.CompareAndSwapInt64(&d.retryAt, retryAt, now+int64(d.backoff)) {
+			return 0, errBackendDown
+		}
+	}
+
+	count, err := d.backend.Incr(key, n, window)
+	if err != nil {
+		atomic.StoreInt64(&d.retryAt, time.Now().Add(d.backoff).UnixNano())
+		if atomic.CompareAndSwapInt32(&d.healthy, 1, 0) {
+			logger.Logger.Errorf("ratelimit backend unreachable, fail open: %v, error: %v",
+				d.failOpen, err)
+		}
+		return 0, err
+	}
+	atomic.StoreInt64(&d.retryAt, 0)
+	if atomic.CompareAndSwapInt32(&d.healthy, 0, 1) {
+		logger.Logger.Info("ratelimit backend recovered")
+	}
+	return count, nil
+}
+
+// distributedLimiter limit requests in fixed window or calendar period
+// counted by backend,
+// tokens are pre-allocated from backend in batch to avoid a round trip
+// per request, so tokens held by an instance might be unused in window.
+type distributedLimiter struct {
+	mutex    sync.Mutex
+	d        *distributed
+	key      string
+	requests int
+	window   time.Duration // fixed window, or
+	period   string        // calendar period of quota in UTC, if set
+
+	start     time.Time     // start of the current window
+	end       time.Time     // end of the current window
+	local     int           // tokens pre-allocated locally
+	remaining int           // requests remaining in backend
+	exhausted bool          // no tokens remaining in the window
+	fetching  chan struct{} // closed after tokens fetched, nil if not fetching
+}
+
+func newDistributedLimiter(d *distributed, key string, requests int,
+	window time.Duration) *distributedLimiter {
+	return &distributedLimiter{
+		d:        d,
+		key:      key,
+		requests: requests,
+		window:   window,
+	}
+}
+
+// newDistributedQuota limit requests in calendar day or month with backend,
+// so the quota is kept while gateway restarted
+func newDistributedQuota(d *distributed, key string, requests int,
+	period string) *distributedLimiter {
+	return &distributedLimiter{
+		d:        d,
+		key:      key,
+		requests: requests,
+		period:   period,
+	}
+}
+
+// bounds of window including now
+func (l *distributedLimiter) bounds(now time.Time) (time.Time, time.Time) {
+	if l.period != "" {
+		return periodStart(l.period, now), periodEnd(l.period, now)
+	}
+	start := now.Truncate(l.window)
+	return start, start.Add(l.window)
+}
+
+// take a token, tokens are fetched from backend without holding the mutex,
+// and concurrent takers wait for the fetching one.
+func (l *distributedLimiter) take(now time.Time) result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		if start, end := l.bounds(now); !start.Equal(l.start) {
+			l.start, l.end = start, end
+			l.local, l.remaining, l.exhausted = 0, l.requests, false
+		}
+		if l.local != 0 || l.exhausted {
+			break
+		}
+		if fetching := l.fetching; fetching != nil {
+			l.mutex.Unlock()
+			<-fetching
+			l.mutex.Lock()
+			continue
+		}
+		if err := l.fetch(); err != nil {
+			res := result{limit: l.requests, reset: l.end.Sub(now)}
+			if l.d.failOpen {
+				// no local token taken, so nothing to refund
+				res.allowed, res.remaining, res.untaken = true, l.remaining, true
+				return res
+			}
+			res.unavailable, res.retry = true, time.Second
+			return res
+		}
+	}
+
+	res := result{limit: l.requests, reset: l.end.Sub(now)}
+	if l.local == 0 {
+		res.retry = res.reset
+		return res
+	}
+	l.local--
+	res.allowed = true
+	res.remaining = l.remaining + l.local
+	return res
+}
+
+// refund a token taken at now to local, unless the window changed. Tokens
+// allowed by failing open are never taken from local, so never refunded.
+func (l *distributedLimiter) refund(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if start, _ := l.bounds(now); start.Equal(l.start) {
+		l.local++
+	}
+}
+
+// fetch tokens of the current window from backend, called with mutex held
+// which is released during the round trip. Tokens are discarded if window
+// changed meanwhile.
+func (l *distributedLimiter) fetch() error {
+	var (
+		fetching = make(chan struct{})
+		start    = l.start
+		window   = l.end.Sub(l.start)
+		n        = l.d.batch
+	)
+	if n > l.requests {
+		n = l.requests
+	}
+	key := l.key + ":" + strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	l.fetching = fetching
+	l.mutex.Unlock()
+
+	count, err := l.d.incr(key, n, window)
+
+	l.mutex.Lock()
+	l.fetching = nil
+	close(fetching)
+	if err != nil || !start.Equal(l.start) {
+		return err
+	}
+
+	// only tokens under the limit are granted
+	granted := l.requests - int(count) + n
+	if granted > n {
+		granted = n
+	}
+	if granted < n {
+		l.exhausted = true
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	l.local = granted
+	if l.remaining = l.requests - int(count); l.remaining < 0 {
+		l.remaining = 0
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/plugin"
+	"github.com/jademperor/common/models"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_Bucket_distributed(t *testing.T) {
+	f := newFakeRedis(t, "")
+	defer f.close()
+
+	// two instances share the limit of 20 requests per minute
+	cfg := []byte(`{
+		"limits": [{"key_by": "ip", "algorithm": "distributed", "requests": 20, "window": 60}],
+		"backend": {"addr": "` + f.addr() + `", "batch": 10}
+	}`)
+	var instances []*Bucket
+	for i := 0; i < 2; i++ {
+		b := New(100, 10)
+		if err := b.Init(cfg); err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		instances = append(instances, b)
+	}
+
+	allowed := 0
+	for i := 0; i < 30; i++ {
+		ctx, w := newContext(instances[i%2], "1.1.1.1", "")
+		ctx.Next()
+		if w.Code == http.StatusOK {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("want 20 allowed, got %d", allowed)
+	}
+	// tokens pre-allocated in batch, and no more round trip once exhausted
+	if n := f.received("INCRBY"); n != 4 {
+		t.Errorf("want 4 round trips, got %d", n)
+	}
+
+	// backend unreachable
+	f.close()
+	for _, failOpen := range []bool{false, true} {
+		b := New(100, 10)
+		cfg := []byte(`{
+			"limits": [{"key_by": "ip", "algorithm": "distributed", "requests": 20, "window": 60}],
+			"backend": {"addr": "` + f.addr() + `", "fail_open": ` + strconv.FormatBool(failOpen) + `}
+		}`)
+		if err := b.Init(cfg); err != nil {
+			t.Fatal(err)
+		}
+		ctx, w := newContext(b, "2.2.2.2", "")
+		ctx.Next()
+		if want := map[bool]int{false: http.StatusServiceUnavailable, true: http.StatusOK}[failOpen]; w.Code != want {
+			t.Errorf("fail open %v want %d, got %d", failOpen, want, w.Code)
+		}
+		b.Close()
+	}
+
+	if err := New(100, 10).Init([]byte(`{"limits": [{"key_by": "ip", "algorithm": "distributed", "requests": 1, "window": 1}]}`)); err != errNoBackend {
+		t.Errorf("want error %v, got %v", errNoBackend, err)
+	}
+}
+
+func Test_Bucket_distributedKeys(t *testing.T) {
+	f := newFakeRedis(t, "")
+	defer f.close()
+
+	b := New(100, 10)
+	if err := b.Init([]byte(`{
+		"limits": [{"key_by": "ip", "algorithm": "distributed", "requests": 20, "window": 60}],
+		"backend": {"addr": "` + f.addr() + `", "prefix": "gw1"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// derived with the same limits, but counted separately by route
+	d, err := b.Derive(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.(*Bucket).Close()
+
+	ctx, _ := newContext(b, "1.1.1.1", "")
+	ctx.Next()
+	ctx, _ = newContext(d.(*Bucket), "1.1.1.1", "")
+	ctx.SetPlugins([]plugin.Plugin{d})
+	ctx.SetRoute(&plugin.Route{Kind: plugin.RouteAPI, API: &models.API{Idx: "orders"}})
+	ctx.Next()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.counts) != 2 {
+		t.Fatalf("want 2 counters, got %v", f.counts)
+	}
+	var scoped bool
+	for key := range f.counts {
+		if !strings.HasPrefix(key, "gw1:") {
+			t.Errorf("want key prefixed, got %s", key)
+		}
+		scoped = scoped || strings.Contains(key, ":api/orders/0/ip:1.1.1.1:")
+	}
+	if !scoped {
+		t.Errorf("want key of derived scoped by route, got %v", f.counts)
+	}
+}
+
+// downBackend fails after delay, like dialing an unreachable redis
+type downBackend struct {
+	calls int32
+	delay time.Duration
+}
+
+func (b *downBackend) Incr(key string, n int, window time.Duration) (int64, error) {
+	atomic.AddInt32(&b.calls, 1)
+	time.Sleep(b.delay)
+	return 0, errors.New("connection refused")
+}
+
+func (b *downBackend) Close() error { return nil }
+
+func Test_distributedLimiter_backendDown(t *testing.T) {
+	backend := &downBackend{delay: 50 * time.Millisecond}
+	d := newDistributed(&BackendConfig{}, backend)
+	d.backoff = 200 * time.Millisecond
+	l := newDistributedLimiter(d, "k", 20, time.Minute)
+
+	var (
+		wg    sync.WaitGroup
+		begin = time.Now()
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := l.take(time.Now()); res.allowed || !res.unavailable {
+				t.Errorf("want unavailable, got %+v", res)
+			}
+		}()
+	}
+	wg.Wait()
+	// waiters fail fast while backing off, rather than redial one by one
+	if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+		t.Errorf("want 1 call to backend, got %d", calls)
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("want takers not serialized by round trips, took %v", elapsed)
+	}
+
+	// mutex is not held during the round trip
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		l.take(time.Now())
+		close(done)
+	}()
+	time.Sleep(270 * time.Millisecond)
+	begin = time.Now()
+	l.mutex.Lock()
+	l.mutex.Unlock()
+	if waited := time.Since(begin); waited > 20*time.Millisecond {
+		t.Errorf("want mutex free during round trip, waited %v", waited)
+	}
+	<-done
+	if calls := atomic.LoadInt32(&backend.calls); calls != 2 {
+		t.Errorf("want backend probed after backoff, got %d calls", calls)
+	}
+}
+
+func Test_distributedLimiter_failOpenRefund(t *testing.T) {
+	limits := []*Limit{
+		{KeyBy: KeyByIP, Algorithm: AlgorithmDistributed, Requests: 20, Window: 60},
+		{KeyBy: KeyByHeader, Header: "X-Api-Key", Rate: 1, Burst: 1},
+	}
+	k, err := newKeyedLimiter(limits, 0, &BackendConfig{FailOpen: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.d = newDistributed(&BackendConfig{FailOpen: true}, &downBackend{})
+	now := time.Now()
+	take := func() result {
+		ctx, _ := newContext(nil, "1.1.1.1", "key1")
+		return k.take(ctx, now)
+	}
+
+	if res := take(); !res.allowed {
+		t.Fatalf("want allowed by failing open, got %+v", res)
+	}
+	// rejected by the key limit, the distributed one allowed by failing open
+	// took no local token, so none is refunded
+	for i := 0; i < 3; i++ {
+		if res := take(); res.allowed {
+			t.Fatal("want rejected by key limit")
+		}
+	}
+	l := k.lru.get("0/ip:1.1.1.1", now, nil, limits[0].expire()).(*distributedLimiter)
+	if l.local != 0 {
+		t.Errorf("want no local tokens, got %d", l.local)
+	}
+}
+
+// memBackend counts in memory
+type memBackend struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func (b *memBackend) Incr(key string, n int, window time.Duration) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.counts[key] += int64(n)
+	return b.counts[key], nil
+}
+
+func (b *memBackend) Close() error { return nil }
+
+func Test_distributedQuota(t *testing.T) {
+	var (
+		backend = &memBackend{counts: make(map[string]int64)}
+		d       = newDistributed(&BackendConfig{Batch: 1}, backend)
+		now     = time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	)
+	q := newDistributedQuota(d, "k", 2, PeriodMonth)
+	q.take(now)
+	q.take(now)
+	r := q.take(now)
+	if r.allowed || r.retry != 12*time.Hour || r.limit != 2 {
+		t.Errorf("want rejected until next month, got %+v", r)
+	}
+
+	// counted by backend, kept while limiter evicted or gateway restarted
+	if r := newDistributedQuota(d, "k", 2, PeriodMonth).take(now); r.allowed {
+		t.Errorf("want quota kept by backend, got %+v", r)
+	}
+	if r := q.take(now.Add(12 * time.Hour)); !r.allowed || r.remaining != 1 {
+		t.Errorf("want allowed in the next month, got %+v", r)
+	}
+
+	// token refunded is kept locally, without counting in backend again
+	r1 := newDistributedQuota(d, "r", 1, PeriodDay)
+	r1.take(now)
+	r1.refund(now)
+	if r := r1.take(now); !r.allowed {
+		t.Errorf("want token refunded taken again, got %+v", r)
+	}
+	for key, count := range backend.counts {
+		if strings.HasPrefix(key, "r:") && count != 1 {
+			t.Errorf("want counted once in backend, got %d", count)
+		}
+	}
+}
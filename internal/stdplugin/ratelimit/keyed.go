@@ -0,0 +1,355 @@
+package ratelimit
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+// keys to limit by
+const (
+	KeyByIP       = "ip"
+	KeyByConsumer = "consumer"
+	KeyByHeader   = "header"
+	KeyByRoute    = "route"
+	KeyByCluster  = "cluster"
+)
+
+// algorithms of limit
+const (
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmQuota         = "quota"
+	AlgorithmDistributed   = "distributed"
+)
+
+var (
+	errInvalidLimit  = errors.New("ratelimit: rate and burst of limit must be positive")
+	errInvalidWindow = errors.New("ratelimit: requests and window of limit must be positive")
+	errNoBackend     = errors.New("ratelimit: backend must be set for distributed and quota limit")
+
+	// default max keys of buckets to keep
+	defaultMaxKeys = 10000
+	// default seconds of idle bucket to expire
+	defaultExpire = 60
+)
+
+// Limit of requests keyed by client IP, consumer, header value, route or
+// cluster, each key has its own limiter.
+type Limit struct {
+	// KeyBy one of "ip", "consumer", "header", "route" and "cluster", the
+	// client IP is used if consumer or header value is empty, keys are
+	// prefixed with the kind, so a client IP never shares the limiter of
+	// a consumer or header value
+	KeyBy string `json:"key_by"`
+	// Header name if KeyBy is "header"
+	Header string `json:"header"`
+	// Algorithm one of "token_bucket", "sliding_log", "sliding_window",
+	// "quota" and "distributed", default is "token_bucket". "distributed"
+	// counts requests in fixed window with backend shared by instances, so
+	// instances must share the same limits. "quota" is counted by backend
+	// also, so it's kept while limiters evicted or gateway restarted.
+	Algorithm string `json:"algorithm"`
+	// Rate tokens generated per second of "token_bucket"
+	Rate float64 `json:"rate"`
+	// Burst max tokens of "token_bucket"
+	Burst int `json:"burst"`
+	// Requests max requests in window or quota period
+	Requests int `json:"requests"`
+	// Window seconds of "sliding_log", "sliding_window" and "distributed"
+	Window int `json:"window"`
+	// Period of "quota", one of "day" and "month", in UTC
+	Period string `json:"period"`
+	// Expire seconds of idle limiter to be removed, default is 60, and
+	// never less than the window or quota period
+	Expire int `json:"expire"`
+}
+
+func (l *Limit) validate() error {
+	switch l.KeyBy {
+	case KeyByIP, KeyByConsumer, KeyByRoute, KeyByCluster:
+	case KeyByHeader:
+		if l.Header == "" {
+			return fmt.Errorf("ratelimit: header of limit must be set")
+		}
+	default:
+		return fmt.Errorf("ratelimit: unknown key_by of limit: %s", l.KeyBy)
+	}
+
+	switch l.Algorithm {
+	case "", AlgorithmTokenBucket:
+		if l.Rate <= 0 || l.Burst <= 0 {
+			return errInvalidLimit
+		}
+	case AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmDistributed:
+		if l.Requests <= 0 || l.Window <= 0 {
+			return errInvalidWindow
+		}
+	case AlgorithmQuota:
+		if l.Requests <= 0 {
+			return errInvalidWindow
+		}
+		if l.Period != PeriodDay && l.Period != PeriodMonth {
+			return fmt.Errorf("ratelimit: unknown period of quota: %s", l.Period)
+		}
+	default:
+		return fmt.Errorf("ratelimit: unknown algorithm of limit: %s", l.Algorithm)
+	}
+	return nil
+}
+
+// newLimiter of the algorithm, d and key are used by "distributed" and
+// "quota"
+func (l *Limit) newLimiter(d *distributed, key string) limiter {
+	switch l.Algorithm {
+	case AlgorithmDistributed:
+		return newDistributedLimiter(d, key, l.Requests,
+			time.Duration(l.Window)*time.Second)
+	case AlgorithmQuota:
+		return newDistributedQuota(d, key, l.Requests, l.Period)
+	case AlgorithmSlidingLog:
+		return newSlidingLog(l.Requests, time.Duration(l.Window)*time.Second)
+	case AlgorithmSlidingWindow:
+		return newSlidingWindow(l.Requests, time.Duration(l.Window)*time.Second)
+	}
+	return newLazyBucket(l.Rate, l.Burst)
+}
+
+// expire of idle limiter, not less than the window to keep counting
+func (l *Limit) expire() time.Duration {
+	expire := time.Duration(l.Expire) * time.Second
+	if expire <= 0 {
+		expire = time.Duration(defaultExpire) * time.Second
+	}
+	var window time.Duration
+	switch l.Algorithm {
+	case AlgorithmSlidingLog, AlgorithmDistributed:
+		window = time.Duration(l.Window) * time.Second
+	case AlgorithmSlidingWindow:
+		// the previous window is counted too
+		window = 2 * time.Duration(l.Window) * time.Second
+	case AlgorithmQuota:
+		window = periodDuration(l.Period)
+	}
+	if expire < window {
+		expire = window
+	}
+	return expire
+}
+
+// hash of limit config, so limits changed are counted separately in backend
+func (l *Limit) hash() string {
+	byts, _ := json.Marshal(l)
+	h := fnv.New64a()
+	h.Write(byts)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// key of ctx to limit by, prefixed with the kind of key
+func (l *Limit) key(ctx *plugin.Context) string {
+	switch l.KeyBy {
+	case KeyByConsumer:
+		if consumer := ctx.GetString(plugin.KeyConsumer); consumer != "" {
+			return "consumer:" + consumer
+		}
+	case KeyByHeader:
+		if value := ctx.Request().Header.Get(l.Header); value != "" {
+			return "header:" + value
+		}
+	case KeyByRoute:
+		if route := ctx.Route(); route != nil {
+			return "route:" + string(route.Kind) + "/" + route.RuleID()
+		}
+		return "path:" + ctx.Path
+	case KeyByCluster:
+		if route := ctx.Route(); route != nil {
+			return "cluster:" + route.ClusterID
+		}
+		return "cluster:"
+	}
+	return "ip:" + ctx.ClientIP
+}
+
+// result of taking token
+type result struct {
+	allowed   bool
+	limit     int           // burst of bucket, or requests of window
+	remaining int           // tokens remaining
+	reset     time.Duration // duration until bucket full or window reset
+	retry     time.Duration // duration until a token available if not allowed
+
+	unavailable bool // rejected as backend unreachable
+	untaken     bool // allowed without a token taken, never refunded
+}
+
+// limiter of a key
+type limiter interface {
+	take(now time.Time) result
+	// refund a token taken at now, as the request is rejected by others
+	refund(now time.Time)
+}
+
+// keyedLimiter limit requests with limits, limiters are kept in LRU
+type keyedLimiter struct {
+	limits []*Limit
+	lru    *lru
+	d      *distributed // nil if no backend configured
+	// prefixes of backend keys by limit, with key prefix and hash of limit
+	prefixes []string
+	// scoped keys by matched route, for limiter of Bucket derived for
+	// routes, so routes are counted separately from each other and the
+	// global Bucket
+	scoped bool
+}
+
+// newKeyedLimiter with limits, backend is created with backendCfg if set
+func newKeyedLimiter(limits []*Limit, maxKeys int, backendCfg *BackendConfig,
+	scoped bool) (*keyedLimiter, error) {
+	for _, l := range limits {
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+		if (l.Algorithm == AlgorithmDistributed || l.Algorithm == AlgorithmQuota) && backendCfg == nil {
+			return nil, errNoBackend
+		}
+	}
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	k := &keyedLimiter{limits: limits, lru: newLRU(maxKeys), scoped: scoped}
+	if backendCfg != nil {
+		k.d = newDistributed(backendCfg, newRedisBackend(backendCfg))
+		prefix := backendCfg.Prefix
+		if prefix == "" {
+			prefix = defaultPrefix
+		}
+		for _, l := range limits {
+			k.prefixes = append(k.prefixes, prefix+":"+l.hash()+":")
+		}
+	}
+	return k, nil
+}
+
+// close backend if configured
+func (k *keyedLimiter) close() error {
+	if k.d != nil {
+		return k.d.backend.Close()
+	}
+	return nil
+}
+
+// take a token from limiter of each limit, result of the most restrictive
+// limit returned. Tokens taken are refunded if rejected by any limit, so
+// rejected requests are never counted.
+func (k *keyedLimiter) take(ctx *plugin.Context, now time.Time) result {
+	var (
+		res   = result{allowed: true, remaining: math.MaxInt32}
+		first = true
+		taken = make([]limiter, 0, len(k.limits))
+	)
+	var scope string
+	if route := ctx.Route(); k.scoped && route != nil {
+		scope = string(route.Kind) + "/" + route.RuleID() + "/"
+	}
+	for i, l := range k.limits {
+		key := scope + strconv.Itoa(i) + "/" + l.key(ctx)
+		b := k.lru.get(key, now, func() limiter {
+			if k.d == nil {
+				return l.newLimiter(nil, key)
+			}
+			return l.newLimiter(k.d, k.prefixes[i]+key)
+		}, l.expire())
+
+		r := b.take(now)
+		if !r.allowed {
+			for _, b := range taken {
+				b.refund(now)
+			}
+			return r
+		}
+		if !r.untaken {
+			taken = append(taken, b)
+		}
+		if first || r.remaining < res.remaining {
+			res, first = r, false
+		}
+	}
+	return res
+}
+
+// setHeaders set X-RateLimit headers, and Retry-After if not allowed
+func (r result) setHeaders(h http.Header) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(r.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(r.remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(r.reset)))
+	if !r.allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(r.retry)))
+	}
+}
+
+// lru of limiters, bounded with max keys and limiters idle would be expired
+type lru struct {
+	mutex   sync.Mutex
+	maxKeys int
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	limiter limiter
+	expires time.Time
+}
+
+func newLRU(maxKeys int) *lru {
+	return &lru{
+		maxKeys: maxKeys,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get limiter of key, created by newLimiter if not found or expired, the
+// least recently used one would be evicted if full.
+func (c *lru) get(key string, now time.Time, newLimiter func() limiter,
+	expire time.Duration) limiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		if now.Before(entry.expires) {
+			entry.expires = now.Add(expire)
+			c.ll.MoveToFront(elem)
+			return entry.limiter
+		}
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+
+	entry := &lruEntry{key: key, limiter: newLimiter(), expires: now.Add(expire)}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.maxKeys {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+	return entry.limiter
+}
+
+func (c *lru) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ll.Len()
+}
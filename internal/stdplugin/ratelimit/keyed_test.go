@@ -0,0 +1,236 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func newContext(b *Bucket, ip, apiKey string) (*plugin.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "http://example.com/orders", nil)
+	req.Header.Set("X-Api-Key", apiKey)
+	w := httptest.NewRecorder()
+	ctx := plugin.NewContext(w, req, []plugin.Plugin{b})
+	ctx.ClientIP = ip
+	return ctx, w
+}
+
+func Test_Bucket_keyed(t *testing.T) {
+	b := New(100, 10)
+	cfg := `{"limits": [
+		{"key_by": "ip", "rate": 1, "burst": 3},
+		{"key_by": "header", "header": "X-Api-Key", "rate": 1, "burst": 2}
+	]}`
+	if err := b.Init([]byte(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.capacity != 100 {
+		t.Errorf("want capacity unchanged, got %d", b.capacity)
+	}
+
+	// the key limit is more restrictive
+	ctx, w := newContext(b, "1.1.1.1", "key1")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Fatalf("want allowed, got %d", w.Code)
+	}
+	h := w.Header()
+	if h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != "1" ||
+		h.Get("X-RateLimit-Reset") != "1" {
+		t.Errorf("want limit 2, remaining 1, reset 1, got %v", h)
+	}
+
+	ctx, _ = newContext(b, "1.1.1.1", "key1")
+	ctx.Next()
+	ctx, w = newContext(b, "1.1.1.1", "key1")
+	ctx.Next()
+	if !ctx.Aborted() || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("want 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("want Retry-After 1, got %v", w.Header())
+	}
+
+	// another key has its own bucket, and the IP token taken by the
+	// rejected request is refunded, until the IP bucket is exhausted
+	ctx, w = newContext(b, "1.1.1.1", "key2")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Errorf("want allowed with IP token refunded, got %d %v", w.Code, w.Header())
+	}
+	ctx, w = newContext(b, "1.1.1.1", "key3")
+	ctx.Next()
+	if !ctx.Aborted() || w.Header().Get("X-RateLimit-Limit") != "3" {
+		t.Errorf("want rejected by IP limit, got %d %v", w.Code, w.Header())
+	}
+	ctx, _ = newContext(b, "2.2.2.2", "key2")
+	ctx.Next()
+	if ctx.Aborted() {
+		t.Fatal("want allowed with another IP and key")
+	}
+
+	// derived bucket counts separately with overridden limits
+	d, err := b.Derive([]byte(`{"limits": [{"key_by": "route", "rate": 5, "burst": 5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.(*Bucket).Close()
+	ctx, w = newContext(d.(*Bucket), "1.1.1.1", "key1")
+	ctx.Next()
+	if ctx.Aborted() || w.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Errorf("want allowed by derived limit, got %d %v", w.Code, w.Header())
+	}
+	if b.limits[0].KeyBy != KeyByIP {
+		t.Errorf("want limits of parent unchanged, got %s", b.limits[0].KeyBy)
+	}
+
+	if err := b.Reload([]byte(`{"limits": [{"key_by": "unknown", "rate": 1, "burst": 1}]}`)); err == nil {
+		t.Error("want error of unknown key_by")
+	}
+
+	// daily quota per consumer alongside burst control, quota requires
+	// backend
+	quota := `[
+		{"key_by": "ip", "rate": 100, "burst": 100},
+		{"key_by": "consumer", "algorithm": "quota", "requests": 1, "period": "day"}
+	]`
+	if err := b.Reload([]byte(`{"limits": ` + quota + `}`)); err != errNoBackend {
+		t.Errorf("want error %v, got %v", errNoBackend, err)
+	}
+	f := newFakeRedis(t, "")
+	defer f.close()
+	cfg = `{"limits": ` + quota + `, "backend": {"addr": "` + f.addr() + `"}}`
+	if err := b.Reload([]byte(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		ctx, w = newContext(b, "3.3.3.3", "")
+		ctx.SetValue(plugin.KeyConsumer, "alice")
+		ctx.Next()
+		if w.Code != want || w.Header().Get("X-RateLimit-Limit") != "1" {
+			t.Errorf("#%d want %d with limit 1, got %d %v", i, want, w.Code, w.Header())
+		}
+	}
+	if err := b.Reload([]byte(`{"limits": [{"key_by": "ip", "algorithm": "quota", "requests": 1, "period": "week"}]}`)); err == nil {
+		t.Error("want error of unknown period")
+	}
+}
+
+func Test_Bucket_refund(t *testing.T) {
+	b := New(2, 1)
+	if err := b.Init([]byte(`{"limits": [{"key_by": "header", "header": "X-Api-Key", "rate": 1, "burst": 1}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	serve := func(apiKey string) int {
+		ctx, w := newContext(b, "1.1.1.1", apiKey)
+		ctx.Next()
+		return w.Code
+	}
+
+	// rejected by the key limit many times, the global bucket never exhausted
+	if code := serve("key1"); code != http.StatusOK {
+		t.Fatalf("want allowed, got %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := serve("key1"); code != http.StatusTooManyRequests {
+			t.Fatalf("want rejected by key limit, got %d", code)
+		}
+	}
+	if code := serve("key2"); code != http.StatusOK {
+		t.Errorf("want allowed with global token refunded, got %d", code)
+	}
+	if code := serve("key3"); code != http.StatusTooManyRequests {
+		t.Errorf("want rejected by global bucket, got %d", code)
+	}
+}
+
+func Test_Limit_key(t *testing.T) {
+	ctx, _ := newContext(nil, "alice", "alice")
+	ctx.SetValue(plugin.KeyConsumer, "alice")
+	cases := []struct {
+		limit *Limit
+		want  string
+	}{
+		{&Limit{KeyBy: KeyByIP}, "ip:alice"},
+		{&Limit{KeyBy: KeyByConsumer}, "consumer:alice"},
+		{&Limit{KeyBy: KeyByHeader, Header: "X-Api-Key"}, "header:alice"},
+		{&Limit{KeyBy: KeyByHeader, Header: "X-Missing"}, "ip:alice"},
+		{&Limit{KeyBy: KeyByRoute}, "path:/orders"},
+	}
+	for _, c := range cases {
+		if got := c.limit.key(ctx); got != c.want {
+			t.Errorf("%s %s: want key %s, got %s", c.limit.KeyBy, c.limit.Header, c.want, got)
+		}
+	}
+}
+
+func Test_keyedLimiter_refund(t *testing.T) {
+	limits := []*Limit{
+		{KeyBy: KeyByIP, Algorithm: AlgorithmSlidingLog, Requests: 2, Window: 60},
+		{KeyBy: KeyByIP, Algorithm: AlgorithmSlidingWindow, Requests: 2, Window: 60},
+		{KeyBy: KeyByIP, Rate: 1, Burst: 2},
+		{KeyBy: KeyByHeader, Header: "X-Api-Key", Rate: 1, Burst: 1},
+	}
+	k, err := newKeyedLimiter(limits, 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	take := func(apiKey string) bool {
+		ctx, _ := newContext(nil, "1.1.1.1", apiKey)
+		return k.take(ctx, now).allowed
+	}
+
+	// rejected by the last limit many times, earlier ones never exhausted
+	if !take("key1") {
+		t.Fatal("want allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if take("key1") {
+			t.Fatal("want rejected by key limit")
+		}
+	}
+	if !take("key2") {
+		t.Error("want allowed with tokens of IP limits refunded")
+	}
+	if take("key3") {
+		t.Error("want rejected by IP limits")
+	}
+}
+
+func Test_lru(t *testing.T) {
+	var (
+		c       = newLRU(2)
+		now     = time.Now()
+		created int
+	)
+	newBucket := func() limiter {
+		created++
+		return newLazyBucket(1, 1)
+	}
+
+	a := c.get("a", now, newBucket, time.Minute)
+	c.get("b", now, newBucket, time.Minute)
+	if c.get("a", now, newBucket, time.Minute) != a {
+		t.Error("want bucket of a cached")
+	}
+	// b is the least recently used one to be evicted
+	c.get("c", now, newBucket, time.Minute)
+	if c.len() != 2 {
+		t.Errorf("want 2 keys, got %d", c.len())
+	}
+	c.get("b", now, newBucket, time.Minute)
+	if created != 4 {
+		t.Errorf("want b created again, got %d created", created)
+	}
+
+	// expired bucket is created again
+	if c.get("b", now.Add(2*time.Minute), newBucket, time.Minute) == nil || created != 5 {
+		t.Errorf("want expired b created again, got %d created", created)
+	}
+}
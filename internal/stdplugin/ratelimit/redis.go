@@ -0,0 +1,264 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/netaddr"
+)
+
+var (
+	_ Backend = &redisBackend{}
+
+	errRedisClosed = errors.New("ratelimit: redis backend closed")
+
+	// default timeout of redis dial, read and write
+	defaultRedisTimeout = 100 * time.Millisecond
+	// default idle connections of redis to keep
+	defaultRedisPoolSize = 16
+)
+
+// redisError error replied by redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "ratelimit: redis error: " + string(e)
+}
+
+// redisBackend is a Backend speaks RESP (REdis Serialization Protocol),
+// counts are kept with INCRBY and PEXPIRE pipelined in one round trip.
+type redisBackend struct {
+	network  string
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn // idle connections
+	closed   chan struct{}
+}
+
+type redisConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+func newRedisBackend(cfg *BackendConfig) *redisBackend {
+	network, address := netaddr.Parse(cfg.Addr)
+	timeout := time.Duration(cfg.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultRedisPoolSize
+	}
+	return &redisBackend{
+		network:  network,
+		address:  address,
+		password: cfg.Password,
+		db:       cfg.DB,
+		timeout:  timeout,
+		pool:     make(chan *redisConn, poolSize),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Incr count of key by n, key would be expired after window
+func (r *redisBackend) Incr(key string, n int, window time.Duration) (int64, error) {
+	replies, err := r.do(
+		[]string{"INCRBY", key, strconv.Itoa(n)},
+		[]string{"PEXPIRE", key, strconv.FormatInt(int64(window/time.Millisecond), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("ratelimit: unexpected reply of INCRBY: %v", replies[0])
+	}
+	return count, nil
+}
+
+// Close connections idle, connections in use would be closed after used
+func (r *redisBackend) Close() error {
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	for {
+		select {
+		case c := <-r.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do commands pipelined, replies of commands returned, or the first error
+// replied.
+func (r *redisBackend) do(cmds ...[]string) ([]interface{}, error) {
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.do(r.timeout, cmds...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// connection broken
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	r.put(c)
+	return replies, err
+}
+
+func (r *redisBackend) get() (*redisConn, error) {
+	select {
+	case <-r.closed:
+		return nil, errRedisClosed
+	case c := <-r.pool:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout(r.network, r.address, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}
+
+	var cmds [][]string
+	if r.password != "" {
+		cmds = append(cmds, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	if len(cmds) != 0 {
+		if _, err := c.do(r.timeout, cmds...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *redisBackend) put(c *redisConn) {
+	select {
+	case <-r.closed:
+		c.conn.Close()
+		return
+	default:
+	}
+
+	select {
+	case r.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *redisConn) do(timeout time.Duration, cmds ...[]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	for _, cmd := range cmds {
+		writeCommand(c.bw, cmd)
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	var (
+		replies  = make([]interface{}, len(cmds))
+		replyErr error
+	)
+	for i := range cmds {
+		reply, err := readReply(c.br)
+		if err != nil {
+			if _, ok := err.(redisError); !ok {
+				return nil, err
+			}
+			// read all replies to keep the connection reusable
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// writeCommand as array of bulk strings
+func writeCommand(w *bufio.Writer, cmd []string) {
+	w.WriteString("*" + strconv.Itoa(len(cmd)) + "\r\n")
+	for _, arg := range cmd {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+// readReply of RESP, string, int64, nil, []interface{} or redisError
+// returned.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("ratelimit: empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("ratelimit: unknown redis reply: %q", line)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("ratelimit: invalid redis reply line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaks RESP, supports commands used by
+// redisBackend only.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mutex    sync.Mutex
+	counts   map[string]int64
+	commands []string // name of commands received
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, counts: make(map[string]int64)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) close() { f.ln.Close() }
+
+func (f *fakeRedis) received(name string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := 0
+	for _, cmd := range f.commands {
+		if cmd == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	var (
+		br     = bufio.NewReader(conn)
+		bw     = bufio.NewWriter(conn)
+		authed = f.password == ""
+	)
+	for {
+		reply, err := readReply(br)
+		if err != nil {
+			return
+		}
+		args := reply.([]interface{})
+		cmd := strings.ToUpper(args[0].(string))
+
+		f.mutex.Lock()
+		f.commands = append(f.commands, cmd)
+		switch {
+		case cmd == "AUTH":
+			authed = args[1].(string) == f.password
+			if authed {
+				bw.WriteString("+OK\r\n")
+			} else {
+				bw.WriteString("-ERR invalid password\r\n")
+			}
+		case !authed:
+			bw.WriteString("-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			bw.WriteString("+OK\r\n")
+		case cmd == "INCRBY":
+			n, _ := strconv.ParseInt(args[2].(string), 10, 64)
+			f.counts[args[1].(string)] += n
+			bw.WriteString(":" + strconv.FormatInt(f.counts[args[1].(string)], 10) + "\r\n")
+		case cmd == "PEXPIRE":
+			bw.WriteString(":1\r\n")
+		default:
+			bw.WriteString("-ERR unknown command '" + cmd + "'\r\n")
+		}
+		f.mutex.Unlock()
+
+		if br.Buffered() == 0 {
+			bw.Flush()
+		}
+	}
+}
+
+func Test_redisBackend(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	defer f.close()
+
+	r := newRedisBackend(&BackendConfig{Addr: f.addr(), Password: "secret", DB: 1})
+	defer r.Close()
+	for i, want := range []int64{3, 5} {
+		count, err := r.Incr("k", []int{3, 2}[i], time.Minute)
+		if err != nil || count != want {
+			t.Fatalf("#%d want count %d, got %d %v", i, want, count, err)
+		}
+	}
+	// the connection is reused
+	if n := f.received("AUTH"); n != 1 {
+		t.Errorf("want AUTH once, got %d", n)
+	}
+
+	bad := newRedisBackend(&BackendConfig{Addr: f.addr(), Password: "wrong"})
+	defer bad.Close()
+	if _, err := bad.Incr("k", 1, time.Minute); err == nil {
+		t.Error("want error of invalid password")
+	}
+
+	r.Close()
+	if _, err := r.Incr("k", 1, time.Minute); err != errRedisClosed {
+		t.Errorf("want error %v, got %v", errRedisClosed, err)
+	}
+}
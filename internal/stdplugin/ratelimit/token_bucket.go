@@ -1,69 +1,188 @@
 package ratelimit
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jademperor/api-proxier/plugin"
 )
 
 var (
-	_ plugin.Plugin = &Bucket{}
+	_ plugin.Plugin    = &Bucket{}
+	_ plugin.Lifecycle = &Bucket{}
+	_ plugin.Deriver   = &Bucket{}
+	_ plugin.Phaser    = &Bucket{}
+
+	errInvalidRate = errors.New("ratelimit: rate must be positive and not greater than capacity")
+
+	// default capacity and rate of Bucket created by registered factory
+	defaultCapacity = 1000000
+	defaultRate     = 1000
 )
 
-// New a Bucket to limit request with token
+func init() {
+	plugin.Register("ratelimit", func(cfgData []byte) (plugin.Plugin, error) {
+		b := New(defaultCapacity, defaultRate)
+		if err := b.apply(cfgData); err != nil {
+			return nil, err
+		}
+		return b, nil
+	})
+}
+
+// Config of Bucket
+type Config struct {
+	Capacity int      `json:"capacity"` // max token to own, 0 means unchanged
+	Rate     int      `json:"rate"`     // speed to generate token per second
+	Limits   []*Limit `json:"limits"`   // limits keyed by client IP, consumer and so on
+	MaxKeys  int      `json:"max_keys"` // max keys of buckets to keep, default is 10000
+	// Backend of distributed limits shared by gateway instances
+	Backend *BackendConfig `json:"backend"`
+}
+
+// New a Bucket to limit request with token, tokens are refilled lazily
+// with elapsed time, so no goroutine is needed.
 func New(cap, r int) *Bucket {
-	if r > cap {
+	if r <= 0 || r > cap {
 		panic("i panic anyway")
 	}
 
-	var (
-		// once sync.Once
-		b = &Bucket{
-			capacity: cap,
-			r:        r,
-			rest:     cap / 2,
-			enabled:  true,
-			status:   plugin.Working,
-		}
-	)
-	b.init()
+	b := &Bucket{
+		capacity: cap,
+		r:        r,
+		enabled:  1,
+	}
+	b.status.Store(plugin.Working)
+	b.bucket.Store(newLazyBucket(float64(r), cap))
+	b.keyed.Store((*keyedLimiter)(nil))
 	return b
 }
 
 // Bucket contains token for request
 type Bucket struct {
-	capacity int              // max token to own
-	r        int              // speed to generate a token per second
-	rest     int              // rest token count
-	rwm      sync.RWMutex     // RW mutex
-	enabled  bool             // enabled flag
-	status   plugin.PlgStatus // stauts flag
+	capacity int          // max token to own
+	r        int          // speed to generate a token per second
+	bucket   atomic.Value // *lazyBucket to take token from
+	rwm      sync.RWMutex // RW mutex
+	enabled  int32        // 1 if enabled, accessed atomically per request
+	status   atomic.Value // plugin.PlgStatus, accessed atomically per request
+
+	limits  []*Limit       // limits configured
+	maxKeys int            // max keys of buckets
+	backend *BackendConfig // backend of distributed limits
+	keyed   atomic.Value   // *keyedLimiter of limits, nil if no limits
+	scoped  bool           // derived for routes, limits keyed by route also
 }
 
-// init bucket
-func (b *Bucket) init() {
-	go b.startGenerateToken()
+// Init apply cfgData, which is optional
+func (b *Bucket) Init(cfgData []byte) error {
+	return b.apply(cfgData)
 }
 
-// Handle func for bucket to work as a plugin.Plugin
+// Reload capacity and rate with cfgData
+func (b *Bucket) Reload(cfgData []byte) error {
+	b.setStatus(plugin.Reloading)
+	err := b.apply(cfgData)
+	b.Enable(b.Enabled())
+	return err
+}
+
+// Close mark Bucket stopped and close the backend of distributed limits
+func (b *Bucket) Close() error {
+	b.rwm.Lock()
+	defer b.rwm.Unlock()
+	b.status.Store(plugin.Stopped)
+	if keyed := b.keyed.Load().(*keyedLimiter); keyed != nil {
+		b.keyed.Store((*keyedLimiter)(nil))
+		return keyed.close()
+	}
+	return nil
+}
+
+// Derive a new Bucket with capacity and rate overridden by cfgData,
+// tokens of the new Bucket are counted separately.
+func (b *Bucket) Derive(cfgData []byte) (plugin.Plugin, error) {
+	b.rwm.RLock()
+	cfg := &Config{Capacity: b.capacity, Rate: b.r, MaxKeys: b.maxKeys}
+	for _, l := range b.limits {
+		copied := *l
+		cfg.Limits = append(cfg.Limits, &copied)
+	}
+	if b.backend != nil {
+		copied := *b.backend
+		cfg.Backend = &copied
+	}
+	b.rwm.RUnlock()
+
+	capacity, r := cfg.Capacity, cfg.Rate
+	if len(cfgData) != 0 {
+		if err := json.Unmarshal(cfgData, cfg); err != nil {
+			return nil, err
+		}
+	}
+	// like apply, the global bucket is kept as parent without capacity
+	if cfg.Capacity <= 0 {
+		cfg.Capacity, cfg.Rate = capacity, r
+	}
+	if cfg.Rate <= 0 || cfg.Rate > cfg.Capacity {
+		return nil, errInvalidRate
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	d := New(cfg.Capacity, cfg.Rate)
+	d.scoped = true
+	if err := d.Init(data); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Handle func for bucket to work as a plugin.Plugin, X-RateLimit headers
+// of the most restrictive limit would be set if limits configured.
 func (b *Bucket) Handle(c *plugin.Context) {
-	if !b.accquire() {
+	now := time.Now()
+	if ok, retry := b.take(now); !ok {
+		c.ResponseWriter().Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retry)))
 		c.String(http.StatusTooManyRequests, "Too Many Request")
 		return
 	}
+
+	if keyed := b.keyed.Load().(*keyedLimiter); keyed != nil {
+		res := keyed.take(c, now)
+		res.setHeaders(c.ResponseWriter().Header())
+		if res.unavailable || !res.allowed {
+			// the global token is given back since request never proxied
+			b.bucket.Load().(*lazyBucket).refund(now)
+		}
+		if res.unavailable {
+			c.String(http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		if !res.allowed {
+			c.String(http.StatusTooManyRequests, "Too Many Request")
+			return
+		}
+	}
 	c.Next()
 }
 
 // Enabled ...
 func (b *Bucket) Enabled() bool {
-	return b.enabled
+	return atomic.LoadInt32(&b.enabled) == 1
 }
 
 // Status ...
 func (b *Bucket) Status() plugin.PlgStatus {
-	return b.status
+	return b.status.Load().(plugin.PlgStatus)
 }
 
 // Name ...
@@ -73,40 +192,161 @@ func (b *Bucket) Name() string {
 
 // Enable ...
 func (b *Bucket) Enable(enabled bool) {
-	b.enabled = enabled
+	b.rwm.Lock()
+	defer b.rwm.Unlock()
 	if !enabled {
-		b.status = plugin.Stopped
+		atomic.StoreInt32(&b.enabled, 0)
+		b.status.Store(plugin.Stopped)
 	} else {
-		b.status = plugin.Working
+		atomic.StoreInt32(&b.enabled, 1)
+		b.status.Store(plugin.Working)
 	}
 }
 
-// accquire for a token to allow request process
-func (b *Bucket) accquire() bool {
+// Phase ...
+func (b *Bucket) Phase() plugin.Phase {
+	return plugin.PhaseRateLimit
+}
+
+// Priority ...
+func (b *Bucket) Priority() int {
+	return 0
+}
+
+func (b *Bucket) setStatus(status plugin.PlgStatus) {
+	b.rwm.Lock()
+	defer b.rwm.Unlock()
+	b.status.Store(status)
+}
+
+// apply Config in cfgData, empty cfgData would be ignored
+func (b *Bucket) apply(cfgData []byte) error {
+	if len(cfgData) == 0 {
+		return nil
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(cfgData, cfg); err != nil {
+		return err
+	}
+	if cfg.Capacity > 0 && (cfg.Rate <= 0 || cfg.Rate > cfg.Capacity) {
+		return errInvalidRate
+	}
+
+	var keyed *keyedLimiter
+	if len(cfg.Limits) != 0 {
+		var err error
+		if keyed, err = newKeyedLimiter(cfg.Limits, cfg.MaxKeys, cfg.Backend, b.scoped); err != nil {
+			return err
+		}
+	}
+
 	b.rwm.Lock()
 	defer b.rwm.Unlock()
-	if b.rest > 0 {
-		b.rest--
-		return true
+	if cfg.Capacity > 0 && (cfg.Capacity != b.capacity || cfg.Rate != b.r) {
+		b.capacity, b.r = cfg.Capacity, cfg.Rate
+		b.bucket.Store(b.bucket.Load().(*lazyBucket).resize(float64(cfg.Rate), cfg.Capacity))
+	}
+	b.limits, b.maxKeys, b.backend = cfg.Limits, cfg.MaxKeys, cfg.Backend
+	if old := b.keyed.Load().(*keyedLimiter); old != nil {
+		old.close()
+	}
+	b.keyed.Store(keyed)
+	return nil
+}
+
+// take a token from the global bucket, duration to retry returned if not
+// allowed
+func (b *Bucket) take(now time.Time) (bool, time.Duration) {
+	newTat, ok := b.bucket.Load().(*lazyBucket).reserve(now.UnixNano())
+	if ok {
+		return true, 0
 	}
-	return false
+	return false, time.Duration(newTat - now.UnixNano())
+}
+
+// lazyBucket is a lock-free token bucket implemented with GCRA (generic
+// cell rate algorithm): instead of counting tokens, it tracks the
+// theoretical arrival time (TAT) of the next request, tokens are refilled
+// lazily from elapsed time with nanosecond precision.
+type lazyBucket struct {
+	tat      int64 // theoretical arrival time in unix nano, accessed atomically
+	interval int64 // nanoseconds to generate a token
+	limit    int64 // nanoseconds to generate burst tokens
+	burst    int
 }
 
-// generate token, always start a goroutine to process this
-func (b *Bucket) startGenerateToken() {
-	ticker := time.NewTicker(1 * time.Second)
+func newLazyBucket(rate float64, burst int) *lazyBucket {
+	interval := int64(float64(time.Second) / rate)
+	if interval <= 0 {
+		interval = 1
+	}
+	return &lazyBucket{
+		interval: interval,
+		limit:    interval * int64(burst),
+		burst:    burst,
+	}
+}
+
+// resize a new lazyBucket with rate and burst, tokens taken are kept
+func (b *lazyBucket) resize(rate float64, burst int) *lazyBucket {
+	nb := newLazyBucket(rate, burst)
+	nb.tat = atomic.LoadInt64(&b.tat)
+	return nb
+}
+
+// reserve a token at now in unix nano, TAT after taking returned, or TAT
+// to be allowed (minus burst limit) if not allowed.
+func (b *lazyBucket) reserve(now int64) (int64, bool) {
 	for {
-		select {
-		case <-ticker.C:
-			b.rwm.Lock()
-			if b.capacity >= b.rest+b.r {
-				b.rest = b.capacity
-			} else {
-				b.rest += b.r
-			}
-			b.rwm.Unlock()
-		default:
-			time.Sleep(100 * time.Millisecond)
+		old := atomic.LoadInt64(&b.tat)
+		tat := old
+		if tat < now {
+			tat = now
+		}
+		newTat := tat + b.interval
+		if newTat-now > b.limit {
+			return newTat - b.limit, false
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, old, newTat) {
+			return newTat, true
 		}
 	}
 }
+
+// refund a token, TAT never goes back before now
+func (b *lazyBucket) refund(now time.Time) {
+	nowNano := now.UnixNano()
+	for {
+		old := atomic.LoadInt64(&b.tat)
+		tat := old - b.interval
+		if tat < nowNano {
+			tat = nowNano
+		}
+		if tat >= old || atomic.CompareAndSwapInt64(&b.tat, old, tat) {
+			return
+		}
+	}
+}
+
+// take a token with result to set headers
+func (b *lazyBucket) take(now time.Time) result {
+	nowNano := now.UnixNano()
+	newTat, ok := b.reserve(nowNano)
+	if !ok {
+		return result{
+			limit: b.burst,
+			reset: time.Duration(newTat + b.limit - b.interval - nowNano),
+			retry: time.Duration(newTat - nowNano),
+		}
+	}
+	return result{
+		allowed:   true,
+		limit:     b.burst,
+		remaining: int((b.limit - (newTat - nowNano)) / b.interval),
+		reset:     time.Duration(newTat - nowNano),
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
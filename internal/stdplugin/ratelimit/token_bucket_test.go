@@ -1 +1,199 @@
 package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func Test_Bucket_lifecycle(t *testing.T) {
+	b := New(10, 5)
+	if err := b.Init([]byte(`{"capacity": 4, "rate": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if b.capacity != 4 || b.r != 2 {
+		t.Errorf("want capacity 4, rate 2, got %d %d", b.capacity, b.r)
+	}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("want %d allowed", i)
+		}
+	}
+	if ok, retry := b.take(now); ok || retry != 500*time.Millisecond {
+		t.Errorf("want rejected with retry 500ms, got %v %v", ok, retry)
+	}
+
+	if err := b.Reload([]byte(`{"capacity": 2, "rate": 3}`)); err != errInvalidRate {
+		t.Errorf("want error %v, got %v", errInvalidRate, err)
+	}
+	if err := b.Reload([]byte(`{"capacity": 20, "rate": 10}`)); err != nil {
+		t.Fatal(err)
+	}
+	if b.capacity != 20 || b.Status() != plugin.Working {
+		t.Errorf("want capacity 20 and working, got %d %s", b.capacity, b.Status())
+	}
+
+	b.Close()
+	if b.Status() != plugin.Stopped {
+		t.Errorf("want stopped, got %s", b.Status())
+	}
+	// close twice is safe
+	b.Close()
+}
+
+func Test_Bucket_Derive(t *testing.T) {
+	b := New(10, 5)
+	d, err := b.Derive([]byte(`{"capacity": 4, "rate": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db := d.(*Bucket); db.capacity != 4 || db.r != 2 {
+		t.Errorf("want capacity 4, rate 2, got %d %d", db.capacity, db.r)
+	}
+	d, err = b.Derive([]byte(`{"capacity": 0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db := d.(*Bucket); db.capacity != 10 || db.r != 5 {
+		t.Errorf("want capacity 10, rate 5 of parent, got %d %d", db.capacity, db.r)
+	}
+
+	// rejected instead of panic
+	for _, cfgData := range []string{`{"rate": 20}`, `{"rate": 0}`, `{"capacity": 2, "rate": 3}`} {
+		if _, err := b.Derive([]byte(cfgData)); err != errInvalidRate {
+			t.Errorf("%s want error %v, got %v", cfgData, errInvalidRate, err)
+		}
+	}
+}
+
+func Test_lazyBucket(t *testing.T) {
+	now := time.Now()
+	b := newLazyBucket(2, 2)
+	b.take(now)
+	b.take(now)
+	if r := b.take(now); r.allowed || r.retry != 500*time.Millisecond {
+		t.Errorf("want rejected with retry 500ms, got %+v", r)
+	}
+	if r := b.take(now.Add(500 * time.Millisecond)); !r.allowed || r.remaining != 0 {
+		t.Errorf("want refilled one token, got %+v", r)
+	}
+	if r := b.take(now.Add(time.Hour)); !r.allowed || r.remaining != 1 {
+		t.Errorf("want refilled to burst, got %+v", r)
+	}
+}
+
+func Test_lazyBucket_parallel(t *testing.T) {
+	var (
+		b       = newLazyBucket(1, 100)
+		now     = time.Now()
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if b.take(now).allowed {
+					mutex.Lock()
+					allowed++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 100 {
+		t.Errorf("want 100 allowed, got %d", allowed)
+	}
+}
+
+// mutexBucket is the token bucket guarded by mutex and refilled by a
+// ticker every second, as a baseline of benchmarks.
+type mutexBucket struct {
+	mutex    sync.Mutex
+	capacity int
+	r        int
+	rest     int
+}
+
+func (b *mutexBucket) accquire() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rest > 0 {
+		b.rest--
+		return true
+	}
+	return false
+}
+
+func (b *mutexBucket) refill(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mutex.Lock()
+			if b.rest += b.r; b.rest > b.capacity {
+				b.rest = b.capacity
+			}
+			b.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func Benchmark_mutexBucket_parallel(b *testing.B) {
+	bucket := &mutexBucket{capacity: 1 << 30, r: 1 << 20, rest: 1 << 30}
+	stop := make(chan struct{})
+	defer close(stop)
+	go bucket.refill(stop)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bucket.accquire()
+		}
+	})
+}
+
+// time.Now is excluded from benchmarks of Bucket, which costs the same
+// as the baseline to refill with ticker.
+
+func Benchmark_Bucket_parallel(b *testing.B) {
+	var (
+		bucket = New(1<<30, 1<<20)
+		start  = time.Now()
+	)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			bucket.take(start.Add(time.Duration(i)))
+		}
+	})
+}
+
+func Benchmark_Bucket_serial(b *testing.B) {
+	var (
+		bucket = New(1<<30, 1<<20)
+		start  = time.Now()
+	)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucket.take(start.Add(time.Duration(i)))
+	}
+}
+
+func Benchmark_mutexBucket_serial(b *testing.B) {
+	bucket := &mutexBucket{capacity: 1 << 30, r: 1 << 20, rest: 1 << 30}
+	for i := 0; i < b.N; i++ {
+		bucket.accquire()
+	}
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// periods of quota
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// slidingLog limit requests in sliding window with log of request time,
+// which is exact but costs memory of max requests per key.
+type slidingLog struct {
+	mutex    sync.Mutex
+	requests int
+	window   time.Duration
+	log      []time.Time // time of requests allowed in window, oldest first
+}
+
+func newSlidingLog(requests int, window time.Duration) *slidingLog {
+	return &slidingLog{
+		requests: requests,
+		window:   window,
+		log:      make([]time.Time, 0, requests),
+	}
+}
+
+func (l *slidingLog) take(now time.Time) result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// drop requests out of window
+	start := now.Add(-l.window)
+	i := 0
+	for i < len(l.log) && !l.log[i].After(start) {
+		i++
+	}
+	if i > 0 {
+		l.log = append(l.log[:0], l.log[i:]...)
+	}
+
+	res := result{limit: l.requests}
+	if len(l.log) >= l.requests {
+		res.retry = l.log[0].Add(l.window).Sub(now)
+		res.reset = l.log[len(l.log)-1].Add(l.window).Sub(now)
+		return res
+	}
+
+	l.log = append(l.log, now)
+	res.allowed = true
+	res.remaining = l.requests - len(l.log)
+	res.reset = l.window
+	return res
+}
+
+// refund the latest request allowed
+func (l *slidingLog) refund(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.log) != 0 {
+		l.log = l.log[:len(l.log)-1]
+	}
+}
+
+// slidingWindow limit requests in sliding window approximately with
+// counters of the current and previous fixed window, the previous one is
+// weighted by its overlap with the sliding window.
+type slidingWindow struct {
+	mutex    sync.Mutex
+	requests int
+	window   time.Duration
+	start    time.Time // start of the current window
+	curr     int       // requests in the current window
+	prev     int       // requests in the previous window
+}
+
+func newSlidingWindow(requests int, window time.Duration) *slidingWindow {
+	return &slidingWindow{requests: requests, window: window}
+}
+
+func (w *slidingWindow) take(now time.Time) result {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	start := now.Truncate(w.window)
+	switch {
+	case start.Equal(w.start):
+	case start.Sub(w.start) == w.window:
+		w.prev, w.curr = w.curr, 0
+	default:
+		w.prev, w.curr = 0, 0
+	}
+	w.start = start
+
+	var (
+		elapsed  = now.Sub(start)
+		weight   = float64(w.window-elapsed) / float64(w.window)
+		estimate = float64(w.prev)*weight + float64(w.curr)
+		res      = result{limit: w.requests, reset: w.window - elapsed}
+	)
+	if estimate+1 > float64(w.requests) {
+		res.retry = w.retry(elapsed)
+		return res
+	}
+
+	w.curr++
+	res.allowed = true
+	res.remaining = int(float64(w.requests) - estimate - 1)
+	return res
+}
+
+// refund a request allowed at now, from the window counted it
+func (w *slidingWindow) refund(now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch start := now.Truncate(w.window); {
+	case start.Equal(w.start) && w.curr > 0:
+		w.curr--
+	case w.start.Sub(start) == w.window && w.prev > 0:
+		w.prev--
+	}
+}
+
+// retry duration until estimate of requests is less than the limit
+func (w *slidingWindow) retry(elapsed time.Duration) time.Duration {
+	if w.curr+1 > w.requests || w.prev == 0 {
+		// wait for the next window, then it's weighted by the overlap
+		return w.window - elapsed
+	}
+	// prev * (window - x) / window + curr + 1 <= requests
+	x := time.Duration(float64(w.window) *
+		(1 - float64(w.requests-w.curr-1)/float64(w.prev)))
+	if x <= elapsed {
+		return time.Millisecond
+	}
+	return x - elapsed
+}
+
+// periodStart the start of period including now, in UTC
+func periodStart(period string, now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	if period == PeriodMonth {
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd the end of period including now, in UTC
+func periodEnd(period string, now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	if period == PeriodMonth {
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// periodDuration the max duration of period
+func periodDuration(period string) time.Duration {
+	if period == PeriodMonth {
+		return 31 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
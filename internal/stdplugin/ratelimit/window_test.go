@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_slidingLog(t *testing.T) {
+	var (
+		l   = newSlidingLog(2, time.Minute)
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+	l.take(now)
+	if r := l.take(now.Add(30 * time.Second)); !r.allowed || r.remaining != 0 {
+		t.Errorf("want allowed with remaining 0, got %+v", r)
+	}
+	if r := l.take(now.Add(40 * time.Second)); r.allowed || r.retry != 20*time.Second {
+		t.Errorf("want rejected with retry 20s, got %+v", r)
+	}
+	// the first request is out of window
+	if r := l.take(now.Add(time.Minute + time.Second)); !r.allowed {
+		t.Errorf("want allowed, got %+v", r)
+	}
+}
+
+func Test_slidingWindow(t *testing.T) {
+	var (
+		w   = newSlidingWindow(10, time.Minute)
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+	for i := 0; i < 10; i++ {
+		if r := w.take(now.Add(50 * time.Second)); !r.allowed {
+			t.Fatalf("want %d allowed, got %+v", i, r)
+		}
+	}
+	if r := w.take(now.Add(50 * time.Second)); r.allowed || r.retry != 10*time.Second {
+		t.Errorf("want rejected until the next window, got %+v", r)
+	}
+
+	// 3/4 of the previous window is counted: 7.5 requests estimated
+	r := w.take(now.Add(75 * time.Second))
+	if !r.allowed || r.remaining != 1 {
+		t.Errorf("want allowed with remaining 1, got %+v", r)
+	}
+	w.take(now.Add(75 * time.Second))
+	if r := w.take(now.Add(75 * time.Second)); r.allowed || r.retry != 3*time.Second {
+		t.Errorf("want rejected with retry 3s, got %+v", r)
+	}
+	if r := w.take(now.Add(78 * time.Second)); !r.allowed {
+		t.Errorf("want allowed, got %+v", r)
+	}
+
+	// windows idle are not counted
+	if r := w.take(now.Add(5 * time.Minute)); !r.allowed || r.remaining != 9 {
+		t.Errorf("want allowed with remaining 9, got %+v", r)
+	}
+}
+
+func Test_period(t *testing.T) {
+	now := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	if start := periodStart(PeriodMonth, now); !start.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("want start of month, got %v", start)
+	}
+	if start := periodStart(PeriodDay, now); !start.Equal(time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("want start of day, got %v", start)
+	}
+	if end := periodEnd(PeriodDay, now); !end.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("want end of day, got %v", end)
+	}
+	if end := periodEnd(PeriodMonth, time.Date(2020, 12, 5, 0, 0, 0, 0, time.UTC)); end.Year() != 2021 {
+		t.Errorf("want end of year, got %v", end)
+	}
+}
@@ -0,0 +1,231 @@
+// Package rbacauthz to authorize request with roles of consumer, roles are
+// stored in the config source and loaded into rbac.DefaultStore, roles in
+// token claims verified by auth plugins are granted also.
+package rbacauthz
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/rbac"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+var (
+	_ plugin.Plugin    = &RBAC{}
+	_ plugin.Lifecycle = &RBAC{}
+	_ plugin.Deriver   = &RBAC{}
+	_ plugin.Phaser    = &RBAC{}
+
+	// default claim of roles
+	defaultRolesClaim = "roles"
+	// header of decision explained on response
+	explainHeader = "X-Rbac-Decision"
+)
+
+func init() {
+	plugin.Register("rbac", func(cfgData []byte) (plugin.Plugin, error) {
+		return New(cfgData)
+	})
+}
+
+// Config of RBAC
+type Config struct {
+	// RolesClaim claim of roles in plugin.KeyClaims, as array or string
+	// separated by space or comma, default is "roles"
+	RolesClaim string `json:"roles_claim"`
+	// Explain decision for debugging, denied response body is JSON of
+	// rbac.Decision, and allowed response has header X-Rbac-Decision. It
+	// exposes roles and rules to clients, should not be enabled in
+	// production.
+	Explain bool `json:"explain"`
+}
+
+// New a RBAC with cfgData of Config
+func New(cfgData []byte) (*RBAC, error) {
+	r := &RBAC{
+		store:   rbac.DefaultStore,
+		enabled: true,
+		status:  plugin.Working,
+	}
+	if err := r.apply(cfgData); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RBAC plugin to authorize request with roles of consumer
+type RBAC struct {
+	mutex   sync.RWMutex
+	cfg     *Config
+	store   *rbac.Store
+	enabled bool
+	status  plugin.PlgStatus
+}
+
+// Init ...
+func (r *RBAC) Init(cfgData []byte) error {
+	return r.apply(cfgData)
+}
+
+// Reload config with cfgData
+func (r *RBAC) Reload(cfgData []byte) error {
+	r.setStatus(plugin.Reloading)
+	err := r.apply(cfgData)
+	r.Enable(r.Enabled())
+	return err
+}
+
+// Close ...
+func (r *RBAC) Close() error {
+	r.setStatus(plugin.Stopped)
+	return nil
+}
+
+// Derive a new RBAC with config fields overridden by cfgData, like
+// explaining decisions of a route only
+func (r *RBAC) Derive(cfgData []byte) (plugin.Plugin, error) {
+	r.mutex.RLock()
+	cfg, store := *r.cfg, r.store
+	r.mutex.RUnlock()
+
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		return nil, err
+	}
+	byts, _ := json.Marshal(&cfg)
+	d, err := New(byts)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+	return d, nil
+}
+
+// Handle authorize consumer and roles claimed to request method and path,
+// reject with 403 if not allowed.
+func (r *RBAC) Handle(ctx *plugin.Context) {
+	r.mutex.RLock()
+	cfg, store := r.cfg, r.store
+	r.mutex.RUnlock()
+
+	var (
+		req      = ctx.Request()
+		consumer = ctx.GetString(plugin.KeyConsumer)
+		d        = store.Decide(consumer, claimedRoles(ctx, cfg.RolesClaim), req.Method, req.URL.Path)
+	)
+	logger.Logger.Debugf("rbac consumer [%s] roles %v %s %s: %s",
+		d.Consumer, d.Roles, d.Method, d.Path, d.Reason)
+
+	if !d.Allowed {
+		if cfg.Explain {
+			ctx.JSON(http.StatusForbidden, d)
+			return
+		}
+		reason := "access denied to " + d.Method + " " + d.Path
+		if consumer == "" && len(d.Roles) == 0 {
+			reason = d.Reason
+		}
+		ctx.String(http.StatusForbidden, "Forbidden: "+reason)
+		return
+	}
+	if cfg.Explain {
+		ctx.ResponseWriter().Header().Set(explainHeader, d.Reason)
+	}
+	ctx.Next()
+}
+
+// claimedRoles in claims verified by auth plugins
+func claimedRoles(ctx *plugin.Context, claim string) []string {
+	v, ok := ctx.Value(plugin.KeyClaims)
+	if !ok {
+		return nil
+	}
+	claims, _ := v.(map[string]interface{})
+	switch roles := claims[claim].(type) {
+	case string:
+		return strings.FieldsFunc(roles, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		names := make([]string, 0, len(roles))
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	case []string:
+		return roles
+	}
+	return nil
+}
+
+// Enabled ...
+func (r *RBAC) Enabled() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.enabled
+}
+
+// Status ...
+func (r *RBAC) Status() plugin.PlgStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.status
+}
+
+// Name ...
+func (r *RBAC) Name() string {
+	return "plugin.rbac"
+}
+
+// Enable ...
+func (r *RBAC) Enable(enabled bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.enabled = enabled
+	if !enabled {
+		r.status = plugin.Stopped
+	} else {
+		r.status = plugin.Working
+	}
+}
+
+// Phase ...
+func (r *RBAC) Phase() plugin.Phase {
+	return plugin.PhaseAuth
+}
+
+// Priority lower than auth plugins, so it runs after consumer authenticated
+func (r *RBAC) Priority() int {
+	return -100
+}
+
+func (r *RBAC) setStatus(status plugin.PlgStatus) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status = status
+}
+
+// apply Config in cfgData, defaults are used if cfgData is empty
+func (r *RBAC) apply(cfgData []byte) error {
+	if len(cfgData) == 0 && r.cfg != nil {
+		return nil
+	}
+
+	cfg := new(Config)
+	if len(cfgData) != 0 {
+		if err := json.Unmarshal(cfgData, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = defaultRolesClaim
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cfg = cfg
+	return nil
+}
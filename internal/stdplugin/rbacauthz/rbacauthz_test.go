@@ -0,0 +1,119 @@
+package rbacauthz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/rbac"
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func newStore() *rbac.Store {
+	store := rbac.NewStore()
+	store.Load([]*rbac.Role{
+		{Idx: "reader", Consumers: []string{"bob"}, Rules: []*rbac.Rule{
+			{Methods: []string{"GET"}, Paths: []string{"/orders/**"}},
+		}},
+		{Idx: "admin", Rules: []*rbac.Rule{
+			{Paths: []string{"/**"}},
+			{Deny: true, Methods: []string{"DELETE"}, Paths: []string{"/orders/*/audit"}},
+		}},
+	})
+	return store
+}
+
+func serve(r *RBAC, method, path, consumer string, claims map[string]interface{}) (*plugin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	ctx := plugin.NewContext(w, httptest.NewRequest(method, "http://example.com"+path, nil), []plugin.Plugin{r})
+	if consumer != "" {
+		ctx.SetValue(plugin.KeyConsumer, consumer)
+	}
+	if claims != nil {
+		ctx.SetValue(plugin.KeyClaims, claims)
+	}
+	ctx.Next()
+	return ctx, w
+}
+
+func Test_RBAC(t *testing.T) {
+	r, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.store = newStore()
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		consumer string
+		claims   map[string]interface{}
+		status   int
+		body     string
+	}{
+		{"bound role", "GET", "/orders/1", "bob", nil, http.StatusOK, ""},
+		{"not allowed", "POST", "/orders", "bob", nil, http.StatusForbidden, "Forbidden: access denied to POST /orders"},
+		{"anonymous", "GET", "/orders", "", nil, http.StatusForbidden, "Forbidden: no consumer authenticated"},
+		{"claimed roles", "POST", "/users", "alice", map[string]interface{}{"roles": []interface{}{"dev", "admin"}}, http.StatusOK, ""},
+		{"claimed string", "POST", "/users", "alice", map[string]interface{}{"roles": "dev admin"}, http.StatusOK, ""},
+		{"denied rule", "DELETE", "/orders/1/audit", "alice", map[string]interface{}{"roles": "admin"}, http.StatusForbidden, "Forbidden: access denied to DELETE /orders/1/audit"},
+		{"denied upper case", "DELETE", "/ORDERS/1/AUDIT", "alice", map[string]interface{}{"roles": "admin"}, http.StatusForbidden, "Forbidden: access denied to DELETE /ORDERS/1/AUDIT"},
+		{"denied duplicated slashes", "DELETE", "/orders//1/audit", "alice", map[string]interface{}{"roles": "admin"}, http.StatusForbidden, "Forbidden: access denied to DELETE /orders/1/audit"},
+		{"parent segments", "GET", "/orders/../users", "bob", nil, http.StatusForbidden, "Forbidden: access denied to GET /orders/../users"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, w := serve(r, c.method, c.path, c.consumer, c.claims)
+			if w.Code != c.status || w.Body.String() != c.body {
+				t.Errorf("want %d %q, got %d %q", c.status, c.body, w.Code, w.Body.String())
+			}
+			if w.Header().Get(explainHeader) != "" {
+				t.Error("want decision not explained")
+			}
+		})
+	}
+}
+
+func Test_RBAC_explain(t *testing.T) {
+	r, err := New([]byte(`{"roles_claim": "groups"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.store = newStore()
+
+	// derived for a route to explain decisions
+	plg, err := r.Derive([]byte(`{"explain": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := plg.(*RBAC)
+
+	_, w := serve(d, "GET", "/orders/1", "bob", nil)
+	if w.Code != http.StatusOK || w.Header().Get(explainHeader) != "allowed by rule 0 of role reader" {
+		t.Errorf("want allowed and explained, got %d %q", w.Code, w.Header().Get(explainHeader))
+	}
+
+	_, w = serve(d, "DELETE", "/orders/1/audit", "bob", map[string]interface{}{"groups": "admin"})
+	decision := new(rbac.Decision)
+	if err := json.NewDecoder(w.Body).Decode(decision); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusForbidden || decision.Allowed || decision.Role != "admin" || decision.Rule != 1 ||
+		strings.Join(decision.Roles, ",") != "admin,reader" {
+		t.Errorf("want denied by rule 1 of admin, got %d %+v", w.Code, decision)
+	}
+
+	// parent not explaining
+	if _, w = serve(r, "DELETE", "/orders/1/audit", "bob", map[string]interface{}{"groups": "admin"}); strings.HasPrefix(w.Body.String(), "{") {
+		t.Errorf("want decision not explained by parent, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,337 @@
+// Package tcpproxy to proxy L4 TCP connections to cluster instances
+package tcpproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/netaddr"
+	"github.com/jademperor/api-proxier/internal/proxyproto"
+	"github.com/jademperor/common/models"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	// ErrServerClosed Serve called after Close
+	ErrServerClosed = errors.New("tcpproxy: Server closed")
+
+	// default timeout to connect instance, default is 5 second
+	defaultConnectTimeout = 5 * time.Second
+)
+
+// Rule of TCP proxy, listen on Addr and proxy connections to cluster,
+// Addr could be like ":6379" or "unix:/var/run/proxier.sock"
+type Rule struct {
+	Idx             string `json:"idx"`
+	Addr            string `json:"addr"`
+	TargetClusterID string `json:"target_cluster_id"`
+	// ConnectTimeout timeout to connect instance in millisecond
+	ConnectTimeout int `json:"connect_timeout"`
+	// IdleTimeout close connection without any read or write in millisecond,
+	// 0 means never
+	IdleTimeout int `json:"idle_timeout"`
+	// MaxConns limit concurrent connections, 0 means unlimited
+	MaxConns int `json:"max_conns"`
+	// AcceptProxyProtocol read PROXY protocol header from clients
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol"`
+	// SendProxyProtocol version of PROXY protocol header (1 or 2) to send
+	// to instances, 0 means not to send
+	SendProxyProtocol int `json:"send_proxy_protocol"`
+}
+
+// Picker pick an instance of cluster to proxy, cb is nil if instance
+// has no breaker opened
+type Picker func(clusterID string) (ins *models.ServerInstance, cb *gobreaker.CircuitBreaker, err error)
+
+// New a Server with rule, pick instance from pick. PROXY protocol header
+// is only accepted from peers of IP trusted, nil means any peer.
+func New(rule *Rule, pick Picker, trusted func(ip string) bool) *Server {
+	s := &Server{
+		rule:           rule,
+		pick:           pick,
+		trusted:        trusted,
+		connectTimeout: defaultConnectTimeout,
+		conns:          make(map[net.Conn]struct{}),
+	}
+	if rule.ConnectTimeout > 0 {
+		s.connectTimeout = time.Duration(rule.ConnectTimeout) * time.Millisecond
+	}
+	if rule.IdleTimeout > 0 {
+		s.idleTimeout = time.Duration(rule.IdleTimeout) * time.Millisecond
+	}
+	if rule.MaxConns > 0 {
+		s.sem = make(chan struct{}, rule.MaxConns)
+	}
+	return s
+}
+
+// Server proxy TCP connections accepted from listener
+type Server struct {
+	rule           *Rule
+	pick           Picker
+	trusted        func(ip string) bool // peers allowed to send PROXY protocol header
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	sem            chan struct{} // limit concurrent connections
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{} // accepted connections
+	closed   bool
+}
+
+// Rule get rule of server
+func (s *Server) Rule() *Rule {
+	return s.rule
+}
+
+// ListenAndServe listen on rule.Addr and serve
+func (s *Server) ListenAndServe() error {
+	l, err := netaddr.Listen(s.rule.Addr)
+	if err != nil {
+		return err
+	}
+	if s.rule.AcceptProxyProtocol {
+		l = proxyproto.NewListener(l, s.connectTimeout, s.trusted)
+	}
+	return s.Serve(l)
+}
+
+// Serve accept connections from l and proxy them
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mutex.Unlock()
+
+	logger.Logger.Infof("tcp proxy [%s] listening on %s to cluster %s",
+		s.rule.Idx, l.Addr(), s.rule.TargetClusterID)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Logger.Errorf("tcp proxy [%s] accept error: %v", s.rule.Idx, err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			default:
+				logger.Logger.Errorf("tcp proxy [%s] reached max conns %d, reject %s",
+					s.rule.Idx, s.rule.MaxConns, peerAddr(conn))
+				conn.Close()
+				continue
+			}
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close the listener and all proxying connections
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// peerAddr of the real peer, RemoteAddr of conn is not used since it
+// blocks while reading PROXY protocol header
+func peerAddr(conn net.Conn) net.Addr {
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return pc.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *Server) track(conn net.Conn, add bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// handle proxy the client connection to an instance of cluster
+func (s *Server) handle(client net.Conn) {
+	var (
+		start             = time.Now()
+		upstreamAddr      string
+		bytesIn, bytesOut int64
+		err               error
+	)
+	s.track(client, true)
+
+	defer func() {
+		s.track(client, false)
+		client.Close()
+		if s.sem != nil {
+			<-s.sem
+		}
+
+		fields := map[string]interface{}{
+			"rule":     s.rule.Idx,
+			"client":   client.RemoteAddr().String(),
+			"upstream": upstreamAddr,
+			"bytesIn":  bytesIn,
+			"bytesOut": bytesOut,
+			"duration": time.Since(start).String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		logger.Logger.WithFields(fields).Info("[TCP] connection closed")
+	}()
+
+	upstream, addr, err := s.dial()
+	upstreamAddr = addr
+	if err != nil {
+		return
+	}
+	if s.rule.SendProxyProtocol != 0 {
+		if err = proxyproto.WriteHeader(upstream, s.rule.SendProxyProtocol,
+			client.RemoteAddr(), client.LocalAddr()); err != nil {
+			upstream.Close()
+			return
+		}
+	}
+	s.track(upstream, true)
+	defer func() {
+		s.track(upstream, false)
+		upstream.Close()
+	}()
+
+	bytesIn, bytesOut = s.pipe(client, upstream)
+}
+
+// dial an instance picked from cluster, with breaker if opened
+func (s *Server) dial() (net.Conn, string, error) {
+	ins, cb, err := s.pick(s.rule.TargetClusterID)
+	if err != nil {
+		return nil, "", err
+	}
+	network, addr := netaddr.Parse(ins.Addr)
+
+	if cb == nil {
+		conn, err := net.DialTimeout(network, addr, s.connectTimeout)
+		return conn, addr, err
+	}
+
+	v, err := cb.Execute(func() (interface{}, error) {
+		return net.DialTimeout(network, addr, s.connectTimeout)
+	})
+	if err != nil {
+		return nil, addr, err
+	}
+	return v.(net.Conn), addr, nil
+}
+
+// pipe copy data between client and upstream until any side closed,
+// and returns bytes copied from client and to client.
+func (s *Server) pipe(client, upstream net.Conn) (in, out int64) {
+	var (
+		wg         sync.WaitGroup
+		lastActive = time.Now().UnixNano()
+	)
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		n := s.copy(upstream, client, &lastActive)
+		in = n
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		n := s.copy(client, upstream, &lastActive)
+		out = n
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+	return in, out
+}
+
+// copy from src to dst, the connection is idle only if there is
+// no data transferred in both directions, lastActive is shared by them.
+func (s *Server) copy(dst, src net.Conn, lastActive *int64) int64 {
+	if s.idleTimeout == 0 {
+		n, _ := io.Copy(dst, src)
+		return n
+	}
+
+	var (
+		total int64
+		buf   = make([]byte, 32*1024)
+	)
+	for {
+		deadline := time.Now().Add(s.idleTimeout)
+		src.SetReadDeadline(deadline)
+		dst.SetWriteDeadline(deadline)
+
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			atomic.StoreInt64(lastActive, time.Now().UnixNano())
+			nw, werr := dst.Write(buf[:nr])
+			total += int64(nw)
+			if werr != nil {
+				return total
+			}
+		}
+		if rerr != nil {
+			ne, ok := rerr.(net.Error)
+			if !ok || !ne.Timeout() {
+				return total
+			}
+			// the other direction is still active
+			if time.Since(time.Unix(0, atomic.LoadInt64(lastActive))) < s.idleTimeout {
+				continue
+			}
+			// idle timeout, close both side to stop the other direction
+			src.Close()
+			dst.Close()
+			return total
+		}
+	}
+}
+
+// closeWrite half close the connection if supported
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
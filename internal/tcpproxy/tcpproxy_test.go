@@ -0,0 +1,119 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/proxyproto"
+	"github.com/jademperor/common/models"
+	"github.com/sony/gobreaker"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+// echoServer start a TCP server echo everything back
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func Test_Server_proxy(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	srv := New(&Rule{
+		Idx:             "echo",
+		TargetClusterID: "cls",
+		IdleTimeout:     1000,
+	}, func(clusterID string) (*models.ServerInstance, *gobreaker.CircuitBreaker, error) {
+		return &models.ServerInstance{Addr: "tcp://" + upstream.Addr().String()}, nil, nil
+	}, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err = conn.Write([]byte("PING\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "PING\n" {
+		t.Errorf("want PING, got %q", line)
+	}
+}
+
+func Test_Server_maxConns(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	srv := New(&Rule{
+		Idx:             "echo",
+		TargetClusterID: "cls",
+		MaxConns:        1,
+	}, func(clusterID string) (*models.ServerInstance, *gobreaker.CircuitBreaker, error) {
+		return &models.ServerInstance{Addr: upstream.Addr().String()}, nil, nil
+	}, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rejecting must not wait for PROXY protocol header of idle clients
+	go srv.Serve(proxyproto.NewListener(l, 5*time.Second, nil))
+	defer srv.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// make sure the first connection is proxying
+	first.Write([]byte("a"))
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = first.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want second connection closed with EOF, got %v", err)
+	}
+}
@@ -0,0 +1,704 @@
+package transcode
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	errTruncated = errors.New("truncated protobuf message")
+
+	// wrappers of well-known types, value is type of field `value`
+	wrapperTypes = map[string]descpb.FieldDescriptorProto_Type{
+		"google.protobuf.DoubleValue": descpb.FieldDescriptorProto_TYPE_DOUBLE,
+		"google.protobuf.FloatValue":  descpb.FieldDescriptorProto_TYPE_FLOAT,
+		"google.protobuf.Int64Value":  descpb.FieldDescriptorProto_TYPE_INT64,
+		"google.protobuf.UInt64Value": descpb.FieldDescriptorProto_TYPE_UINT64,
+		"google.protobuf.Int32Value":  descpb.FieldDescriptorProto_TYPE_INT32,
+		"google.protobuf.UInt32Value": descpb.FieldDescriptorProto_TYPE_UINT32,
+		"google.protobuf.BoolValue":   descpb.FieldDescriptorProto_TYPE_BOOL,
+		"google.protobuf.StringValue": descpb.FieldDescriptorProto_TYPE_STRING,
+		"google.protobuf.BytesValue":  descpb.FieldDescriptorProto_TYPE_BYTES,
+	}
+)
+
+const (
+	timestampType = "google.protobuf.Timestamp"
+	durationType  = "google.protobuf.Duration"
+)
+
+// encode JSON object v into protobuf wire format of message msgName
+func (reg *registry) encode(msgName string, v map[string]interface{}) ([]byte, error) {
+	md, ok := reg.messages[msgName]
+	if !ok {
+		return nil, fmt.Errorf("unknown message: %s", msgName)
+	}
+
+	var buf []byte
+	for key, value := range v {
+		f, ok := md.byName[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s of message %s", key, msgName)
+		}
+		if value == nil {
+			continue
+		}
+		var err error
+		if buf, err = reg.encodeField(buf, f, value); err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+	}
+	return buf, nil
+}
+
+func (reg *registry) encodeField(buf []byte, f *descpb.FieldDescriptorProto, value interface{}) ([]byte, error) {
+	var err error
+	num := uint64(f.GetNumber())
+
+	// map field
+	if entry, ok := reg.mapEntry(f); ok {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("map value must be an object")
+		}
+		keyField, valField := entry.byNumber[1], entry.byNumber[2]
+		for k, v := range obj {
+			var b []byte
+			if b, err = reg.encodeField(nil, keyField, k); err != nil {
+				return nil, err
+			}
+			if b, err = reg.encodeField(b, valField, v); err != nil {
+				return nil, err
+			}
+			buf = appendTag(buf, num, wireBytes)
+			buf = appendBytes(buf, b)
+		}
+		return buf, nil
+	}
+
+	if f.GetLabel() != descpb.FieldDescriptorProto_LABEL_REPEATED {
+		return reg.encodeSingle(buf, f, value, true)
+	}
+
+	// repeated field, single value is also accepted (from query parameters)
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	if !packable(f.GetType()) {
+		for _, v := range values {
+			if buf, err = reg.encodeSingle(buf, f, v, true); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	var packed []byte
+	for _, v := range values {
+		if packed, err = reg.encodeSingle(packed, f, v, false); err != nil {
+			return nil, err
+		}
+	}
+	buf = appendTag(buf, num, wireBytes)
+	return appendBytes(buf, packed), nil
+}
+
+// encodeSingle encode a single value of field, tag is omitted if withTag is false
+func (reg *registry) encodeSingle(buf []byte, f *descpb.FieldDescriptorProto,
+	value interface{}, withTag bool) ([]byte, error) {
+	num := uint64(f.GetNumber())
+	tag := func(wt uint64) {
+		if withTag {
+			buf = appendTag(buf, num, wt)
+		}
+	}
+
+	switch f.GetType() {
+	case descpb.FieldDescriptorProto_TYPE_DOUBLE:
+		v, err := toFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed64)
+		buf = appendFixed64(buf, math.Float64bits(v))
+	case descpb.FieldDescriptorProto_TYPE_FLOAT:
+		v, err := toFloat(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed32)
+		buf = appendFixed32(buf, math.Float32bits(float32(v)))
+	case descpb.FieldDescriptorProto_TYPE_INT64, descpb.FieldDescriptorProto_TYPE_INT32:
+		v, err := toInt(value, bitSize(f.GetType()))
+		if err != nil {
+			return nil, err
+		}
+		tag(wireVarint)
+		buf = appendVarint(buf, uint64(v))
+	case descpb.FieldDescriptorProto_TYPE_UINT64, descpb.FieldDescriptorProto_TYPE_UINT32:
+		v, err := toUint(value, bitSize(f.GetType()))
+		if err != nil {
+			return nil, err
+		}
+		tag(wireVarint)
+		buf = appendVarint(buf, v)
+	case descpb.FieldDescriptorProto_TYPE_SINT64, descpb.FieldDescriptorProto_TYPE_SINT32:
+		v, err := toInt(value, bitSize(f.GetType()))
+		if err != nil {
+			return nil, err
+		}
+		tag(wireVarint)
+		buf = appendVarint(buf, uint64(v<<1)^uint64(v>>63))
+	case descpb.FieldDescriptorProto_TYPE_FIXED64:
+		v, err := toUint(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed64)
+		buf = appendFixed64(buf, v)
+	case descpb.FieldDescriptorProto_TYPE_SFIXED64:
+		v, err := toInt(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed64)
+		buf = appendFixed64(buf, uint64(v))
+	case descpb.FieldDescriptorProto_TYPE_FIXED32:
+		v, err := toUint(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed32)
+		buf = appendFixed32(buf, uint32(v))
+	case descpb.FieldDescriptorProto_TYPE_SFIXED32:
+		v, err := toInt(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireFixed32)
+		buf = appendFixed32(buf, uint32(v))
+	case descpb.FieldDescriptorProto_TYPE_BOOL:
+		v, err := toBool(value)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireVarint)
+		if v {
+			buf = appendVarint(buf, 1)
+		} else {
+			buf = appendVarint(buf, 0)
+		}
+	case descpb.FieldDescriptorProto_TYPE_ENUM:
+		v, err := reg.toEnum(f.GetTypeName(), value)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireVarint)
+		buf = appendVarint(buf, uint64(v))
+	case descpb.FieldDescriptorProto_TYPE_STRING:
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid string: %v", value)
+		}
+		tag(wireBytes)
+		buf = appendBytes(buf, []byte(v))
+	case descpb.FieldDescriptorProto_TYPE_BYTES:
+		v, err := toBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireBytes)
+		buf = appendBytes(buf, v)
+	case descpb.FieldDescriptorProto_TYPE_MESSAGE:
+		b, err := reg.encodeMessageValue(strings.TrimPrefix(f.GetTypeName(), "."), value)
+		if err != nil {
+			return nil, err
+		}
+		tag(wireBytes)
+		buf = appendBytes(buf, b)
+	default:
+		return nil, fmt.Errorf("unsupported field type: %s", f.GetType())
+	}
+	return buf, nil
+}
+
+// encodeMessageValue encode value as message, well-known types are
+// encoded with their JSON representation.
+func (reg *registry) encodeMessageValue(msgName string, value interface{}) ([]byte, error) {
+	if typ, ok := wrapperTypes[msgName]; ok {
+		f := &descpb.FieldDescriptorProto{Number: int32Ptr(1), Type: &typ}
+		return reg.encodeSingle(nil, f, value, true)
+	}
+
+	switch msgName {
+	case timestampType:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid timestamp: %v", value)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return encodeSecondsNanos(t.Unix(), int64(t.Nanosecond())), nil
+	case durationType:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid duration: %v", value)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		return encodeSecondsNanos(int64(d/time.Second), int64(d%time.Second)), nil
+	}
+
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("message %s must be an object", msgName)
+	}
+	return reg.encode(msgName, obj)
+}
+
+// decode protobuf wire format data of message msgName into JSON object
+func (reg *registry) decode(msgName string, data []byte, protoNames bool) (map[string]interface{}, error) {
+	md, ok := reg.messages[msgName]
+	if !ok {
+		return nil, fmt.Errorf("unknown message: %s", msgName)
+	}
+
+	out := make(map[string]interface{})
+	for len(data) != 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		data = data[n:]
+		num, wt := int32(tag>>3), tag&7
+
+		raw, rest, err := splitValue(data, wt)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		f, ok := md.byNumber[num]
+		if !ok {
+			// unknown field, skip it
+			continue
+		}
+		key := jsonName(f)
+		if protoNames {
+			key = f.GetName()
+		}
+
+		// map field
+		if entry, ok := reg.mapEntry(f); ok {
+			kv, err := reg.decode(entry.name, raw, protoNames)
+			if err != nil {
+				return nil, err
+			}
+			m, _ := out[key].(map[string]interface{})
+			if m == nil {
+				m = make(map[string]interface{})
+				out[key] = m
+			}
+			m[fmt.Sprint(kv["key"])] = kv["value"]
+			continue
+		}
+
+		if f.GetLabel() != descpb.FieldDescriptorProto_LABEL_REPEATED {
+			if out[key], err = reg.decodeSingle(f, raw, wt, protoNames); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		arr, _ := out[key].([]interface{})
+		if wt == wireBytes && packable(f.GetType()) {
+			// packed repeated field
+			elemWt := packedWireType(f.GetType())
+			for len(raw) != 0 {
+				var elem []byte
+				if elem, raw, err = splitValue(raw, elemWt); err != nil {
+					return nil, err
+				}
+				v, err := reg.decodeSingle(f, elem, elemWt, protoNames)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+		} else {
+			v, err := reg.decodeSingle(f, raw, wt, protoNames)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		out[key] = arr
+	}
+	return out, nil
+}
+
+// decodeSingle decode raw value of field into JSON value
+func (reg *registry) decodeSingle(f *descpb.FieldDescriptorProto, raw []byte,
+	wt uint64, protoNames bool) (interface{}, error) {
+	var x uint64
+	switch wt {
+	case wireVarint:
+		x, _ = binary.Uvarint(raw)
+	case wireFixed64:
+		x = binary.LittleEndian.Uint64(raw)
+	case wireFixed32:
+		x = uint64(binary.LittleEndian.Uint32(raw))
+	}
+
+	switch f.GetType() {
+	case descpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return jsonFloat(math.Float64frombits(x)), nil
+	case descpb.FieldDescriptorProto_TYPE_FLOAT:
+		return jsonFloat(float64(math.Float32frombits(uint32(x)))), nil
+	case descpb.FieldDescriptorProto_TYPE_INT64, descpb.FieldDescriptorProto_TYPE_SFIXED64:
+		// 64-bit integers are represented as string in JSON
+		return strconv.FormatInt(int64(x), 10), nil
+	case descpb.FieldDescriptorProto_TYPE_UINT64, descpb.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.FormatUint(x, 10), nil
+	case descpb.FieldDescriptorProto_TYPE_SINT64:
+		return strconv.FormatInt(int64(x>>1)^-int64(x&1), 10), nil
+	case descpb.FieldDescriptorProto_TYPE_INT32, descpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(x), nil
+	case descpb.FieldDescriptorProto_TYPE_UINT32, descpb.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(x), nil
+	case descpb.FieldDescriptorProto_TYPE_SINT32:
+		return int32(uint32(x>>1) ^ -uint32(x&1)), nil
+	case descpb.FieldDescriptorProto_TYPE_BOOL:
+		return x != 0, nil
+	case descpb.FieldDescriptorProto_TYPE_ENUM:
+		return reg.enumName(f.GetTypeName(), int32(x)), nil
+	case descpb.FieldDescriptorProto_TYPE_STRING:
+		return string(raw), nil
+	case descpb.FieldDescriptorProto_TYPE_BYTES:
+		return base64.StdEncoding.EncodeToString(raw), nil
+	case descpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return reg.decodeMessageValue(strings.TrimPrefix(f.GetTypeName(), "."), raw, protoNames)
+	}
+	return nil, fmt.Errorf("unsupported field type: %s", f.GetType())
+}
+
+func (reg *registry) decodeMessageValue(msgName string, raw []byte, protoNames bool) (interface{}, error) {
+	if typ, ok := wrapperTypes[msgName]; ok {
+		f := &descpb.FieldDescriptorProto{Number: int32Ptr(1), Type: &typ}
+		if len(raw) == 0 {
+			return defaultValue(typ), nil
+		}
+		tag, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		v, _, err := splitValue(raw[n:], tag&7)
+		if err != nil {
+			return nil, err
+		}
+		return reg.decodeSingle(f, v, tag&7, protoNames)
+	}
+
+	switch msgName {
+	case timestampType:
+		sec, nanos, err := decodeSecondsNanos(raw)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(sec, nanos).UTC().Format(time.RFC3339Nano), nil
+	case durationType:
+		sec, nanos, err := decodeSecondsNanos(raw)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.FormatFloat((time.Duration(sec)*time.Second+time.Duration(nanos)).Seconds(),
+			'f', -1, 64) + "s", nil
+	}
+	return reg.decode(msgName, raw, protoNames)
+}
+
+// mapEntry get entry message of field if it's a map field
+func (reg *registry) mapEntry(f *descpb.FieldDescriptorProto) (*messageDesc, bool) {
+	if f.GetType() != descpb.FieldDescriptorProto_TYPE_MESSAGE ||
+		f.GetLabel() != descpb.FieldDescriptorProto_LABEL_REPEATED {
+		return nil, false
+	}
+	md, ok := reg.messages[strings.TrimPrefix(f.GetTypeName(), ".")]
+	if !ok || !md.isMapEntry() {
+		return nil, false
+	}
+	return md, true
+}
+
+func (reg *registry) toEnum(typeName string, value interface{}) (int32, error) {
+	if s, ok := value.(string); ok {
+		if enum, ok := reg.enums[strings.TrimPrefix(typeName, ".")]; ok {
+			for _, ev := range enum.GetValue() {
+				if ev.GetName() == s {
+					return ev.GetNumber(), nil
+				}
+			}
+		}
+	}
+	v, err := toInt(value, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid enum value: %v", value)
+	}
+	return int32(v), nil
+}
+
+func (reg *registry) enumName(typeName string, v int32) interface{} {
+	if enum, ok := reg.enums[strings.TrimPrefix(typeName, ".")]; ok {
+		for _, ev := range enum.GetValue() {
+			if ev.GetNumber() == v {
+				return ev.GetName()
+			}
+		}
+	}
+	return v
+}
+
+// splitValue split the value of wire type wt from data
+func splitValue(data []byte, wt uint64) (value, rest []byte, err error) {
+	switch wt {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, errTruncated
+		}
+		return data[:n], data[n:], nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return nil, nil, errTruncated
+		}
+		return data[:8], data[8:], nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return nil, nil, errTruncated
+		}
+		return data[:4], data[4:], nil
+	case wireBytes:
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, nil, errTruncated
+		}
+		return data[n : n+int(l)], data[n+int(l):], nil
+	}
+	return nil, nil, fmt.Errorf("unsupported wire type: %d", wt)
+}
+
+func packable(typ descpb.FieldDescriptorProto_Type) bool {
+	switch typ {
+	case descpb.FieldDescriptorProto_TYPE_STRING,
+		descpb.FieldDescriptorProto_TYPE_BYTES,
+		descpb.FieldDescriptorProto_TYPE_MESSAGE,
+		descpb.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+func packedWireType(typ descpb.FieldDescriptorProto_Type) uint64 {
+	switch typ {
+	case descpb.FieldDescriptorProto_TYPE_DOUBLE,
+		descpb.FieldDescriptorProto_TYPE_FIXED64,
+		descpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return wireFixed64
+	case descpb.FieldDescriptorProto_TYPE_FLOAT,
+		descpb.FieldDescriptorProto_TYPE_FIXED32,
+		descpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return wireFixed32
+	}
+	return wireVarint
+}
+
+func bitSize(typ descpb.FieldDescriptorProto_Type) int {
+	switch typ {
+	case descpb.FieldDescriptorProto_TYPE_INT32,
+		descpb.FieldDescriptorProto_TYPE_UINT32,
+		descpb.FieldDescriptorProto_TYPE_SINT32:
+		return 32
+	}
+	return 64
+}
+
+func defaultValue(typ descpb.FieldDescriptorProto_Type) interface{} {
+	switch typ {
+	case descpb.FieldDescriptorProto_TYPE_BOOL:
+		return false
+	case descpb.FieldDescriptorProto_TYPE_STRING, descpb.FieldDescriptorProto_TYPE_BYTES:
+		return ""
+	case descpb.FieldDescriptorProto_TYPE_INT64, descpb.FieldDescriptorProto_TYPE_UINT64:
+		return "0"
+	}
+	return 0
+}
+
+func encodeSecondsNanos(sec, nanos int64) []byte {
+	var buf []byte
+	if sec != 0 {
+		buf = appendTag(buf, 1, wireVarint)
+		buf = appendVarint(buf, uint64(sec))
+	}
+	if nanos != 0 {
+		buf = appendTag(buf, 2, wireVarint)
+		buf = appendVarint(buf, uint64(nanos))
+	}
+	return buf
+}
+
+func decodeSecondsNanos(data []byte) (sec, nanos int64, err error) {
+	for len(data) != 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, 0, errTruncated
+		}
+		var raw []byte
+		if raw, data, err = splitValue(data[n:], tag&7); err != nil {
+			return 0, 0, err
+		}
+		x, _ := binary.Uvarint(raw)
+		switch tag >> 3 {
+		case 1:
+			sec = int64(x)
+		case 2:
+			nanos = int64(int32(x))
+		}
+	}
+	return sec, nanos, nil
+}
+
+func appendTag(buf []byte, num, wt uint64) []byte {
+	return appendVarint(buf, num<<3|wt)
+}
+
+func appendVarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendFixed64(buf []byte, x uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], x)
+	return append(buf, tmp[:]...)
+}
+
+func appendFixed32(buf []byte, x uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	return append(buf, tmp[:]...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// toInt convert JSON value (number or string) into int64
+func toInt(value interface{}, bitSize int) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseInt(v.String(), 10, bitSize)
+	case string:
+		return strconv.ParseInt(v, 10, bitSize)
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("invalid integer: %v", value)
+}
+
+// toUint convert JSON value (number or string) into uint64
+func toUint(value interface{}, bitSize int) (uint64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseUint(v.String(), 10, bitSize)
+	case string:
+		return strconv.ParseUint(v, 10, bitSize)
+	case float64:
+		return uint64(v), nil
+	}
+	return 0, fmt.Errorf("invalid unsigned integer: %v", value)
+}
+
+// toFloat convert JSON value (number or string) into float64
+func toFloat(value interface{}, bitSize int) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseFloat(v.String(), bitSize)
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(v, bitSize)
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid number: %v", value)
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("invalid bool: %v", value)
+}
+
+// toBytes decode base64 string in standard or URL-safe encoding
+func toBytes(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid bytes: %v", value)
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// jsonFloat handle NaN and Infinity which could not be marshaled by encoding/json
+func jsonFloat(v float64) interface{} {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return v
+}
+
+func int32Ptr(v int32) *int32 {
+	return &v
+}
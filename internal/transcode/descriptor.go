@@ -0,0 +1,157 @@
+package transcode
+
+import (
+	"sort"
+	"strings"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// methodDesc describe a gRPC method
+type methodDesc struct {
+	service   string // fully-qualified service name, like "pkg.Service"
+	fullName  string // like "pkg.Service/Method"
+	input     string // fully-qualified input message name
+	output    string // fully-qualified output message name
+	opts      *descpb.MethodOptions
+	streaming bool
+}
+
+// messageDesc describe a message with fields indexed
+type messageDesc struct {
+	name     string
+	desc     *descpb.DescriptorProto
+	byName   map[string]*descpb.FieldDescriptorProto // by both proto name and json name
+	byNumber map[int32]*descpb.FieldDescriptorProto
+}
+
+// registry index messages, enums and methods from FileDescriptorSet
+type registry struct {
+	messages map[string]*messageDesc
+	enums    map[string]*descpb.EnumDescriptorProto
+	methods  map[string]*methodDesc
+}
+
+func newRegistry(fds *descpb.FileDescriptorSet) *registry {
+	reg := &registry{
+		messages: make(map[string]*messageDesc),
+		enums:    make(map[string]*descpb.EnumDescriptorProto),
+		methods:  make(map[string]*methodDesc),
+	}
+
+	for _, fd := range fds.GetFile() {
+		prefix := fd.GetPackage()
+		for _, msg := range fd.GetMessageType() {
+			reg.addMessage(prefix, msg)
+		}
+		for _, enum := range fd.GetEnumType() {
+			reg.enums[qualify(prefix, enum.GetName())] = enum
+		}
+		for _, srv := range fd.GetService() {
+			srvName := qualify(prefix, srv.GetName())
+			for _, m := range srv.GetMethod() {
+				md := &methodDesc{
+					service:   srvName,
+					fullName:  srvName + "/" + m.GetName(),
+					input:     strings.TrimPrefix(m.GetInputType(), "."),
+					output:    strings.TrimPrefix(m.GetOutputType(), "."),
+					opts:      m.GetOptions(),
+					streaming: m.GetClientStreaming() || m.GetServerStreaming(),
+				}
+				reg.methods[md.fullName] = md
+			}
+		}
+	}
+	return reg
+}
+
+func (reg *registry) addMessage(prefix string, msg *descpb.DescriptorProto) {
+	name := qualify(prefix, msg.GetName())
+	md := &messageDesc{
+		name:     name,
+		desc:     msg,
+		byName:   make(map[string]*descpb.FieldDescriptorProto),
+		byNumber: make(map[int32]*descpb.FieldDescriptorProto),
+	}
+	for _, f := range msg.GetField() {
+		md.byName[f.GetName()] = f
+		md.byName[jsonName(f)] = f
+		md.byNumber[f.GetNumber()] = f
+	}
+	reg.messages[name] = md
+
+	for _, nested := range msg.GetNestedType() {
+		reg.addMessage(name, nested)
+	}
+	for _, enum := range msg.GetEnumType() {
+		reg.enums[qualify(name, enum.GetName())] = enum
+	}
+}
+
+// lookupMethod with name like "pkg.Service/Method", "/pkg.Service/Method"
+// or "pkg.Service.Method"
+func (reg *registry) lookupMethod(name string) (*methodDesc, bool) {
+	name = strings.TrimPrefix(name, "/")
+	if !strings.Contains(name, "/") {
+		if idx := strings.LastIndex(name, "."); idx != -1 {
+			name = name[:idx] + "/" + name[idx+1:]
+		}
+	}
+	md, ok := reg.methods[name]
+	return md, ok
+}
+
+// sortedMethods get all methods sorted by name, to keep bindings in stable order
+func (reg *registry) sortedMethods() []*methodDesc {
+	names := make([]string, 0, len(reg.methods))
+	for name := range reg.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	methods := make([]*methodDesc, 0, len(names))
+	for _, name := range names {
+		methods = append(methods, reg.methods[name])
+	}
+	return methods
+}
+
+func (md *messageDesc) isMapEntry() bool {
+	return md.desc.GetOptions().GetMapEntry()
+}
+
+func qualify(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// jsonName of field, protoc always fill json_name in descriptor set,
+// but fallback to lowerCamelCase anyway.
+func jsonName(f *descpb.FieldDescriptorProto) string {
+	if f.GetJsonName() != "" {
+		return f.GetJsonName()
+	}
+	return jsonCamelCase(f.GetName())
+}
+
+// jsonCamelCase convert "foo_bar" into "fooBar"
+func jsonCamelCase(name string) string {
+	var (
+		b     strings.Builder
+		upper bool
+	)
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		upper = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+package transcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// segment kinds of path template
+const (
+	segLiteral = iota
+	segSingle  // "*" match exactly one segment
+	segMulti   // "**" match zero or more segments
+)
+
+type segment struct {
+	kind    int
+	literal string
+}
+
+// variable capture segments [start, end) of template into field
+type variable struct {
+	field      string
+	start, end int
+}
+
+// pathTemplate of `google.api.http`, syntax:
+//
+//	Template = "/" Segments [ Verb ] ;
+//	Segments = Segment { "/" Segment } ;
+//	Segment  = "*" | "**" | LITERAL | Variable ;
+//	Variable = "{" FieldPath [ "=" Segments ] "}" ;
+//	Verb     = ":" LITERAL ;
+type pathTemplate struct {
+	segments []segment
+	vars     []variable
+	verb     string
+}
+
+func parseTemplate(tmpl string) (*pathTemplate, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, fmt.Errorf("path template must start with '/': %s", tmpl)
+	}
+	t := new(pathTemplate)
+	s := tmpl[1:]
+
+	// verb is after the last ':' which is out of any variable
+	if idx := strings.LastIndex(s, ":"); idx != -1 && idx > strings.LastIndex(s, "}") &&
+		idx > strings.LastIndex(s, "/") {
+		t.verb = s[idx+1:]
+		s = s[:idx]
+	}
+
+	for len(s) != 0 {
+		var token string
+		if s[0] == '{' {
+			end := strings.IndexByte(s, '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed variable in path template: %s", tmpl)
+			}
+			token, s = s[:end+1], s[end+1:]
+			if err := t.addVariable(token[1 : len(token)-1]); err != nil {
+				return nil, fmt.Errorf("%v in path template: %s", err, tmpl)
+			}
+		} else {
+			end := strings.IndexByte(s, '/')
+			if end == -1 {
+				end = len(s)
+			}
+			token, s = s[:end], s[end:]
+			t.segments = append(t.segments, parseSegment(token))
+		}
+
+		if len(s) != 0 {
+			if s[0] != '/' {
+				return nil, fmt.Errorf("invalid path template: %s", tmpl)
+			}
+			s = s[1:]
+		}
+	}
+
+	for i, seg := range t.segments {
+		if seg.kind == segMulti && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("'**' must be the last segment in path template: %s", tmpl)
+		}
+	}
+	return t, nil
+}
+
+func (t *pathTemplate) addVariable(v string) error {
+	field, pattern := v, "*"
+	if idx := strings.IndexByte(v, '='); idx != -1 {
+		field, pattern = v[:idx], v[idx+1:]
+	}
+	if field == "" || pattern == "" {
+		return fmt.Errorf("invalid variable {%s}", v)
+	}
+
+	start := len(t.segments)
+	for _, token := range strings.Split(pattern, "/") {
+		t.segments = append(t.segments, parseSegment(token))
+	}
+	t.vars = append(t.vars, variable{field: field, start: start, end: len(t.segments)})
+	return nil
+}
+
+func parseSegment(token string) segment {
+	switch token {
+	case "*":
+		return segment{kind: segSingle}
+	case "**":
+		return segment{kind: segMulti}
+	}
+	return segment{kind: segLiteral, literal: token}
+}
+
+// match path with template, and returns the captured variables
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = strings.TrimSuffix(path, ":"+t.verb)
+	}
+
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	// bounds[i] is the range of parts matched by t.segments[i]
+	bounds := make([][2]int, len(t.segments))
+	pos := 0
+	for i, seg := range t.segments {
+		switch seg.kind {
+		case segMulti:
+			bounds[i] = [2]int{pos, len(parts)}
+			pos = len(parts)
+			continue
+		case segLiteral:
+			if pos >= len(parts) || parts[pos] != seg.literal {
+				return nil, false
+			}
+		case segSingle:
+			if pos >= len(parts) || parts[pos] == "" {
+				return nil, false
+			}
+		}
+		bounds[i] = [2]int{pos, pos + 1}
+		pos++
+	}
+	if pos != len(parts) {
+		return nil, false
+	}
+
+	vars := make(map[string]string, len(t.vars))
+	for _, v := range t.vars {
+		vars[v.field] = strings.Join(parts[bounds[v.start][0]:bounds[v.end-1][1]], "/")
+	}
+	return vars, true
+}
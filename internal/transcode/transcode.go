@@ -0,0 +1,501 @@
+// Package transcode translate REST/JSON request into gRPC call with
+// compiled protobuf descriptor set, and convert the response back to JSON.
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/api-proxier/internal/netaddr"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrNoDescriptor neither descriptor_set nor descriptor_file set
+	ErrNoDescriptor = errors.New("no descriptor set specified")
+	// ErrNoBinding no method could be bound to http
+	ErrNoBinding = errors.New("no method bound to http")
+
+	// default timeout of gRPC call, default is 5 second
+	defaultCallTimeout = 5 * time.Second
+)
+
+// Rule of transcoding, to expose gRPC methods of target cluster as REST/JSON
+type Rule struct {
+	Idx             string `json:"idx"`
+	TargetClusterID string `json:"target_cluster_id"`
+	// DescriptorSet base64 encoded FileDescriptorSet, generated by
+	// `protoc --include_imports --descriptor_set_out`
+	DescriptorSet string `json:"descriptor_set"`
+	// DescriptorFile path to FileDescriptorSet file, used if DescriptorSet is empty
+	DescriptorFile string `json:"descriptor_file"`
+	// Services limit services (fully-qualified) to bind by `google.api.http`
+	// annotations, empty means all services in descriptor set
+	Services []string `json:"services"`
+	// Methods explicit method mapping, matched before the annotations
+	Methods []*MethodMapping `json:"methods"`
+	// ForwardHeaders http headers to forward as gRPC metadata
+	ForwardHeaders []string `json:"forward_headers"`
+	// UseProtoNames to output response with proto field name rather than json name
+	UseProtoNames bool `json:"use_proto_names"`
+	// Timeout of gRPC call in millisecond
+	Timeout int `json:"timeout"`
+}
+
+// MethodMapping bind a gRPC method to http method and path template
+type MethodMapping struct {
+	// Method fully-qualified gRPC method, like "pkg.Service/Method"
+	Method     string `json:"method"`
+	HTTPMethod string `json:"http_method"`
+	// Path template in syntax of `google.api.http`, like "/v1/books/{id}"
+	Path         string `json:"path"`
+	Body         string `json:"body"`
+	ResponseBody string `json:"response_body"`
+}
+
+// Binding is a gRPC method bound to http method and path template
+type Binding struct {
+	method       *methodDesc
+	httpMethod   string
+	tmpl         *pathTemplate
+	body         string
+	responseBody string
+}
+
+// Method get fully-qualified gRPC method name of binding
+func (b *Binding) Method() string {
+	return b.method.fullName
+}
+
+// New Transcoder with rule
+func New(rule *Rule) (*Transcoder, error) {
+	byts, err := loadDescriptorSet(rule)
+	if err != nil {
+		return nil, err
+	}
+	fds := new(descpb.FileDescriptorSet)
+	if err = proto.Unmarshal(byts, fds); err != nil {
+		return nil, err
+	}
+
+	t := &Transcoder{
+		rule:  rule,
+		reg:   newRegistry(fds),
+		conns: make(map[string]*grpc.ClientConn),
+	}
+	if err = t.bind(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Transcoder translate http request into gRPC call
+type Transcoder struct {
+	rule     *Rule
+	reg      *registry
+	bindings []*Binding
+
+	mutex   sync.Mutex
+	conns   map[string]*grpc.ClientConn // gRPC client connections by target
+	calls   int                         // calls in flight
+	closing bool                        // connections closed after calls in flight finished
+}
+
+// ClusterID get target cluster id of transcoder
+func (t *Transcoder) ClusterID() string {
+	return t.rule.TargetClusterID
+}
+
+// Match binding with method and path, vars captured from path template
+// would be returned.
+func (t *Transcoder) Match(method, path string) (*Binding, map[string]string, bool) {
+	for _, b := range t.bindings {
+		if b.httpMethod != "*" && !strings.EqualFold(b.httpMethod, method) {
+			continue
+		}
+		if vars, ok := b.tmpl.match(path); ok {
+			return b, vars, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Call translate req into gRPC call to target with binding b,
+// and returns JSON encoded response.
+func (t *Transcoder) Call(target string, b *Binding, vars map[string]string, req *http.Request) ([]byte, error) {
+	t.acquire()
+	defer t.release()
+
+	reqMsg, err := t.requestMessage(b, vars, req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	in, err := t.reg.encode(b.method.input, reqMsg)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	conn, err := t.conn(target)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultCallTimeout
+	if t.rule.Timeout > 0 {
+		timeout = time.Duration(t.rule.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	ctx = t.outgoingMetadata(ctx, req)
+
+	out := new(rawMessage)
+	if err = conn.Invoke(ctx, "/"+b.method.fullName, &rawMessage{data: in}, out,
+		grpc.CallCustomCodec(rawCodec{})); err != nil {
+		return nil, err
+	}
+
+	respMsg, err := t.reg.decode(b.method.output, out.data, t.rule.UseProtoNames)
+	if err != nil {
+		return nil, err
+	}
+	if b.responseBody != "" {
+		return json.Marshal(lookupField(respMsg, b.responseBody, t.rule.UseProtoNames))
+	}
+	return json.Marshal(respMsg)
+}
+
+// Close all gRPC client connections after calls in flight finished. Routes
+// matched before closed could still be called, with connections closed
+// after the call.
+func (t *Transcoder) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closing = true
+	if t.calls == 0 {
+		t.closeConns()
+	}
+}
+
+func (t *Transcoder) acquire() {
+	t.mutex.Lock()
+	t.calls++
+	t.mutex.Unlock()
+}
+
+func (t *Transcoder) release() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.calls--; t.calls == 0 && t.closing {
+		t.closeConns()
+	}
+}
+
+// closeConns close all gRPC client connections, mutex should be held
+func (t *Transcoder) closeConns() {
+	for target, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, target)
+	}
+}
+
+// HTTPStatus convert error returned by Call into http status code
+func HTTPStatus(err error) int {
+	st, ok := status.FromError(err)
+	if !ok {
+		return http.StatusBadGateway
+	}
+	switch st.Code() {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorMessage get message of error returned by Call
+func ErrorMessage(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return st.Message()
+	}
+	return err.Error()
+}
+
+// bind methods to http with explicit mapping and `google.api.http` annotations
+func (t *Transcoder) bind() error {
+	for _, m := range t.rule.Methods {
+		md, ok := t.reg.lookupMethod(m.Method)
+		if !ok {
+			return fmt.Errorf("unknown method: %s", m.Method)
+		}
+		if err := t.addBinding(md, m.HTTPMethod, m.Path, m.Body, m.ResponseBody); err != nil {
+			return err
+		}
+	}
+
+	for _, md := range t.reg.sortedMethods() {
+		if len(t.rule.Services) != 0 && !contains(t.rule.Services, md.service) {
+			continue
+		}
+		if md.opts == nil || !proto.HasExtension(md.opts, annotations.E_Http) {
+			continue
+		}
+		v, err := proto.GetExtension(md.opts, annotations.E_Http)
+		if err != nil {
+			return err
+		}
+		if err = t.addHTTPRule(md, v.(*annotations.HttpRule)); err != nil {
+			return err
+		}
+	}
+
+	if len(t.bindings) == 0 {
+		return ErrNoBinding
+	}
+	return nil
+}
+
+func (t *Transcoder) addHTTPRule(md *methodDesc, rule *annotations.HttpRule) error {
+	var method, path string
+	switch {
+	case rule.GetGet() != "":
+		method, path = http.MethodGet, rule.GetGet()
+	case rule.GetPut() != "":
+		method, path = http.MethodPut, rule.GetPut()
+	case rule.GetPost() != "":
+		method, path = http.MethodPost, rule.GetPost()
+	case rule.GetDelete() != "":
+		method, path = http.MethodDelete, rule.GetDelete()
+	case rule.GetPatch() != "":
+		method, path = http.MethodPatch, rule.GetPatch()
+	case rule.GetCustom() != nil:
+		method, path = rule.GetCustom().GetKind(), rule.GetCustom().GetPath()
+	default:
+		return fmt.Errorf("no http pattern of method: %s", md.fullName)
+	}
+
+	if err := t.addBinding(md, method, path, rule.GetBody(), rule.GetResponseBody()); err != nil {
+		return err
+	}
+	for _, additional := range rule.GetAdditionalBindings() {
+		if err := t.addHTTPRule(md, additional); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Transcoder) addBinding(md *methodDesc, method, path, body, respBody string) error {
+	if md.streaming {
+		logger.Logger.Errorf("streaming method %s is not supported to transcode, skipped", md.fullName)
+		return nil
+	}
+	tmpl, err := parseTemplate(path)
+	if err != nil {
+		return err
+	}
+	if method == "" {
+		method = http.MethodPost
+	}
+	t.bindings = append(t.bindings, &Binding{
+		method:       md,
+		httpMethod:   strings.ToUpper(method),
+		tmpl:         tmpl,
+		body:         body,
+		responseBody: respBody,
+	})
+	logger.Logger.Infof("transcode binding: %s %s => %s", method, path, md.fullName)
+	return nil
+}
+
+// requestMessage build the JSON object of request message from
+// body, path vars and query parameters.
+func (t *Transcoder) requestMessage(b *Binding, vars map[string]string,
+	req *http.Request) (map[string]interface{}, error) {
+	msg := make(map[string]interface{})
+
+	if b.body != "" && req.Body != nil {
+		byts, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(byts) != 0 {
+			var v interface{}
+			dec := json.NewDecoder(bytes.NewReader(byts))
+			dec.UseNumber()
+			if err = dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			if b.body == "*" {
+				obj, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, errors.New("request body must be an object")
+				}
+				msg = obj
+			} else {
+				setField(msg, b.body, v)
+			}
+		}
+	}
+
+	// query parameters are mapped only if body is not "*"
+	if b.body != "*" {
+		for key, values := range req.URL.Query() {
+			if len(values) == 1 {
+				setField(msg, key, values[0])
+				continue
+			}
+			arr := make([]interface{}, 0, len(values))
+			for _, value := range values {
+				arr = append(arr, value)
+			}
+			setField(msg, key, arr)
+		}
+	}
+
+	for field, value := range vars {
+		setField(msg, field, value)
+	}
+	return msg, nil
+}
+
+func (t *Transcoder) outgoingMetadata(ctx context.Context, req *http.Request) context.Context {
+	if len(t.rule.ForwardHeaders) == 0 {
+		return ctx
+	}
+	md := metadata.MD{}
+	for _, h := range t.rule.ForwardHeaders {
+		if values := req.Header[http.CanonicalHeaderKey(h)]; len(values) != 0 {
+			md.Append(strings.ToLower(h), values...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// conn get or dial a gRPC client connection to target
+func (t *Transcoder) conn(target string) (*grpc.ClientConn, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if conn, ok := t.conns[target]; ok {
+		return conn, nil
+	}
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	network, addr := netaddr.Parse(target)
+	if network == "unix" {
+		opts = append(opts, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[target] = conn
+	return conn, nil
+}
+
+func loadDescriptorSet(rule *Rule) ([]byte, error) {
+	if rule.DescriptorSet != "" {
+		return base64.StdEncoding.DecodeString(rule.DescriptorSet)
+	}
+	if rule.DescriptorFile != "" {
+		return ioutil.ReadFile(rule.DescriptorFile)
+	}
+	return nil, ErrNoDescriptor
+}
+
+// setField set value into msg with field path like "a.b.c"
+func setField(msg map[string]interface{}, fieldPath string, value interface{}) {
+	names := strings.Split(fieldPath, ".")
+	for _, name := range names[:len(names)-1] {
+		sub, ok := msg[name].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			msg[name] = sub
+		}
+		msg = sub
+	}
+	msg[names[len(names)-1]] = value
+}
+
+// lookupField get value from msg with field path like "a.b.c"
+func lookupField(msg map[string]interface{}, fieldPath string, protoNames bool) interface{} {
+	var v interface{} = msg
+	for _, name := range strings.Split(fieldPath, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if !protoNames {
+			name = jsonCamelCase(name)
+		}
+		v = obj[name]
+	}
+	return v
+}
+
+func contains(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rawMessage hold the encoded protobuf message
+type rawMessage struct {
+	data []byte
+}
+
+// rawCodec pass encoded protobuf message through gRPC
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*rawMessage).data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	v.(*rawMessage).data = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "proto"
+}
@@ -0,0 +1,229 @@
+package transcode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jademperor/api-proxier/internal/logger"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+)
+
+func init() {
+	logger.Init(os.TempDir(), false)
+}
+
+func Test_pathTemplate_match(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		path string
+		ok   bool
+		vars map[string]string
+	}{
+		{"/v1/books/{id}", "/v1/books/42", true, map[string]string{"id": "42"}},
+		{"/v1/books/{id}", "/v1/books/42/pages", false, nil},
+		{"/v1/{name=shelves/*}/books", "/v1/shelves/s1/books", true, map[string]string{"name": "shelves/s1"}},
+		{"/v1/{name=files/**}", "/v1/files/a/b/c", true, map[string]string{"name": "files/a/b/c"}},
+		{"/v1/books/{book.id}:publish", "/v1/books/7:publish", true, map[string]string{"book.id": "7"}},
+		{"/v1/books/{book.id}:publish", "/v1/books/7", false, nil},
+		{"/v1/*/books", "/v1/any/books", true, map[string]string{}},
+	}
+
+	for _, c := range cases {
+		tmpl, err := parseTemplate(c.tmpl)
+		if err != nil {
+			t.Fatalf("parseTemplate(%s) got error: %v", c.tmpl, err)
+		}
+		vars, ok := tmpl.match(c.path)
+		if ok != c.ok {
+			t.Errorf("template %s match %s, want %v, got %v", c.tmpl, c.path, c.ok, ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(vars, c.vars) {
+			t.Errorf("template %s match %s, want vars %v, got %v", c.tmpl, c.path, c.vars, vars)
+		}
+	}
+}
+
+// bookstoreDescriptorSet generate FileDescriptorSet of:
+//
+//	package bookstore;
+//	message GetBookRequest { int64 id = 1; string shelf = 2; }
+//	message Book { int64 id = 1; string title = 2; }
+//	service Bookstore {
+//	  rpc GetBook(GetBookRequest) returns (Book) {
+//	    option (google.api.http) = { get: "/v1/books/{id}" };
+//	  }
+//	}
+func bookstoreDescriptorSet(t *testing.T) string {
+	field := func(name string, num int32, typ descpb.FieldDescriptorProto_Type) *descpb.FieldDescriptorProto {
+		return &descpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(jsonCamelCase(name)),
+			Number:   proto.Int32(num),
+			Label:    descpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+
+	opts := new(descpb.MethodOptions)
+	if err := proto.SetExtension(opts, annotations.E_Http, &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/books/{id}"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	fds := &descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{{
+			Name:    proto.String("bookstore.proto"),
+			Package: proto.String("bookstore"),
+			MessageType: []*descpb.DescriptorProto{{
+				Name: proto.String("GetBookRequest"),
+				Field: []*descpb.FieldDescriptorProto{
+					field("id", 1, descpb.FieldDescriptorProto_TYPE_INT64),
+					field("shelf", 2, descpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			}, {
+				Name: proto.String("Book"),
+				Field: []*descpb.FieldDescriptorProto{
+					field("id", 1, descpb.FieldDescriptorProto_TYPE_INT64),
+					field("title", 2, descpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			}},
+			Service: []*descpb.ServiceDescriptorProto{{
+				Name: proto.String("Bookstore"),
+				Method: []*descpb.MethodDescriptorProto{{
+					Name:       proto.String("GetBook"),
+					InputType:  proto.String(".bookstore.GetBookRequest"),
+					OutputType: proto.String(".bookstore.Book"),
+					Options:    opts,
+				}},
+			}},
+		}},
+	}
+
+	byts, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(byts)
+}
+
+func Test_Transcoder_Call(t *testing.T) {
+	// gRPC server echo the request back, GetBookRequest and Book
+	// share the same wire format
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotMethod string
+	srv := grpc.NewServer(grpc.CustomCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			gotMethod, _ = grpc.MethodFromServerStream(stream)
+			msg := new(rawMessage)
+			if err := stream.RecvMsg(msg); err != nil {
+				return err
+			}
+			return stream.SendMsg(msg)
+		}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	tc, err := New(&Rule{
+		Idx:             "bookstore",
+		TargetClusterID: "cls",
+		DescriptorSet:   bookstoreDescriptorSet(t),
+	})
+	if err != nil {
+		t.Fatalf("New() got error: %v", err)
+	}
+	defer tc.Close()
+
+	binding, vars, ok := tc.Match("GET", "/v1/books/42")
+	if !ok {
+		t.Fatal("could not match GET /v1/books/42")
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/v1/books/42?shelf=fiction", nil)
+	body, err := tc.Call("http://"+lis.Addr().String(), binding, vars, req)
+	if err != nil {
+		t.Fatalf("Call() got error: %v", err)
+	}
+
+	if gotMethod != "/bookstore.Bookstore/GetBook" {
+		t.Errorf("want method /bookstore.Bookstore/GetBook, got %s", gotMethod)
+	}
+	var got map[string]interface{}
+	if err = json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": "42", "title": "fiction"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want response %v, got %v", want, got)
+	}
+}
+
+func Test_Transcoder_Close(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		received = make(chan struct{}, 1)
+		blocked  = make(chan struct{})
+	)
+	srv := grpc.NewServer(grpc.CustomCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			msg := new(rawMessage)
+			if err := stream.RecvMsg(msg); err != nil {
+				return err
+			}
+			received <- struct{}{}
+			<-blocked
+			return stream.SendMsg(msg)
+		}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	tc, err := New(&Rule{
+		Idx:             "bookstore",
+		TargetClusterID: "cls",
+		DescriptorSet:   bookstoreDescriptorSet(t),
+	})
+	if err != nil {
+		t.Fatalf("New() got error: %v", err)
+	}
+	binding, vars, _ := tc.Match("GET", "/v1/books/42")
+	call := func() error {
+		req := httptest.NewRequest("GET", "http://example.com/v1/books/42", nil)
+		_, err := tc.Call("http://"+lis.Addr().String(), binding, vars, req)
+		return err
+	}
+
+	// call in flight is finished after closed
+	done := make(chan error)
+	go func() { done <- call() }()
+	<-received
+	tc.Close()
+	close(blocked)
+	if err := <-done; err != nil {
+		t.Errorf("want call in flight finished, got error: %v", err)
+	}
+
+	// route matched before closed is still called, without leaking
+	if err := call(); err != nil {
+		t.Errorf("want call after closed finished, got error: %v", err)
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if len(tc.conns) != 0 {
+		t.Errorf("want connections closed, got %d", len(tc.conns))
+	}
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	osplugin "plugin"
@@ -12,10 +13,12 @@ import (
 )
 
 var (
-	errInvalidFlag = errors.New("invalid plugin flag: [pluginName:plugin.so:/path/to/config.json]")
+	errInvalidFlag = errors.New("invalid plugin flag: [pluginName:plugin.so:/path/to/config.json], " +
+		"[pluginName:/path/to/config.json] or [pluginName={json config}]")
 )
 
-// Recover func to get panic detail
+// Recover func to get panic detail, only log it. Panics of plugins are
+// recovered by Context with 500 response, so it's not necessary in Handle.
 func Recover(plgName string) {
 	if v := recover(); v != nil {
 		err, ok := v.(error)
@@ -29,17 +32,32 @@ func Recover(plgName string) {
 
 type plgInfo struct {
 	Name    string
-	SoPath  string
+	SoPath  string // empty means a registered plugin
 	CfgData []byte
 }
 
-// InstallExtension get Plugin from ".so" file and init it
+// InstallExtension get Plugin registered with name, or from ".so" file,
+// and init it
 func InstallExtension(plgFlag string) (Plugin, error) {
 	plgInfo, err := parseExtensionFlag(plgFlag)
 	if err != nil {
 		return nil, err
 	}
 
+	if plgInfo.SoPath == "" {
+		factory, ok := Lookup(plgInfo.Name)
+		if !ok {
+			return nil, fmt.Errorf("plugin [%s] not registered, registered: %v",
+				plgInfo.Name, Registered())
+		}
+		plg, err := factory(plgInfo.CfgData)
+		if err != nil {
+			return nil, err
+		}
+		logger.Logger.Infof("registered plugin [%s] created", plgInfo.Name)
+		return plg, nil
+	}
+
 	var (
 		p       *osplugin.Plugin
 		newFunc osplugin.Symbol
@@ -60,26 +78,52 @@ func InstallExtension(plgFlag string) (Plugin, error) {
 	return plg, nil
 }
 
+// LoadExtensionConfig read config data of extension from plgFlag,
+// nil returned if no config file specified.
+func LoadExtensionConfig(plgFlag string) ([]byte, error) {
+	plgInfo, err := parseExtensionFlag(plgFlag)
+	if err != nil {
+		return nil, err
+	}
+	return plgInfo.CfgData, nil
+}
+
+// parseExtensionFlag parse flag like:
+//
+//	"name:plugin.so[:/path/to/config.json]" extension from ".so" file
+//	"name[:/path/to/config.json]" registered plugin with config file
+//	"name={json config}" registered plugin with inline config
 func parseExtensionFlag(plgFlag string) (*plgInfo, error) {
+	if idx := strings.Index(plgFlag, "="); idx > 0 && !strings.Contains(plgFlag[:idx], ":") {
+		return &plgInfo{
+			Name:    plgFlag[:idx],
+			CfgData: []byte(plgFlag[idx+1:]),
+		}, nil
+	}
+
 	pfs := strings.Split(plgFlag, ":")
-	if len(pfs) < 2 || len(pfs) > 3 {
+	if len(pfs) < 1 || len(pfs) > 3 || pfs[0] == "" {
 		return nil, errInvalidFlag
 	}
-	var (
-		data []byte
-		err  error
-	)
+
+	info := &plgInfo{Name: pfs[0]}
+	cfgPath := ""
+	switch {
+	case len(pfs) == 3:
+		info.SoPath, cfgPath = pfs[1], pfs[2]
+	case len(pfs) == 2 && strings.HasSuffix(pfs[1], ".so"):
+		info.SoPath = pfs[1]
+	case len(pfs) == 2:
+		cfgPath = pfs[1]
+	}
 
 	// with config file specified, so load it
-	if len(pfs) == 3 {
-		if data, err = ioutil.ReadFile(pfs[2]); err != nil {
+	if cfgPath != "" {
+		data, err := ioutil.ReadFile(cfgPath)
+		if err != nil {
 			return nil, err
 		}
+		info.CfgData = data
 	}
-
-	return &plgInfo{
-		Name:    pfs[0],
-		SoPath:  pfs[1],
-		CfgData: data,
-	}, nil
+	return info, nil
 }
@@ -0,0 +1,21 @@
+package plugin
+
+import (
+	"encoding/json"
+)
+
+// Config of plugin stored in config source, to enable a registered plugin
+type Config struct {
+	// Name registered name of plugin, like "ratelimit"
+	Name string `json:"name"`
+	// Enabled plugin or not, disabled plugin would be skipped
+	Enabled bool `json:"enabled"`
+	// Order of plugin in the same phase and priority, ascending
+	Order int `json:"order"`
+	// Phase name to override the phase declared by plugin, like "auth"
+	Phase string `json:"phase"`
+	// Priority to override the priority declared by plugin
+	Priority *int `json:"priority"`
+	// Config data passed to factory and Lifecycle of plugin
+	Config json.RawMessage `json:"config"`
+}
@@ -3,9 +3,11 @@ package plugin
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/jademperor/common/pkg/code"
 	"github.com/jademperor/common/pkg/utils"
@@ -34,6 +36,7 @@ func NewContext(w http.ResponseWriter, req *http.Request, plugins []Plugin) *Con
 		Ctx:       req.Context(),
 		Method:    method,
 		Path:      path,
+		ClientIP:  remoteIP(req),
 		Form:      utils.ParseRequestForm(cpyReq),
 		plugins:   plugins,
 		numPlugin: len(plugins),
@@ -53,18 +56,33 @@ type Context struct {
 	Method string
 	// Path means request Path
 	Path string
+	// ClientIP means the real client IP, resolved with trusted proxies
+	ClientIP string
 	// Form includes current http request has been parsed form values
 	Form url.Values
 
 	req *http.Request
 	w   http.ResponseWriter
 
+	route     *Route // route matched before plugins executed
 	plugins   []Plugin
 	pluginIdx int
 	numPlugin int
 
 	aborted bool  // request aborted
 	err     error // error
+
+	kvMutex sync.RWMutex
+	kv      map[string]interface{} // values shared between plugins and proxier
+
+	handling  Plugin     // plugin being handled, which registers finishers
+	finishers []finisher // called after request proxied, see OnFinish
+}
+
+// finisher registered by OnFinish
+type finisher struct {
+	plg Plugin // plugin registered fn, nil if not registered by plugins
+	fn  func()
 }
 
 // Next call next plugin in context, if has beed aborted then just return
@@ -81,12 +99,48 @@ func (c *Context) Next() {
 		return
 	}
 
-	if c.plugins[c.pluginIdx].Enabled() {
-		c.plugins[c.pluginIdx].Handle(c)
+	if plg := c.plugins[c.pluginIdx]; plg.Enabled() {
+		c.handle(plg)
 	}
 	c.Next()
 }
 
+// Route get the matched route, nil if nothing matched
+func (c *Context) Route() *Route {
+	return c.route
+}
+
+// SetRoute set the matched route, should be called before Next
+func (c *Context) SetRoute(route *Route) {
+	c.route = route
+	c.SetValue(KeyRoute, route)
+}
+
+// SetPlugins set plugins to be called by Next, like the plugin chain of
+// matched route, should be called before Next
+func (c *Context) SetPlugins(plugins []Plugin) {
+	c.plugins = plugins
+	c.numPlugin = len(plugins)
+}
+
+// OnFinish register fn to be called after request processed, including
+// proxying to upstream which happens after all plugins returned, so
+// plugins could hold resources for the whole request. Functions are called
+// in reverse order, even if the request is aborted or panicked. Panics of
+// fn are recovered, and count to disable the plugin registered it.
+func (c *Context) OnFinish(fn func()) {
+	c.finishers = append(c.finishers, finisher{plg: c.handling, fn: fn})
+}
+
+// Finish call functions registered by OnFinish, should be called once by
+// the server after request processed
+func (c *Context) Finish() {
+	for i := len(c.finishers) - 1; i >= 0; i-- {
+		c.finish(c.finishers[i])
+	}
+	c.finishers = c.finishers[:0]
+}
+
 // Abort process to stop calling next plugin
 // [TODO](done): ignore response here, should call JSON, or String manually
 func (c *Context) Abort() {
@@ -116,6 +170,11 @@ func (c *Context) Reset() {
 	c.req = nil
 	c.w = nil
 	c.Form = nil
+	c.ClientIP = ""
+	c.route = nil
+	c.handling = nil
+	c.finishers = c.finishers[:0]
+	c.resetValues()
 	c.aborted = false
 	c.err = nil
 	c.pluginIdx = -1
@@ -158,15 +217,24 @@ func (c *Context) JSON(status int, v interface{}) {
 	}
 	c.w.Header().Set("Content-Type", "application/json")
 	c.AbortWithStatus(status)
-	fmt.Fprintf(c.w, string(byts))
+	c.w.Write(byts)
 }
 
 // String ...
 func (c *Context) String(status int, s string) {
 	c.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	c.AbortWithStatus(status)
-	fmt.Fprintf(c.w, s)
+	io.WriteString(c.w, s)
 }
 
 // close only for ContextPool
 func (c *Context) close() {}
+
+// remoteIP get IP of the direct peer, used as ClientIP by default
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -41,6 +41,7 @@ func DefaultFactory(w http.ResponseWriter,
 	req *http.Request, plugins []Plugin) (*Context, error) {
 	var (
 		method, path string
+		clientIP     string
 		cpyReq       *http.Request
 		cCtx         context.Context
 		form         url.Values
@@ -49,6 +50,7 @@ func DefaultFactory(w http.ResponseWriter,
 	if req != nil {
 		method = req.Method
 		path = req.URL.Path
+		clientIP = remoteIP(req)
 		cpyReq = utils.CopyRequest(req)
 		cCtx = req.Context()
 		form = utils.ParseRequestForm(cpyReq)
@@ -62,6 +64,7 @@ func DefaultFactory(w http.ResponseWriter,
 		Ctx:       cCtx,
 		Method:    method,
 		Path:      path,
+		ClientIP:  clientIP,
 		Form:      form,
 		plugins:   plugins,
 		numPlugin: len(plugins),
@@ -89,6 +92,7 @@ func DefaultPreFactory(ctx *Context, w http.ResponseWriter,
 
 	ctx.Method = req.Method
 	ctx.Path = req.URL.Path
+	ctx.ClientIP = remoteIP(req)
 	ctx.Ctx = req.Context()
 
 	cpyReq := utils.CopyRequest(req)
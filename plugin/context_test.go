@@ -32,3 +32,60 @@ func Benchmark_NewContextWithoutPool(b *testing.B) {
 		_ = ctx
 	}
 }
+
+func Test_Context_values(t *testing.T) {
+	pool, err := plugin.NewContextPool(1, 1, plugin.DefaultFactory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	ctx, err := pool.Get(httptest.NewRecorder(), req, plugin.DefaultPreFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.SetValue(plugin.KeyConsumer, "consumer-1")
+	ctx.SetValue("count", 3)
+	ctx.SetValue("admin", true)
+	if got := ctx.GetString(plugin.KeyConsumer); got != "consumer-1" {
+		t.Errorf("want consumer-1, got %q", got)
+	}
+	if got := ctx.GetInt("count"); got != 3 {
+		t.Errorf("want 3, got %d", got)
+	}
+	if got := ctx.GetBool("admin"); !got {
+		t.Error("want admin true")
+	}
+	// mismatched type got zero value
+	if got := ctx.GetString("count"); got != "" {
+		t.Errorf("want empty string, got %q", got)
+	}
+
+	// values are cleared after put back
+	pool.Put(ctx)
+	ctx, _ = pool.Get(httptest.NewRecorder(), req, plugin.DefaultPreFactory)
+	if _, ok := ctx.Value(plugin.KeyConsumer); ok {
+		t.Error("want values cleared after reset")
+	}
+}
+
+func Test_Context_OnFinish(t *testing.T) {
+	ctx := plugin.NewContext(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "http://example.com/foo", nil), nil)
+
+	var called []int
+	for i := 0; i < 3; i++ {
+		i := i
+		ctx.OnFinish(func() { called = append(called, i) })
+	}
+	ctx.Finish()
+	if len(called) != 3 || called[0] != 2 || called[2] != 0 {
+		t.Errorf("want called in reverse order, got %v", called)
+	}
+
+	// called once
+	ctx.Finish()
+	if len(called) != 3 {
+		t.Errorf("want called once, got %v", called)
+	}
+}
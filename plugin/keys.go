@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"time"
+)
+
+// well-known keys of values stored in Context
+const (
+	// KeyConsumer string ID of consumer authenticated by auth plugins
+	KeyConsumer = "plugin.consumer"
+	// KeyClientIP string of the real client IP
+	KeyClientIP = "plugin.client_ip"
+	// KeyRoute *Route matched before plugins executed
+	KeyRoute = "plugin.route"
+	// KeyRequestID string ID of request, from X-Request-Id header or generated
+	KeyRequestID = "plugin.request_id"
+	// KeyClaims map[string]interface{} claims of token verified by auth plugins
+	KeyClaims = "plugin.claims"
+	// KeyPlan string plan of consumer authenticated by auth plugins
+	KeyPlan = "plugin.plan"
+)
+
+// SetValue store v with key in Context, it would be cleared by Reset
+func (c *Context) SetValue(key string, v interface{}) {
+	c.kvMutex.Lock()
+	defer c.kvMutex.Unlock()
+	if c.kv == nil {
+		c.kv = make(map[string]interface{})
+	}
+	c.kv[key] = v
+}
+
+// Value get value stored with key
+func (c *Context) Value(key string) (v interface{}, ok bool) {
+	c.kvMutex.RLock()
+	defer c.kvMutex.RUnlock()
+	v, ok = c.kv[key]
+	return
+}
+
+// DeleteValue delete value stored with key
+func (c *Context) DeleteValue(key string) {
+	c.kvMutex.Lock()
+	defer c.kvMutex.Unlock()
+	delete(c.kv, key)
+}
+
+// GetString get string value of key, empty if not found or not a string
+func (c *Context) GetString(key string) string {
+	v, _ := c.Value(key)
+	s, _ := v.(string)
+	return s
+}
+
+// GetStrings get []string value of key
+func (c *Context) GetStrings(key string) []string {
+	v, _ := c.Value(key)
+	s, _ := v.([]string)
+	return s
+}
+
+// GetInt get int value of key, 0 if not found or not an int
+func (c *Context) GetInt(key string) int {
+	v, _ := c.Value(key)
+	i, _ := v.(int)
+	return i
+}
+
+// GetInt64 get int64 value of key
+func (c *Context) GetInt64(key string) int64 {
+	v, _ := c.Value(key)
+	i, _ := v.(int64)
+	return i
+}
+
+// GetBool get bool value of key, false if not found or not a bool
+func (c *Context) GetBool(key string) bool {
+	v, _ := c.Value(key)
+	b, _ := v.(bool)
+	return b
+}
+
+// GetDuration get time.Duration value of key
+func (c *Context) GetDuration(key string) time.Duration {
+	v, _ := c.Value(key)
+	d, _ := v.(time.Duration)
+	return d
+}
+
+// resetValues clear values but keep the map to reuse
+func (c *Context) resetValues() {
+	c.kvMutex.Lock()
+	defer c.kvMutex.Unlock()
+	for k := range c.kv {
+		delete(c.kv, k)
+	}
+}
@@ -0,0 +1,47 @@
+package plugin
+
+// Lifecycle optional interface of Plugin, detected by type assertion.
+// Engine calls Init before serving, Reload while config changed and Close
+// while shutting down. Status should be Reloading during Reload.
+type Lifecycle interface {
+	// Init plugin with config data, resources like goroutines should be
+	// started here rather than in constructor.
+	Init(cfgData []byte) error
+
+	// Reload plugin with new config data, nil means to keep current config.
+	Reload(cfgData []byte) error
+
+	// Close plugin and release all resources.
+	Close() error
+}
+
+// Init plg with cfgData if plg implements Lifecycle
+func Init(plg Plugin, cfgData []byte) error {
+	if lc, ok := plg.(Lifecycle); ok {
+		return lc.Init(cfgData)
+	}
+	return nil
+}
+
+// Reload plg with cfgData if plg implements Lifecycle
+func Reload(plg Plugin, cfgData []byte) error {
+	if lc, ok := plg.(Lifecycle); ok {
+		return lc.Reload(cfgData)
+	}
+	return nil
+}
+
+// Close plg if plg implements Lifecycle
+func Close(plg Plugin) error {
+	if lc, ok := plg.(Lifecycle); ok {
+		return lc.Close()
+	}
+	return nil
+}
+
+// Deriver optional interface of Plugin, to derive a new plugin with config
+// overrides for a route. The derived plugin should be ready to use, and it
+// would be closed by Close while the route config changed.
+type Deriver interface {
+	Derive(cfgData []byte) (Plugin, error)
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+	"github.com/jademperor/common/pkg/code"
+)
+
+var (
+	// panics count by plugin name
+	panicsVar = expvar.NewMap("plugin_panics")
+	// times of plugin disabled for panicking repeatedly by plugin name
+	disabledVar = expvar.NewMap("plugin_panic_disabled")
+
+	guard = &panicGuard{
+		threshold: 5,
+		window:    time.Minute,
+		counts:    make(map[string]*panicCount),
+	}
+)
+
+// SetPanicPolicy plugin panics threshold times in window would be disabled,
+// threshold <= 0 means never. Default is 5 times in a minute.
+func SetPanicPolicy(threshold int, window time.Duration) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.threshold, guard.window = threshold, window
+	guard.counts = make(map[string]*panicCount)
+}
+
+// Recover panic of name like "Proxier", a 500 response would be written
+// and the context aborted. It must be called by defer directly.
+func (c *Context) Recover(name string) {
+	if v := recover(); v != nil {
+		c.panicked(name, v)
+	}
+}
+
+// handle plg with panic recovered, plg panics repeatedly would be disabled
+func (c *Context) handle(plg Plugin) {
+	prev := c.handling
+	c.handling = plg
+	defer func() {
+		c.handling = prev
+		if v := recover(); v != nil {
+			c.panicked(plg.Name(), v)
+			guardPlugin(plg)
+		}
+	}()
+	plg.Handle(c)
+}
+
+// handleResponse call h of plg with panic recovered as error, so the
+// response would be rejected
+func (c *Context) handleResponse(plg Plugin, h ResponseHandler, resp *http.Response) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(plg.Name(), v)
+			guardPlugin(plg)
+			err = fmt.Errorf("%s panic: %v", plg.Name(), v)
+		}
+	}()
+	return h.HandleResponse(c, resp)
+}
+
+// finish call f with panic recovered, the response has been written so
+// only logged
+func (c *Context) finish(f finisher) {
+	defer func() {
+		if v := recover(); v != nil {
+			if f.plg == nil {
+				logPanic("OnFinish", v)
+				return
+			}
+			logPanic(f.plg.Name(), v)
+			guardPlugin(f.plg)
+		}
+	}()
+	f.fn()
+}
+
+func (c *Context) panicked(name string, v interface{}) {
+	logPanic(name, v)
+	c.err = fmt.Errorf("%s panic: %v", name, v)
+	c.JSON(http.StatusInternalServerError,
+		code.NewCodeInfo(code.CodeSystemErr, http.StatusText(http.StatusInternalServerError)))
+}
+
+func logPanic(name string, v interface{}) {
+	panicsVar.Add(name, 1)
+	logger.Logger.Errorf("%s panic: %v\n stack %s", name, v, debug.Stack())
+}
+
+// guardPlugin record a panic of plg, and disable it if panics repeatedly
+func guardPlugin(plg Plugin) {
+	if guard.record(plg.Name()) {
+		plg.Enable(false)
+		disabledVar.Add(plg.Name(), 1)
+		logger.Logger.Errorf("plugin [%s] panics repeatedly, disable it", plg.Name())
+	}
+}
+
+// panicGuard count panics of plugins in window
+type panicGuard struct {
+	mutex     sync.Mutex
+	threshold int
+	window    time.Duration
+	counts    map[string]*panicCount
+}
+
+type panicCount struct {
+	start time.Time // start of window
+	count int
+}
+
+// record a panic of plugin name, returns true if it reaches threshold
+func (g *panicGuard) record(name string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.threshold <= 0 {
+		return false
+	}
+	now := time.Now()
+	pc, ok := g.counts[name]
+	if !ok || now.Sub(pc.start) > g.window {
+		pc = &panicCount{start: now}
+		g.counts[name] = pc
+	}
+	pc.count++
+	if pc.count >= g.threshold {
+		delete(g.counts, name)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package plugin_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+type panicPlugin struct {
+	headerPlugin
+}
+
+func (p *panicPlugin) Handle(ctx *plugin.Context) { panic("boom") }
+
+type countPlugin struct {
+	headerPlugin
+	count int
+}
+
+func (p *countPlugin) Handle(ctx *plugin.Context) { p.count++; ctx.Next() }
+
+func Test_Context_panic(t *testing.T) {
+	plugin.SetPanicPolicy(2, time.Minute)
+	defer plugin.SetPanicPolicy(5, time.Minute)
+
+	var (
+		bad  = &panicPlugin{headerPlugin{name: "panic-test", enabled: true}}
+		next = &countPlugin{headerPlugin: headerPlugin{name: "next", enabled: true}}
+	)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		w := httptest.NewRecorder()
+		ctx := plugin.NewContext(w, req, []plugin.Plugin{bad, next})
+		ctx.Next()
+		return w
+	}
+
+	w := serve()
+	if w.Code != http.StatusInternalServerError || next.count != 0 {
+		t.Errorf("want 500 and next plugin not called, got %d %d", w.Code, next.count)
+	}
+	if !bad.Enabled() {
+		t.Error("want plugin still enabled after first panic")
+	}
+
+	serve()
+	if bad.Enabled() {
+		t.Error("want plugin disabled after panicking repeatedly")
+	}
+	if got := expvar.Get("plugin_panics").(*expvar.Map).Get("panic-test").String(); got != "2" {
+		t.Errorf("want 2 panics recorded, got %s", got)
+	}
+
+	// disabled plugin is skipped
+	if w = serve(); w.Code != http.StatusOK || next.count != 1 {
+		t.Errorf("want 200 and next plugin called, got %d %d", w.Code, next.count)
+	}
+}
+
+// hookPanicPlugin panics in response phase, and in function registered
+// by OnFinish
+type hookPanicPlugin struct {
+	headerPlugin
+}
+
+func (p *hookPanicPlugin) Handle(ctx *plugin.Context) {
+	ctx.OnFinish(func() { panic("finish boom") })
+	ctx.Next()
+}
+
+func (p *hookPanicPlugin) HandleResponse(ctx *plugin.Context, resp *http.Response) error {
+	panic("response boom")
+}
+
+func Test_Context_panicHooks(t *testing.T) {
+	plugin.SetPanicPolicy(4, time.Minute)
+	defer plugin.SetPanicPolicy(5, time.Minute)
+
+	var (
+		bad      = &hookPanicPlugin{headerPlugin{name: "hook-panic-test", enabled: true}}
+		finished int
+	)
+	serve := func() error {
+		req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		ctx := plugin.NewContext(httptest.NewRecorder(), req, []plugin.Plugin{bad})
+		ctx.OnFinish(func() { finished++ })
+		ctx.Next()
+		err := ctx.HandleResponse(&http.Response{Header: make(http.Header)})
+		ctx.Finish()
+		return err
+	}
+
+	if err := serve(); err == nil {
+		t.Error("want panic in response phase returned as error")
+	}
+	if finished != 1 {
+		t.Errorf("want functions registered before called after panic, got %d", finished)
+	}
+	if !bad.Enabled() {
+		t.Error("want plugin still enabled after first panics")
+	}
+
+	// panics in response phase and OnFinish count
+	serve()
+	if bad.Enabled() {
+		t.Error("want plugin disabled after panicking repeatedly")
+	}
+	if got := expvar.Get("plugin_panics").(*expvar.Map).Get("hook-panic-test").String(); got != "4" {
+		t.Errorf("want 4 panics recorded, got %s", got)
+	}
+}
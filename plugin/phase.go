@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Phase of plugin in chain, plugins run in order of phase ascending, then
+// priority descending.
+type Phase int
+
+// phases of plugin, log phase is the outermost one, so it could observe
+// requests aborted by plugins of later phases.
+const (
+	PhaseLog       Phase = 100
+	PhasePreAuth   Phase = 200
+	PhaseAuth      Phase = 300
+	PhaseRateLimit Phase = 400
+	PhaseTransform Phase = 500
+
+	// DefaultPhase of plugin not implements Phaser, after auth and rate
+	// limit, so extensions would not run before authentication by accident
+	DefaultPhase = PhaseTransform
+)
+
+var phaseNames = map[Phase]string{
+	PhaseLog:       "log",
+	PhasePreAuth:   "pre-auth",
+	PhaseAuth:      "auth",
+	PhaseRateLimit: "rate-limit",
+	PhaseTransform: "transform",
+}
+
+func (p Phase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// ParsePhase parse phase from name like "auth"
+func ParsePhase(name string) (Phase, error) {
+	for phase, n := range phaseNames {
+		if n == name {
+			return phase, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown plugin phase: %s", name)
+}
+
+// Phaser optional interface of Plugin, to declare phase and priority,
+// plugin with higher priority runs earlier in the same phase.
+type Phaser interface {
+	Phase() Phase
+	Priority() int
+}
+
+// PhaseOf get phase and priority of plg, DefaultPhase and 0 if plg not
+// implements Phaser.
+func PhaseOf(plg Plugin) (Phase, int) {
+	if p, ok := plg.(Phaser); ok {
+		return p.Phase(), p.Priority()
+	}
+	return DefaultPhase, 0
+}
+
+// SortPlugins sort plugins stably by phase and priority got from order,
+// PhaseOf is used if order is nil.
+func SortPlugins(plugins []Plugin, order func(Plugin) (Phase, int)) {
+	if order == nil {
+		order = PhaseOf
+	}
+	type item struct {
+		plg      Plugin
+		phase    Phase
+		priority int
+	}
+	items := make([]item, len(plugins))
+	for i, plg := range plugins {
+		phase, priority := order(plg)
+		items[i] = item{plg, phase, priority}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].phase != items[j].phase {
+			return items[i].phase < items[j].phase
+		}
+		return items[i].priority > items[j].priority
+	})
+	for i := range items {
+		plugins[i] = items[i].plg
+	}
+}
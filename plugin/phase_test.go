@@ -0,0 +1,50 @@
+package plugin_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+type phasePlugin struct {
+	headerPlugin
+	phase    plugin.Phase
+	priority int
+}
+
+func (p *phasePlugin) Phase() plugin.Phase { return p.phase }
+func (p *phasePlugin) Priority() int       { return p.priority }
+
+func Test_SortPlugins(t *testing.T) {
+	plugins := []plugin.Plugin{
+		&headerPlugin{name: "extension"},
+		&phasePlugin{headerPlugin{name: "limit"}, plugin.PhaseRateLimit, 0},
+		&phasePlugin{headerPlugin{name: "jwt"}, plugin.PhaseAuth, 10},
+		&phasePlugin{headerPlugin{name: "log"}, plugin.PhaseLog, 0},
+		&phasePlugin{headerPlugin{name: "apikey"}, plugin.PhaseAuth, 20},
+		&phasePlugin{headerPlugin{name: "cors"}, plugin.PhasePreAuth, 0},
+	}
+	plugin.SortPlugins(plugins, nil)
+
+	var names []string
+	for _, plg := range plugins {
+		names = append(names, plg.Name())
+	}
+	want := "[log cors apikey jwt limit extension]"
+	if got := fmt.Sprint(names); got != want {
+		t.Errorf("want order %s, got %s", want, got)
+	}
+}
+
+func Test_ParsePhase(t *testing.T) {
+	for _, phase := range []plugin.Phase{plugin.PhaseLog, plugin.PhasePreAuth,
+		plugin.PhaseAuth, plugin.PhaseRateLimit, plugin.PhaseTransform} {
+		if got, err := plugin.ParsePhase(phase.String()); err != nil || got != phase {
+			t.Errorf("want phase %s, got %s %v", phase, got, err)
+		}
+	}
+	if _, err := plugin.ParsePhase("unknown"); err == nil {
+		t.Error("want error of unknown phase")
+	}
+}
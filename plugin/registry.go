@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"sort"
+	"sync"
+)
+
+// Factory create a Plugin with config data, cfgData is nil if not specified
+type Factory func(cfgData []byte) (Plugin, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register factory of plugin with name, it should be called in init() of
+// plugin package, so custom binaries could link plugins statically.
+// Register panics if name is duplicated or factory is nil.
+func Register(name string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("plugin: Register factory is nil: " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("plugin: Register called twice for plugin " + name)
+	}
+	registry[name] = factory
+}
+
+// Lookup factory registered with name
+func Lookup(name string) (Factory, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+// Registered get sorted names of registered plugins
+func Registered() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
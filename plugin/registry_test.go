@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jademperor/api-proxier/internal/logger"
+)
+
+type registeredPlugin struct {
+	cfg string
+}
+
+func (p *registeredPlugin) Handle(ctx *Context) { ctx.Next() }
+func (p *registeredPlugin) Status() PlgStatus   { return Working }
+func (p *registeredPlugin) Enabled() bool       { return true }
+func (p *registeredPlugin) Name() string        { return "registered" }
+func (p *registeredPlugin) Enable(enabled bool) {}
+
+func init() {
+	logger.Init(os.TempDir(), false)
+	Register("registered", func(cfgData []byte) (Plugin, error) {
+		return &registeredPlugin{cfg: string(cfgData)}, nil
+	})
+}
+
+func Test_parseExtensionFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgPath := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(cfgPath, []byte(`{"file":true}`), 0644)
+
+	cases := []struct {
+		flag       string
+		wantName   string
+		wantSoPath string
+		wantCfg    string
+	}{
+		{"ext:ext.so", "ext", "ext.so", ""},
+		{"ext:ext.so:" + cfgPath, "ext", "ext.so", `{"file":true}`},
+		{"registered", "registered", "", ""},
+		{"registered:" + cfgPath, "registered", "", `{"file":true}`},
+		{`registered={"url":"http://127.0.0.1:8080"}`, "registered", "", `{"url":"http://127.0.0.1:8080"}`},
+	}
+	for _, c := range cases {
+		info, err := parseExtensionFlag(c.flag)
+		if err != nil {
+			t.Errorf("%s: got error: %v", c.flag, err)
+			continue
+		}
+		if info.Name != c.wantName || info.SoPath != c.wantSoPath || string(info.CfgData) != c.wantCfg {
+			t.Errorf("%s: want %s %s %s, got %s %s %s", c.flag, c.wantName, c.wantSoPath, c.wantCfg,
+				info.Name, info.SoPath, info.CfgData)
+		}
+	}
+
+	if _, err := parseExtensionFlag("a:b:c:d"); err != errInvalidFlag {
+		t.Errorf("want error %v, got %v", errInvalidFlag, err)
+	}
+}
+
+func Test_InstallExtension_registered(t *testing.T) {
+	plg, err := InstallExtension(`registered={"k":"v"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plg.(*registeredPlugin).cfg; got != `{"k":"v"}` {
+		t.Errorf("want config passed to factory, got %q", got)
+	}
+
+	if _, err = InstallExtension("unknown"); err == nil {
+		t.Error("want error of unregistered plugin")
+	}
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// ErrBodyTooLarge body is larger than the limit to buffer
+	ErrBodyTooLarge = errors.New("plugin: response body too large")
+)
+
+// ResponseHandler optional interface of Plugin, to inspect and modify
+// upstream response before it's written to client, including transcoded
+// gRPC and combined responses. Any error returned would abort the response
+// with 502 Bad Gateway, which is not counted as failure of upstream.
+type ResponseHandler interface {
+	HandleResponse(ctx *Context, resp *http.Response) error
+}
+
+// HandleResponse call ResponseHandler of enabled plugins in chain with
+// upstream resp, in reverse order like returning from Next. Panics are
+// recovered as error, and count to disable the plugin like in Handle.
+func (c *Context) HandleResponse(resp *http.Response) error {
+	for i := c.numPlugin - 1; i >= 0; i-- {
+		plg := c.plugins[i]
+		if !plg.Enabled() {
+			continue
+		}
+		if h, ok := plg.(ResponseHandler); ok {
+			if err := c.handleResponse(plg, h, resp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BufferBody read body of resp into memory and replace it with a reader
+// of the buffered data, so it could be read again. If the body is larger
+// than limit (<= 0 means unlimited), ErrBodyTooLarge returned and the body
+// is still readable as is. Notice that the body may be compressed as
+// Content-Encoding of resp.
+func BufferBody(resp *http.Response, limit int64) ([]byte, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil, nil
+	}
+
+	var (
+		body []byte
+		err  error
+	)
+	if limit <= 0 {
+		body, err = ioutil.ReadAll(resp.Body)
+	} else {
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err == nil && int64(len(body)) > limit {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil, ErrBodyTooLarge
+		}
+	}
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SetBody replace body of resp with body, and Content-Length is updated
+func SetBody(resp *http.Response, body []byte) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,73 @@
+package plugin_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jademperor/api-proxier/plugin"
+)
+
+type headerPlugin struct {
+	name    string
+	enabled bool
+}
+
+func (p *headerPlugin) Handle(ctx *plugin.Context) { ctx.Next() }
+func (p *headerPlugin) Status() plugin.PlgStatus   { return plugin.Working }
+func (p *headerPlugin) Enabled() bool              { return p.enabled }
+func (p *headerPlugin) Name() string               { return p.name }
+func (p *headerPlugin) Enable(enabled bool)        { p.enabled = enabled }
+
+func (p *headerPlugin) HandleResponse(ctx *plugin.Context, resp *http.Response) error {
+	resp.Header.Add("X-Plugins", p.name)
+	body, err := plugin.BufferBody(resp, 0)
+	if err != nil {
+		return err
+	}
+	plugin.SetBody(resp, []byte(strings.Replace(string(body), "secret", "******", -1)))
+	return nil
+}
+
+func Test_Context_HandleResponse(t *testing.T) {
+	plugins := []plugin.Plugin{
+		&headerPlugin{name: "first", enabled: true},
+		&headerPlugin{name: "disabled", enabled: false},
+		&headerPlugin{name: "second", enabled: true},
+	}
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	ctx := plugin.NewContext(httptest.NewRecorder(), req, plugins)
+
+	resp := &http.Response{
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(strings.NewReader("token: secret")),
+	}
+	if err := ctx.HandleResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resp.Header["X-Plugins"]; len(got) != 2 || got[0] != "second" || got[1] != "first" {
+		t.Errorf("want response handled by [second first], got %v", got)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "token: ******" || resp.ContentLength != int64(len(body)) {
+		t.Errorf("want body redacted with length, got %q %d", body, resp.ContentLength)
+	}
+}
+
+func Test_BufferBody_limit(t *testing.T) {
+	resp := &http.Response{
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(strings.NewReader("0123456789")),
+	}
+	if _, err := plugin.BufferBody(resp, 4); err != plugin.ErrBodyTooLarge {
+		t.Errorf("want error %v, got %v", plugin.ErrBodyTooLarge, err)
+	}
+	// body is still readable as is
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "0123456789" {
+		t.Errorf("want body 0123456789, got %q", body)
+	}
+}
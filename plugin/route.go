@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"github.com/jademperor/common/models"
+)
+
+// RouteKind kind of rule matched
+type RouteKind string
+
+const (
+	// RouteAPI API rule matched
+	RouteAPI RouteKind = "api"
+	// RouteTranscoding transcoding rule matched
+	RouteTranscoding RouteKind = "transcoding"
+	// RouteRouting routing rule matched
+	RouteRouting RouteKind = "routing"
+)
+
+// Route matched by proxier before plugins executed, so plugins could
+// make rule-aware decisions.
+type Route struct {
+	Kind RouteKind
+	// API matched API rule, only set if Kind is RouteAPI
+	API *models.API
+	// Routing matched routing rule, only set if Kind is RouteRouting
+	Routing *models.Routing
+	// Params path params of API rule or transcoding rule
+	Params map[string]string
+	// ClusterID target cluster to proxy to
+	ClusterID string
+
+	// Target private target of matched rule, only used by proxier
+	Target interface{}
+}
+
+// RuleID get idx of matched API or routing rule, empty if nil or
+// transcoding rule matched.
+func (r *Route) RuleID() string {
+	if r == nil {
+		return ""
+	}
+	switch r.Kind {
+	case RouteAPI:
+		return r.API.Idx
+	case RouteRouting:
+		return r.Routing.Idx
+	}
+	return ""
+}